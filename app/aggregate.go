@@ -4,15 +4,21 @@ import (
 	"../vaas"
 	gomapinfer "github.com/mitroadmaps/gomapinfer/common"
 
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 )
 
 type LabeledSlice struct {
 	Slice vaas.Slice
 	Background *DBSeries
 	Data vaas.Data
+	// sampling frequency of Data
+	Freq int
 }
 
 // specifier/reference for where we can get one or more LabeledSlices
@@ -61,6 +67,7 @@ func (r LabeledSliceRef) Resolve(f func(l LabeledSlice) error) error {
 			Slice: item.Slice,
 			Background: background,
 			Data: data,
+			Freq: item.Freq,
 		})
 	} else if r.Node != nil {
 		segment := GetSegment(r.Slice.Segment.ID)
@@ -87,6 +94,7 @@ func (r LabeledSliceRef) Resolve(f func(l LabeledSlice) error) error {
 			Slice: slice,
 			Background: background,
 			Data: data,
+			Freq: item.Freq,
 		})
 	} else if len(r.Data) > 0 {
 		segment := GetSegment(r.Slice.Segment.ID)
@@ -96,11 +104,157 @@ func (r LabeledSliceRef) Resolve(f func(l LabeledSlice) error) error {
 			Slice: slice,
 			Background: background,
 			Data: data,
+			Freq: 1,
 		})
 	}
 	panic(fmt.Errorf("bad LabeledSliceSpec"))
 }
 
+// Label for tracks that start or end outside all of the zones.
+const ODOutside = "(outside)"
+
+type ODExample struct {
+	// the frames where the track is visible
+	Slice vaas.Slice
+	TrackID int
+}
+
+// Origin-destination matrix: the number of tracks between each pair of zones.
+type ODMatrix struct {
+	// row and column labels: the zone names followed by ODOutside
+	Zones []string
+	// Counts[i][j] is the number of tracks that start in Zones[i] and end in Zones[j]
+	Counts [][]int
+	Examples [][][]ODExample
+
+	// parts of tracks added so far, one per track in each slice
+	parts []odTrackPart
+}
+
+type odTrackPart struct {
+	// the LabeledSlice containing this part
+	Slice vaas.Slice
+	TrackID int
+	// the frames where the track is visible in the slice
+	Start int
+	End int
+	// first and last detection, resized to the zone CanvasDims
+	First vaas.Detection
+	Last vaas.Detection
+}
+
+func NewODMatrix(zones []vaas.Zone) *ODMatrix {
+	m := &ODMatrix{}
+	for _, zone := range zones {
+		m.Zones = append(m.Zones, zone.Name)
+	}
+	m.Zones = append(m.Zones, ODOutside)
+	m.Counts = make([][]int, len(m.Zones))
+	m.Examples = make([][][]ODExample, len(m.Zones))
+	for i := range m.Zones {
+		m.Counts[i] = make([]int, len(m.Zones))
+		m.Examples[i] = make([][]ODExample, len(m.Zones))
+	}
+	return m
+}
+
+// Adds the tracks in a LabeledSlice. They are only counted by Finish, since
+// tracks may continue in slices that are added later.
+func (m *ODMatrix) Add(l LabeledSlice, canvasDims [2]int) error {
+	if l.Data.Type() != vaas.TrackType {
+		return fmt.Errorf("expected track data but got %s", l.Data.Type())
+	}
+	freq := l.Freq
+	if freq < 1 {
+		freq = 1
+	}
+	data := l.Data.(vaas.DetectionData).Resize(canvasDims)
+	for _, track := range vaas.DetectionsToTracks(data.D) {
+		first := track[0]
+		last := track[len(track)-1]
+		part := odTrackPart{
+			Slice: l.Slice,
+			TrackID: first.TrackID,
+			Start: l.Slice.Start + first.FrameIdx*freq,
+			End: l.Slice.Start + (last.FrameIdx+1)*freq,
+			First: first.Detection,
+			Last: last.Detection,
+		}
+		if part.End > l.Slice.End {
+			part.End = l.Slice.End
+		}
+		m.parts = append(m.parts, part)
+	}
+	return nil
+}
+
+// Counts the tracks that were added.
+// Stateful trackers keep track IDs across contiguous slices of a segment, so
+// parts with the same ID in contiguous slices are merged into one track.
+// The zone of a track is the first zone (in configuration order) containing the
+// center of its first or last detection.
+func (m *ODMatrix) Finish(zones []vaas.Zone, maxExamples int) {
+	sort.SliceStable(m.parts, func(i, j int) bool {
+		a, b := m.parts[i], m.parts[j]
+		if a.Slice.Segment.ID != b.Slice.Segment.ID {
+			return a.Slice.Segment.ID < b.Slice.Segment.ID
+		}
+		return a.Slice.Start < b.Slice.Start
+	})
+	var tracks []*odTrackPart
+	// the last track with each segment ID and track ID
+	byID := make(map[[2]int]*odTrackPart)
+	for _, part := range m.parts {
+		k := [2]int{part.Slice.Segment.ID, part.TrackID}
+		if track := byID[k]; track != nil && track.Slice.End == part.Slice.Start {
+			track.Slice.End = part.Slice.End
+			track.End = part.End
+			track.Last = part.Last
+			continue
+		}
+		track := part
+		tracks = append(tracks, &track)
+		byID[k] = &track
+	}
+	m.parts = nil
+
+	zoneIdx := func(d vaas.Detection) int {
+		idx := vaas.FindZone(zones, d)
+		if idx == -1 {
+			return len(zones)
+		}
+		return idx
+	}
+	for _, track := range tracks {
+		i := zoneIdx(track.First)
+		j := zoneIdx(track.Last)
+		m.Counts[i][j]++
+		if len(m.Examples[i][j]) >= maxExamples {
+			continue
+		}
+		m.Examples[i][j] = append(m.Examples[i][j], ODExample{
+			Slice: vaas.Slice{track.Slice.Segment, track.Start, track.End},
+			TrackID: track.TrackID,
+		})
+	}
+}
+
+// Returns the counts as CSV, with origins as rows and destinations as columns.
+func (m *ODMatrix) CSV() []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(append([]string{"origin/destination"}, m.Zones...))
+	for i, origin := range m.Zones {
+		row := []string{origin}
+		for _, count := range m.Counts[i] {
+			row = append(row, strconv.Itoa(count))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
 func init() {
 	type AggregateResponse struct {
 		URL string
@@ -181,4 +335,55 @@ func init() {
 			fmt.Sprintf("/cache/view?id=%s&type=jpeg", id),
 		})
 	})
+
+	http.HandleFunc("/aggregates/od", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		var request struct {
+			Refs []LabeledSliceRef
+			// zone shapes are relative to these dimensions
+			CanvasDims [2]int
+			Zones []vaas.Zone
+			// maximum number of example slices for each cell
+			MaxExamples int
+		}
+		if err := vaas.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		if request.MaxExamples == 0 {
+			request.MaxExamples = 5
+		}
+		// otherwise every box is resized to (0, 0) and all tracks are outside the zones
+		if request.CanvasDims[0] <= 0 || request.CanvasDims[1] <= 0 {
+			http.Error(w, "CanvasDims must be set to the dimensions of the zone coordinates", 400)
+			return
+		}
+		for _, zone := range request.Zones {
+			if len(zone.Shape) < 2 {
+				http.Error(w, fmt.Sprintf("zone %s has no shape", zone.Name), 400)
+				return
+			}
+		}
+
+		m := NewODMatrix(request.Zones)
+		for _, ref := range request.Refs {
+			err := ref.Resolve(func(l LabeledSlice) error {
+				return m.Add(l, request.CanvasDims)
+			})
+			if err != nil {
+				log.Printf("[/aggregates/od] failed to compute origin-destination matrix: %v", err)
+				http.Error(w, fmt.Sprintf("failed to compute origin-destination matrix: %v", err), 400)
+				return
+			}
+		}
+		m.Finish(request.Zones, request.MaxExamples)
+
+		id := cache.Add(m)
+		vaas.JsonResponse(w, struct {
+			*ODMatrix
+			CSVURL string
+		}{m, fmt.Sprintf("/cache/view?id=%s&type=csv", id)})
+	})
 }
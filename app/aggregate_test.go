@@ -0,0 +1,54 @@
+package app
+
+import (
+	"../vaas"
+	"testing"
+)
+
+func TestODMatrixAcrossSlices(t *testing.T) {
+	zones := []vaas.Zone{
+		{Name: "A", Shape: vaas.Shape{{0, 0}, {50, 100}}},
+		{Name: "B", Shape: vaas.Shape{{50, 0}, {100, 100}}},
+	}
+	seg := vaas.Segment{ID: 1}
+	// a slice with track 1 centered at each x in turn, sampled at freq=2
+	slice := func(start int, xs ...int) LabeledSlice {
+		data := vaas.DetectionData{T: vaas.TrackType}
+		for _, x := range xs {
+			data.D = append(data.D, vaas.DetectionFrame{
+				Detections: []vaas.Detection{{Left: x-5, Top: 40, Right: x+5, Bottom: 50, TrackID: 1}},
+				CanvasDims: [2]int{200, 200},
+			})
+		}
+		return LabeledSlice{
+			Slice: vaas.Slice{seg, start, start+2*len(xs)},
+			Data: data,
+			Freq: 2,
+		}
+	}
+
+	m := NewODMatrix(zones)
+	// track 1 moves from A to B over two contiguous slices, which are added out
+	// of order; the slice at 100 isn't contiguous, so its track 1 is another track
+	for _, l := range []LabeledSlice{slice(10, 100, 120), slice(0, 20, 40, 60, 80, 100), slice(100, 20, 40)} {
+		if err := m.Add(l, [2]int{100, 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Finish(zones, 5)
+
+	if m.Counts[0][1] != 1 || m.Counts[0][0] != 1 {
+		t.Fatalf("expected one track A->B and one A->A but got %v", m.Counts)
+	}
+	for i := range m.Counts {
+		for j := range m.Counts[i] {
+			if (i != 0 || j > 1) && m.Counts[i][j] != 0 {
+				t.Fatalf("unexpected counts %v", m.Counts)
+			}
+		}
+	}
+	example := m.Examples[0][1][0]
+	if example.Slice != (vaas.Slice{seg, 0, 14}) || example.TrackID != 1 {
+		t.Fatalf("expected example spanning both slices but got %v", example)
+	}
+}
@@ -62,12 +62,14 @@ type MinimalAllocator struct {
 	mu sync.Mutex
 }
 
-var allocator = &SmartAllocator{
+var smartAllocator = &SmartAllocator{
 	envSets: make(map[vaas.EnvSetID]vaas.EnvSet),
 	containers: make(map[vaas.EnvSetID][][]vaas.Container),
 	roundRobinIdx: make(map[vaas.EnvSetID][]int),
 }
 
+var allocator Allocator = smartAllocator
+
 func GetAllocator() Allocator {
 	return allocator
 }
@@ -97,6 +99,32 @@ func (a *MinimalAllocator) Allocate(set vaas.EnvSet) []vaas.Container {
 	panic(fmt.Errorf("TODO: implement de-allocation"))
 }
 
+// Returns whether the requirements (e.g. gpu, container, memory in MB, cpu in cores)
+// fit in the free resources of a machine.
+// Resources that the machine doesn't report (e.g. memory if the machine couldn't
+// determine it) are unknown, and we don't enforce requirements on them.
+func resourcesFit(free map[string]int, requirements map[string]int) bool {
+	for k, v := range requirements {
+		if _, ok := free[k]; !ok {
+			continue
+		}
+		if free[k] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// Subtracts the requirements from the free resources of a machine, skipping
+// resources that the machine doesn't report.
+func useResources(free map[string]int, requirements map[string]int) {
+	for k, v := range requirements {
+		if _, ok := free[k]; ok {
+			free[k] -= v
+		}
+	}
+}
+
 // caller must have the lock
 func (a *MinimalAllocator) tryAllocate(set vaas.EnvSet) bool {
 	// try to fit the envset, return false if it's not possible
@@ -111,22 +139,13 @@ func (a *MinimalAllocator) tryAllocate(set vaas.EnvSet) bool {
 		}
 	}
 	for _, container := range a.FlatContainers() {
-		for k, v := range container.Environment.Requirements {
-			machineUsage[container.MachineIdx][k] -= v
-		}
+		useResources(machineUsage[container.MachineIdx], container.Environment.Requirements)
 	}
 	var allocation []int
 	for _, env := range set.Environments {
 		var bestMachineIdx int = -1
 		for i, usage := range machineUsage {
-			ok := true
-			for k, v := range env.Requirements {
-				if usage[k] < v {
-					ok = false
-					break
-				}
-			}
-			if !ok {
+			if !resourcesFit(usage, env.Requirements) {
 				continue
 			}
 			if bestMachineIdx == -1 || machineHits[i] > machineHits[bestMachineIdx] {
@@ -136,9 +155,7 @@ func (a *MinimalAllocator) tryAllocate(set vaas.EnvSet) bool {
 		if bestMachineIdx == -1 {
 			return false
 		}
-		for k, v := range env.Requirements {
-			machineUsage[bestMachineIdx][k] -= v
-		}
+		useResources(machineUsage[bestMachineIdx], env.Requirements)
 		allocation = append(allocation, bestMachineIdx)
 	}
 
@@ -169,7 +186,7 @@ func (a *MinimalAllocator) Deallocate(setID vaas.EnvSetID) {
 	}
 	for _, container := range a.containers[setID] {
 		log.Printf("[allocator] begin de-allocating container %s", container.UUID)
-		resp, err := http.PostForm(Machines.GetList()[container.MachineIdx].BaseURL + "/deallocate", url.Values{"uuid": {container.UUID}})
+		resp, err := vaas.InternalClient.PostForm(Machines.GetList()[container.MachineIdx].BaseURL + "/deallocate", url.Values{"uuid": {container.UUID}})
 		if err != nil {
 			panic(fmt.Errorf("de-allocation error: %v", err))
 		} else if resp.StatusCode != 200 {
@@ -205,12 +222,77 @@ func (a *MinimalAllocator) GetContainers(setID vaas.EnvSetID) [][]vaas.Container
 	return containers
 }
 
+// Functions that should be notified when a machine reports that one of its containers exited.
+// Listeners are keyed so that e.g. jobs can stop listening once they finish.
+var containerExitListeners = make(map[int]func(vaas.ContainerExit))
+var containerExitCounter int
+var containerExitMu sync.Mutex
+
+func AddContainerExitListener(f func(vaas.ContainerExit)) int {
+	containerExitMu.Lock()
+	defer containerExitMu.Unlock()
+	id := containerExitCounter
+	containerExitCounter++
+	containerExitListeners[id] = f
+	return id
+}
+
+func RemoveContainerExitListener(id int) {
+	containerExitMu.Lock()
+	delete(containerExitListeners, id)
+	containerExitMu.Unlock()
+}
+
+func OnContainerExited(exit vaas.ContainerExit) {
+	containerExitMu.Lock()
+	var listeners []func(vaas.ContainerExit)
+	for _, f := range containerExitListeners {
+		listeners = append(listeners, f)
+	}
+	containerExitMu.Unlock()
+	for _, f := range listeners {
+		f(exit)
+	}
+
+	// if the machine could not restart the container, then we need to de-allocate
+	// the environment set that it belongs to, so that it is re-allocated on next use
+	if exit.Restarted {
+		return
+	}
+	for _, setID := range allocator.GetEnvSets() {
+		found := false
+		for _, clist := range allocator.GetContainers(setID) {
+			for _, container := range clist {
+				if container.UUID == exit.UUID {
+					found = true
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+		// de-allocate in the background since stopping the other containers of the
+		// set waits for their machines, and the machine is waiting for our reply
+		go func(setID vaas.EnvSetID) {
+			defer func() {
+				// Deallocate panics on errors stopping containers, which would
+				// otherwise bring down the coordinator
+				if err := recover(); err != nil {
+					log.Printf("[allocator] error de-allocating %v after container %s exited: %v", setID, exit.UUID, err)
+				}
+			}()
+			allocator.Deallocate(setID)
+		}(setID)
+	}
+}
+
 func init() {
 	QueryChangeListeners = append(QueryChangeListeners, func(query *DBQuery) {
 		allocator.Deallocate(vaas.EnvSetID{"query", query.ID})
 	})
 
-	http.HandleFunc("/register-machine", func(w http.ResponseWriter, r *http.Request) {
+	// called from machine
+	http.HandleFunc("/register-machine", vaas.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(404)
 			return
@@ -220,5 +302,19 @@ func init() {
 			return
 		}
 		Machines.Register(machine)
-	})
+	}))
+
+	// called from machine
+	http.HandleFunc("/container-exited", vaas.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		var exit vaas.ContainerExit
+		if err := vaas.ParseJsonRequest(w, r, &exit); err != nil {
+			return
+		}
+		log.Printf("[allocator] container %s (%s) %s (restarted=%v)", exit.UUID, exit.BaseURL, exit.Reason, exit.Restarted)
+		OnContainerExited(exit)
+	}))
 }
@@ -0,0 +1,299 @@
+package app
+
+import (
+	"../vaas"
+
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The autoscaler periodically adjusts the number of replicas of each environment
+// in the allocated query EnvSets based on the idle fraction of the nodes they run.
+// A node with low idle fraction spends most of its time computing rather than
+// waiting for its inputs, so it is a bottleneck and should get more replicas.
+const AutoscaleInterval = 30*time.Second
+
+// Don't re-scale an EnvSet more often than this, so that stats reflect the last decision.
+const AutoscaleCooldown = 60*time.Second
+
+// Add replicas to environments whose idle fraction is below this.
+const ScaleUpIdle = 0.2
+
+// Remove replicas from environments whose idle fraction is above this.
+const ScaleDownIdle = 0.7
+
+// Removed containers keep running for at least this long, and then until they
+// have no in-progress work (or DrainTimeout passes).
+const DrainTime = 30*time.Second
+const DrainTimeout = 30*time.Minute
+
+// How often we check whether a draining container is idle.
+const DrainPollInterval = 5*time.Second
+
+// Only keep this many decisions in the scaling log.
+const ScalingLogSize = 1000
+
+type ScalingDecision struct {
+	Time time.Time
+	SetID vaas.EnvSetID
+	EnvIdx int
+	Template string
+	// node ID, or 0 for the default environment
+	RefID int
+
+	// "add", "remove", or "add-failed" if the machines are full
+	Action string
+	Idle float64
+	// number of replicas after the action
+	Replicas int
+	Reason string
+}
+
+var scalingLog []ScalingDecision
+var scalingLogMu sync.Mutex
+
+func recordScalingDecision(d ScalingDecision) {
+	log.Printf("[autoscale] [set %v] %s replica of env %d (template=%s ref=%d idle=%.2f replicas=%d): %s", d.SetID, d.Action, d.EnvIdx, d.Template, d.RefID, d.Idle, d.Replicas, d.Reason)
+	scalingLogMu.Lock()
+	scalingLog = append(scalingLog, d)
+	if len(scalingLog) > ScalingLogSize {
+		scalingLog = append([]ScalingDecision{}, scalingLog[len(scalingLog)-ScalingLogSize:]...)
+	}
+	scalingLogMu.Unlock()
+}
+
+func GetScalingLog() []ScalingDecision {
+	scalingLogMu.Lock()
+	defer scalingLogMu.Unlock()
+	return append([]ScalingDecision{}, scalingLog...)
+}
+
+// Allocate one more container for an environment in the set.
+// Returns false if no machine has enough free resources.
+func (a *SmartAllocator) addReplica(setID vaas.EnvSetID, envIdx int) (int, bool) {
+	machines := Machines.GetList()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.containers[setID] == nil {
+		return 0, false
+	}
+	env := a.envSets[setID].Environments[envIdx]
+	var machineIdx int = -1
+	for i, free := range a.machineFree() {
+		if resourcesFit(free, env.Requirements) {
+			machineIdx = i
+			break
+		}
+	}
+	if machineIdx == -1 {
+		return len(a.containers[setID][envIdx]), false
+	}
+	var container vaas.Container
+	err := vaas.JsonPost(machines[machineIdx].BaseURL, "/allocate", env, &container)
+	if err != nil {
+		log.Printf("[autoscale] [set %v] error allocating container on machine %d: %v", setID, machineIdx, err)
+		return len(a.containers[setID][envIdx]), false
+	}
+	container.Environment = env
+	container.MachineIdx = machineIdx
+	a.containers[setID][envIdx] = append(a.containers[setID][envIdx], container)
+	return len(a.containers[setID][envIdx]), true
+}
+
+// Remove one container of an environment in the set, leaving at least one.
+// The container stops being picked immediately, but is only stopped once the
+// slices that were already assigned to it finish (see waitIdle).
+func (a *SmartAllocator) removeReplica(setID vaas.EnvSetID, envIdx int) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.containers[setID] == nil {
+		return 0, false
+	}
+	envlist := a.containers[setID][envIdx]
+	if len(envlist) <= 1 {
+		return len(envlist), false
+	}
+	container := envlist[len(envlist)-1]
+	a.removeContainer(setID, container)
+	a.draining = append(a.draining, container)
+	go func() {
+		time.Sleep(DrainTime)
+		waitIdle(container)
+		// stop it without the lock since this waits for its machine
+		// until then, it still counts against the machine's resources
+		func() {
+			defer func() {
+				// stopContainer panics on error, which would otherwise bring down the coordinator
+				if err := recover(); err != nil {
+					log.Printf("[autoscale] error stopping drained container %s: %v", container.UUID, err)
+				}
+			}()
+			a.stopContainer(container)
+		}()
+		a.mu.Lock()
+		var draining []vaas.Container
+		for _, c := range a.draining {
+			if c.UUID != container.UUID {
+				draining = append(draining, c)
+			}
+		}
+		a.draining = draining
+		a.mu.Unlock()
+	}()
+	return len(envlist)-1, true
+}
+
+// Wait until the container has no contexts with running executors or buffers
+// being streamed, i.e., no slices are in progress on it.
+func waitIdle(container vaas.Container) {
+	deadline := time.Now().Add(DrainTimeout)
+	for time.Now().Before(deadline) {
+		health, err := vaas.GetContainerHealth(container)
+		if err != nil {
+			// it's probably not running anymore
+			log.Printf("[autoscale] error checking draining container %s: %v", container.UUID, err)
+			return
+		}
+		if health.Active == 0 {
+			return
+		}
+		time.Sleep(DrainPollInterval)
+	}
+	log.Printf("[autoscale] draining container %s still busy after %v, stopping it anyway", container.UUID, DrainTimeout)
+}
+
+// Returns the idle fraction of each environment in a query's EnvSet.
+// Environments without stats are omitted.
+func envIdleFractions(query *DBQuery, set vaas.EnvSet) map[int]float64 {
+	query.Load()
+	nodeStats := statsManager.GetStatsByNode(query.ID)
+	// nodes without their own environment run in the default environment (RefID=0)
+	envStats := make(map[int]vaas.StatsSample)
+	for nodeID, sample := range nodeStats {
+		node := query.Nodes[nodeID]
+		if node == nil {
+			continue
+		}
+		refID := 0
+		if vaas.NodeEnvironment(*node) != nil {
+			refID = nodeID
+		}
+		envStats[refID] = envStats[refID].Add(sample)
+	}
+	idle := make(map[int]float64)
+	for envIdx, env := range set.Environments {
+		sample, ok := envStats[env.RefID]
+		if !ok || sample.Idle.Count == 0 {
+			continue
+		}
+		idle[envIdx] = sample.Idle.Fraction
+	}
+	return idle
+}
+
+type Autoscaler struct {
+	lastScaled map[vaas.EnvSetID]time.Time
+	// when we last recorded an add-failed decision for each set
+	lastFailed map[vaas.EnvSetID]time.Time
+}
+
+func (s *Autoscaler) iter() {
+	for _, setID := range smartAllocator.GetEnvSets() {
+		if setID.Type != "query" {
+			continue
+		}
+		if time.Now().Sub(s.lastScaled[setID]) < AutoscaleCooldown {
+			continue
+		}
+		query := GetQuery(setID.RefID)
+		if query == nil {
+			continue
+		}
+		smartAllocator.mu.Lock()
+		set, ok := smartAllocator.envSets[setID]
+		smartAllocator.mu.Unlock()
+		if !ok {
+			continue
+		}
+		idle := envIdleFractions(query, set)
+		if s.scaleSet(set, idle) {
+			s.lastScaled[setID] = time.Now()
+		}
+	}
+}
+
+// Make at most one scale-up and one scale-down decision for the set.
+// Returns true if any replicas were added or removed.
+func (s *Autoscaler) scaleSet(set vaas.EnvSet, idle map[int]float64) bool {
+	// find the most and least idle environments
+	var bottleneckIdx, idlestIdx int = -1, -1
+	for envIdx, fraction := range idle {
+		if bottleneckIdx == -1 || fraction < idle[bottleneckIdx] {
+			bottleneckIdx = envIdx
+		}
+		if idlestIdx == -1 || fraction > idle[idlestIdx] {
+			idlestIdx = envIdx
+		}
+	}
+	if bottleneckIdx == -1 {
+		return false
+	}
+	decision := func(envIdx int, action string, replicas int, reason string) {
+		env := set.Environments[envIdx]
+		recordScalingDecision(ScalingDecision{
+			Time: time.Now(),
+			SetID: set.ID,
+			EnvIdx: envIdx,
+			Template: env.Template,
+			RefID: env.RefID,
+			Action: action,
+			Idle: idle[envIdx],
+			Replicas: replicas,
+			Reason: reason,
+		})
+	}
+
+	changed := false
+	// resources freed by a removal are only available after DrainTime, so if the machines
+	// are full the bottleneck gets them in a later iteration
+	if idle[idlestIdx] > ScaleDownIdle && idlestIdx != bottleneckIdx {
+		replicas, ok := smartAllocator.removeReplica(set.ID, idlestIdx)
+		if ok {
+			decision(idlestIdx, "remove", replicas, fmt.Sprintf("idle fraction above %v", ScaleDownIdle))
+			changed = true
+		}
+	}
+	if idle[bottleneckIdx] < ScaleUpIdle {
+		replicas, ok := smartAllocator.addReplica(set.ID, bottleneckIdx)
+		if ok {
+			decision(bottleneckIdx, "add", replicas, fmt.Sprintf("idle fraction below %v", ScaleUpIdle))
+			changed = true
+		} else if time.Now().Sub(s.lastFailed[set.ID]) >= AutoscaleCooldown {
+			// record that we wanted to scale up so users can see the machines are full
+			// we'll keep failing until resources are freed, so only record it once per cooldown
+			decision(bottleneckIdx, "add-failed", replicas, "no machine has enough free resources")
+			s.lastFailed[set.ID] = time.Now()
+		}
+	}
+	return changed
+}
+
+func init() {
+	autoscaler := &Autoscaler{
+		lastScaled: make(map[vaas.EnvSetID]time.Time),
+		lastFailed: make(map[vaas.EnvSetID]time.Time),
+	}
+	go func() {
+		for {
+			time.Sleep(AutoscaleInterval)
+			autoscaler.iter()
+		}
+	}()
+
+	http.HandleFunc("/allocator/scaling-log", func(w http.ResponseWriter, r *http.Request) {
+		vaas.JsonResponse(w, GetScalingLog())
+	})
+}
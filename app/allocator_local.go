@@ -0,0 +1,94 @@
+package app
+
+import (
+	"../vaas"
+	gouuid "github.com/google/uuid"
+
+	"log"
+	"sync"
+)
+
+// Runs every environment in the coordinator process instead of on machines.
+// This is meant for development and CI, where we don't want to start machine and
+// container processes. Each environment gets one in-process container, and
+// ExecContext calls it directly instead of over HTTP.
+type LocalAllocator struct {
+	envSets map[vaas.EnvSetID]vaas.EnvSet
+	containers map[vaas.EnvSetID][]vaas.Container
+	mu sync.Mutex
+}
+
+// Switch to running executors in-process.
+// Must be called before any queries are executed.
+func UseLocalAllocator() {
+	log.Printf("[allocator] running executors in-process")
+	allocator = &LocalAllocator{
+		envSets: make(map[vaas.EnvSetID]vaas.EnvSet),
+		containers: make(map[vaas.EnvSetID][]vaas.Container),
+	}
+}
+
+func (a *LocalAllocator) Pick(setID vaas.EnvSetID) []vaas.Container {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.containers[setID]
+}
+
+func (a *LocalAllocator) Allocate(set vaas.EnvSet) []vaas.Container {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.containers[set.ID] != nil {
+		return a.containers[set.ID]
+	}
+	var containers []vaas.Container
+	for _, env := range set.Environments {
+		rt := vaas.NewContainerRuntime(gouuid.New().String(), func(request vaas.AddOutputItemRequest) vaas.Item {
+			return AddOutputItem(request).Item
+		})
+		rt.SaveState = SaveState
+		vaas.RegisterLocalContainer(rt)
+		log.Printf("[allocator] [set %v] started in-process container %s for env template=%s", set.ID, rt.UUID, env.Template)
+		containers = append(containers, vaas.Container{
+			UUID: rt.UUID,
+			Environment: env,
+			BaseURL: "local://" + rt.UUID,
+		})
+	}
+	a.envSets[set.ID] = set
+	a.containers[set.ID] = containers
+	return containers
+}
+
+func (a *LocalAllocator) Deallocate(setID vaas.EnvSetID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, container := range a.containers[setID] {
+		vaas.UnregisterLocalContainer(container.UUID)
+		log.Printf("[allocator] stopped in-process container %s", container.UUID)
+	}
+	delete(a.envSets, setID)
+	delete(a.containers, setID)
+}
+
+func (a *LocalAllocator) GetEnvSets() []vaas.EnvSetID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ids []vaas.EnvSetID
+	for id := range a.envSets {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (a *LocalAllocator) GetContainers(setID vaas.EnvSetID) [][]vaas.Container {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.containers[setID] == nil {
+		return nil
+	}
+	var containers [][]vaas.Container
+	for _, container := range a.containers[setID] {
+		containers = append(containers, []vaas.Container{container})
+	}
+	return containers
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"sync"
 )
@@ -15,11 +14,15 @@ import (
 // Automatically de-allocate queries that are idle for longer than 30 sec. (TODO)
 // Within a query, balance the resources among environments based on the idle time.
 // So initially, distribute resources evenly, but then shift resources from
-// environments with high average idle time to those with low idle time.
+// environments with high average idle time to those with low idle time (see allocator_autoscale.go).
 type SmartAllocator struct {
 	envSets map[vaas.EnvSetID]vaas.EnvSet
 	containers map[vaas.EnvSetID][][]vaas.Container
 	roundRobinIdx map[vaas.EnvSetID][]int
+
+	// containers removed by the autoscaler that are still finishing in-progress work
+	draining []vaas.Container
+
 	mu sync.Mutex
 }
 
@@ -47,10 +50,8 @@ func (a *SmartAllocator) machineFree() []map[string]int {
 			free[i][k] = v
 		}
 	}
-	for _, container := range a.flatContainers() {
-		for k, v := range container.Environment.Requirements {
-			free[container.MachineIdx][k] -= v
-		}
+	for _, container := range append(a.flatContainers(), a.draining...) {
+		useResources(free[container.MachineIdx], container.Environment.Requirements)
 	}
 	return free
 }
@@ -119,6 +120,10 @@ func (a *SmartAllocator) Allocate(set vaas.EnvSet) []vaas.Container {
 		for _, idx := range rand.Perm(len(setContainers)) {
 			container := setContainers[idx]
 			for k, v := range container.Environment.Requirements {
+				if _, ok := setResources[k]; !ok {
+					// no machine reports this resource
+					continue
+				}
 				if allocResources[k]+v <= setResources[k] {
 					allocResources[k] += v
 					continue
@@ -142,14 +147,7 @@ func (a *SmartAllocator) Allocate(set vaas.EnvSet) []vaas.Container {
 		free := a.machineFree()
 		var machineIdx int = -1
 		for i, free := range free {
-			ok := true
-			for k, v := range env.Requirements {
-				if free[k] < v {
-					ok = false
-					break
-				}
-			}
-			if !ok {
+			if !resourcesFit(free, env.Requirements) {
 				continue
 			}
 			machineIdx = i
@@ -181,10 +179,10 @@ func (a *SmartAllocator) Allocate(set vaas.EnvSet) []vaas.Container {
 	return a.pick(set)
 }
 
-// caller must have lock
-func (a *SmartAllocator) deallocate(setID vaas.EnvSetID, container vaas.Container) {
+// Stop a container on its machine.
+func (a *SmartAllocator) stopContainer(container vaas.Container) {
 	log.Printf("[allocator] begin de-allocating container %s", container.UUID)
-	resp, err := http.PostForm(Machines.GetList()[container.MachineIdx].BaseURL + "/deallocate", url.Values{"uuid": {container.UUID}})
+	resp, err := vaas.InternalClient.PostForm(Machines.GetList()[container.MachineIdx].BaseURL + "/deallocate", url.Values{"uuid": {container.UUID}})
 	if err != nil {
 		panic(fmt.Errorf("de-allocation error: %v", err))
 	} else if resp.StatusCode != 200 {
@@ -192,7 +190,11 @@ func (a *SmartAllocator) deallocate(setID vaas.EnvSetID, container vaas.Containe
 	}
 	resp.Body.Close()
 	log.Printf("[allocator] successfully de-allocated container %s", container.UUID)
+}
 
+// Remove a container from the set without stopping it.
+// Caller must have the lock.
+func (a *SmartAllocator) removeContainer(setID vaas.EnvSetID, container vaas.Container) {
 	newContainers := make([][]vaas.Container, len(a.containers[setID]))
 	for envIdx, envlist := range a.containers[setID] {
 		for _, c := range envlist {
@@ -205,6 +207,12 @@ func (a *SmartAllocator) deallocate(setID vaas.EnvSetID, container vaas.Containe
 	a.containers[setID] = newContainers
 }
 
+// caller must have lock
+func (a *SmartAllocator) deallocate(setID vaas.EnvSetID, container vaas.Container) {
+	a.stopContainer(container)
+	a.removeContainer(setID, container)
+}
+
 func (a *SmartAllocator) Deallocate(setID vaas.EnvSetID) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -151,6 +151,14 @@ func init() {
 					log.Printf("[cache] view: read from GetVideo: %v", err)
 				}
 			}
+		case *ODMatrix:
+			if contentType == "csv" {
+				w.Header().Set("Content-Type", "text/csv")
+				w.Header().Set("Content-Disposition", "attachment; filename=od.csv")
+				w.Write(v.CSV())
+			} else {
+				vaas.JsonResponse(w, v)
+			}
 		case *CachedDataBuffer:
 			if contentType == "json" {
 				rd := v.Buf.Reader()
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"../vaas"
+
+	"net/http"
+)
+
+func GetCalibration(timelineID int) *vaas.Calibration {
+	rows := db.Query("SELECT calibration FROM calibrations WHERE timeline_id = ?", timelineID)
+	var calib *vaas.Calibration
+	for rows.Next() {
+		var str string
+		rows.Scan(&str)
+		calib = new(vaas.Calibration)
+		vaas.JsonUnmarshal([]byte(str), calib)
+	}
+	return calib
+}
+
+func SetCalibration(calib vaas.Calibration) {
+	db.Exec(
+		"INSERT OR REPLACE INTO calibrations (timeline_id, calibration) VALUES (?, ?)",
+		calib.TimelineID, string(vaas.JsonMarshal(calib)),
+	)
+}
+
+func init() {
+	http.HandleFunc("/timelines/calibration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			r.ParseForm()
+			timelineID := vaas.ParseInt(r.Form.Get("timeline_id"))
+			vaas.JsonResponse(w, GetCalibration(timelineID))
+			return
+		} else if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var request struct {
+			TimelineID int
+			CanvasDims [2]int
+			Points []vaas.CalibrationPoint
+		}
+		if err := vaas.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		if GetTimeline(request.TimelineID) == nil {
+			http.Error(w, "no such timeline", 404)
+			return
+		}
+		if len(request.Points) == 0 {
+			db.Exec("DELETE FROM calibrations WHERE timeline_id = ?", request.TimelineID)
+			return
+		}
+		calib, err := vaas.NewCalibration(request.TimelineID, request.CanvasDims, request.Points)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		SetCalibration(calib)
+		vaas.JsonResponse(w, calib)
+	})
+}
@@ -21,11 +21,16 @@ type Database struct {
 }
 
 func init() {
-	sdb, err := sql.Open("sqlite3", "./skyhook.sqlite3")
+	db = openDatabase("./skyhook.sqlite3")
+}
+
+// Opens the database, creating the tables that don't exist.
+func openDatabase(fname string) *Database {
+	sdb, err := sql.Open("sqlite3", fname)
 	if err != nil {
 		panic(err)
 	}
-	db = &Database{db: sdb}
+	db := &Database{db: sdb}
 
 	db.Exec(`CREATE TABLE IF NOT EXISTS timelines (
 		id INTEGER PRIMARY KEY ASC,
@@ -73,8 +78,14 @@ func init() {
 		height INTEGER NOT NULL DEFAULT 0,
 		freq INTEGER NOT NULL DEFAULT 1,
 		-- used during data import if item is in data series
-		percent INTEGER NOT NULL DEFAULT 100
+		percent INTEGER NOT NULL DEFAULT 100,
+		-- set if the item is a node output computed under the per-frame mask
+		-- of the query selector (see DBQuery.ClearGatedOutputs)
+		masked INTEGER NOT NULL DEFAULT 0
 	)`)
+	// databases created before the masked column was added don't have it
+	// this fails if the column exists already
+	db.db.Exec("ALTER TABLE items ADD COLUMN masked INTEGER NOT NULL DEFAULT 0")
 	db.Exec(`CREATE TABLE IF NOT EXISTS nodes (
 		id INTEGER PRIMARY KEY ASC,
 		name TEXT NOT NULL,
@@ -109,6 +120,19 @@ func init() {
 		type TEXT NOT NULL,
 		detail TEXT NOT NULL DEFAULT ''
 	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS calibrations (
+		timeline_id INTEGER PRIMARY KEY REFERENCES timelines(id),
+		-- JSON-encoded vaas.Calibration
+		calibration TEXT NOT NULL
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS node_states (
+		vnode_id INTEGER REFERENCES vnodes(id),
+		segment_id INTEGER REFERENCES segments(id),
+		-- the state is at the end of a slice ending at this frame
+		frame INTEGER,
+		state BLOB NOT NULL,
+		PRIMARY KEY(vnode_id, segment_id, frame)
+	)`)
 	db.Exec(`CREATE TABLE IF NOT EXISTS suggestions (
 		id INTEGER PRIMARY KEY ASC,
 		query_id TEXT NOT NULL,
@@ -117,6 +141,7 @@ func init() {
 		type TEXT NOT NULL,
 		config TEXT NOT NULL DEFAULT ''
 	)`)
+	return db
 }
 
 func (this *Database) Query(q string, args ...interface{}) *Rows {
@@ -20,11 +20,8 @@ func (query *DBQuery) GetEnvSet() vaas.EnvSet {
 		},
 	})
 	for _, node := range query.Nodes {
-		meta := vaas.Executors[node.Type]
-		if meta.Environment != nil {
-			env := *meta.Environment
-			env.RefID = node.ID
-			environments = append(environments, env)
+		if env := vaas.NodeEnvironment(*node); env != nil {
+			environments = append(environments, *env)
 		}
 	}
 	return vaas.EnvSet{envSetID, environments}
@@ -69,6 +66,9 @@ func (query *DBQuery) Allocate(vector []*DBSeries, slice vaas.Slice) vaas.ExecCo
 	for _, series := range vector {
 		context.Vector = append(context.Vector, series.Series)
 	}
+	if segment := GetSegment(slice.Segment.ID); segment != nil {
+		context.Calibration = GetCalibration(segment.Timeline.ID)
+	}
 
 	// find items that already exist on disk
 	for _, node := range query.Nodes {
@@ -103,6 +103,9 @@ func (query *DBQuery) RunBuffer(vector []*DBSeries, slice vaas.Slice, opts vaas.
 	if context.Opts.IgnoreItems {
 		context.Items = nil
 	}
+	if context.Opts.ChainStates {
+		context.States = query.GetStates(vector, slice)
+	}
 
 	var selector *vaas.Node
 	var outputs [][]vaas.Parent
@@ -132,6 +135,12 @@ func (query *DBQuery) RunBuffer(vector []*DBSeries, slice vaas.Slice, opts vaas.
 		if data.IsEmpty() {
 			return nil, fmt.Errorf("selector reject")
 		}
+
+		// the selector is also applied per frame: expensive nodes downstream only
+		// process the frames where the selector output is not empty
+		// the selector and its ancestors are already computed under this context
+		// so they are not affected by the mask
+		context.Mask = selectorMask(data, rd.Freq(), slice.Length())
 	}
 
 	// get the outputs for rendering
@@ -156,6 +165,24 @@ func (query *DBQuery) RunBuffer(vector []*DBSeries, slice vaas.Slice, opts vaas.
 	return buffers, nil
 }
 
+// Returns the frames of a slice of the given length where the selector output,
+// sampled at freq, is not empty, or nil if all frames are selected.
+func selectorMask(data vaas.Data, freq int, length int) []bool {
+	mask := make([]bool, length)
+	rejected := false
+	for i := range mask {
+		idx := i/freq
+		mask[i] = idx < data.Length() && !data.Slice(idx, idx+1).IsEmpty()
+		if !mask[i] {
+			rejected = true
+		}
+	}
+	if !rejected {
+		return nil
+	}
+	return mask
+}
+
 func (query *DBQuery) Run(vector []*DBSeries, slice vaas.Slice, opts vaas.ExecOptions) ([][]vaas.DataReader, error) {
 	buffers, err := query.RunBuffer(vector, slice, opts)
 	if err != nil {
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"../vaas"
+
+	"net/http"
+)
+
+// Returns the state that a stateful node exported at the end of a slice of the
+// segment ending at frame, or nil if there is none.
+func (vn *DBVNode) GetState(segmentID int, frame int) []byte {
+	rows := db.Query("SELECT state FROM node_states WHERE vnode_id = ? AND segment_id = ? AND frame = ?", vn.ID, segmentID, frame)
+	var state []byte
+	for rows.Next() {
+		rows.Scan(&state)
+	}
+	return state
+}
+
+func (vn *DBVNode) ClearStates() {
+	db.Exec("DELETE FROM node_states WHERE vnode_id = ?", vn.ID)
+}
+
+func SaveState(request vaas.SaveStateRequest) {
+	node := &DBNode{Node: request.Node}
+	vector := VectorFromList(request.Vector)
+	vn := GetOrCreateVNode(node, vector)
+	db.Exec(
+		"INSERT OR REPLACE INTO node_states (vnode_id, segment_id, frame, state) VALUES (?, ?, ?, ?)",
+		vn.ID, request.Slice.Segment.ID, request.Slice.End, request.State,
+	)
+}
+
+// Returns the states that the stateful nodes of the query exported at the end of
+// the slice of the segment ending where this slice starts, by node ID.
+func (query *DBQuery) GetStates(vector []*DBSeries, slice vaas.Slice) map[int][]byte {
+	query.Load()
+	states := make(map[int][]byte)
+	for _, node := range query.Nodes {
+		if !vaas.Executors[node.Type].Stateful {
+			continue
+		}
+		vn := GetOrCreateVNode(&DBNode{Node: *node}, vector)
+		if state := vn.GetState(slice.Segment.ID, slice.Start); state != nil {
+			states[node.ID] = state
+		}
+	}
+	return states
+}
+
+// Returns whether any node in the query has a stateful executor.
+func (query *DBQuery) IsStateful() bool {
+	query.Load()
+	for _, node := range query.Nodes {
+		if vaas.Executors[node.Type].Stateful {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	// called from container
+	http.HandleFunc("/exec/save-state", vaas.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var request vaas.SaveStateRequest
+		if err := vaas.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		SaveState(request)
+	}))
+}
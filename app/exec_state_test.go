@@ -0,0 +1,61 @@
+package app
+
+import (
+	"../vaas"
+
+	"testing"
+)
+
+func init() {
+	vaas.Executors["test-stateful"] = vaas.ExecutorMeta{Stateful: true}
+}
+
+func TestGetStates(t *testing.T) {
+	defer testDatabase(t)()
+
+	timeline := NewTimeline("test")
+	input := NewSeries(timeline.ID, "video", vaas.VideoType)
+	vector := []*DBSeries{input}
+	query := GetQuery(db.Exec("INSERT INTO queries (name) VALUES ('test')").LastInsertId())
+	tracker := query.AddNode("tracker", "test-stateful", vaas.TrackType)
+	detector := query.AddNode("detector", "yolov3", vaas.DetectionType)
+	seg1 := timeline.AddSegment("segment1", 100, 25).Segment
+	seg2 := timeline.AddSegment("segment2", 100, 25).Segment
+	save := func(node *DBNode, slice vaas.Slice, state string) {
+		SaveState(vaas.SaveStateRequest{
+			Node: node.Node,
+			Vector: []vaas.Series{input.Series},
+			Slice: slice,
+			State: []byte(state),
+		})
+	}
+	save(tracker, vaas.Slice{seg1, 0, 10}, "seg1-10")
+	save(tracker, vaas.Slice{seg1, 10, 20}, "old")
+	save(tracker, vaas.Slice{seg1, 10, 20}, "seg1-20")
+	save(tracker, vaas.Slice{seg2, 0, 10}, "seg2-10")
+	// only stateful nodes get their state
+	save(detector, vaas.Slice{seg1, 0, 10}, "detector")
+
+	// the state is at the end of the previous slice of the same segment, and
+	// saving the same slice again replaces it
+	tests := []struct {
+		slice vaas.Slice
+		expected string
+	}{
+		{vaas.Slice{seg1, 0, 10}, ""},
+		{vaas.Slice{seg1, 10, 20}, "seg1-10"},
+		{vaas.Slice{seg1, 20, 30}, "seg1-20"},
+		{vaas.Slice{seg1, 15, 25}, ""},
+		{vaas.Slice{seg2, 10, 20}, "seg2-10"},
+		{vaas.Slice{seg2, 20, 30}, ""},
+	}
+	for _, test := range tests {
+		states := query.GetStates(vector, test.slice)
+		if string(states[tracker.ID]) != test.expected {
+			t.Fatalf("expected state %q for slice %v but got %q", test.expected, test.slice, states[tracker.ID])
+		}
+		if len(states) > 1 || (test.expected == "" && len(states) > 0) {
+			t.Fatalf("unexpected states %v for slice %v", states, test.slice)
+		}
+	}
+}
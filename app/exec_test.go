@@ -0,0 +1,97 @@
+package app
+
+import (
+	"../vaas"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Replaces the database with an empty one in a temporary directory, and returns
+// a function that restores it.
+func testDatabase(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "vaas-app-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = openDatabase(filepath.Join(dir, "skyhook.sqlite3"))
+	return func() {
+		db.db.Close()
+		db = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSelectorMask(t *testing.T) {
+	// the selector is sampled at freq=3, and the slice ends in the middle of
+	// the last sample
+	data := vaas.IntData{1, 0, 2, 0}
+	mask := selectorMask(data, 3, 11)
+	if fmt.Sprintf("%v", mask) != "[true true true false false false true true true false false]" {
+		t.Fatalf("unexpected mask %v", mask)
+	}
+	// frames after the selector output aren't selected
+	mask = selectorMask(vaas.IntData{1, 1}, 3, 7)
+	if fmt.Sprintf("%v", mask) != "[true true true true true true false]" {
+		t.Fatalf("unexpected mask %v", mask)
+	}
+	if mask := selectorMask(vaas.IntData{1, 1, 1}, 3, 7); mask != nil {
+		t.Fatalf("expected no mask when all frames are selected but got %v", mask)
+	}
+}
+
+func TestClearGatedOutputs(t *testing.T) {
+	defer testDatabase(t)()
+
+	timeline := NewTimeline("test")
+	input := NewSeries(timeline.ID, "video", vaas.VideoType)
+	query := GetQuery(db.Exec("INSERT INTO queries (name) VALUES ('test')").LastInsertId())
+	selector := query.AddNode("selector", "python", vaas.IntType)
+	detector := query.AddNode("detector", "yolov3", vaas.DetectionType)
+	segment := timeline.AddSegment("segment", 100, 25).Segment
+	addItem := func(node *DBNode, start int, masked bool) {
+		AddOutputItem(vaas.AddOutputItemRequest{
+			Node: node.Node,
+			Vector: []vaas.Series{input.Series},
+			Slice: vaas.Slice{segment, start, start+10},
+			Format: "json",
+			Freq: 1,
+			Masked: masked,
+		})
+	}
+	// the selector is never masked, and the detector was computed once with
+	// all frames selected and once under a mask
+	addItem(selector, 0, false)
+	addItem(selector, 10, false)
+	addItem(detector, 0, false)
+	addItem(detector, 10, true)
+	SaveState(vaas.SaveStateRequest{
+		Node: detector.Node,
+		Vector: []vaas.Series{input.Series},
+		Slice: vaas.Slice{segment, 10, 20},
+		State: []byte("state"),
+	})
+
+	query.ClearGatedOutputs()
+	for _, node := range []*DBNode{selector, detector} {
+		vn := GetVNode(node, []*DBSeries{input})
+		items := DBSeries{Series: *vn.Series}.ListItems()
+		expected := 2
+		if node == detector {
+			expected = 1
+		}
+		if len(items) != expected {
+			t.Fatalf("expected %d items of %s but got %d", expected, node.Name, len(items))
+		}
+		if node == detector && items[0].Slice.Start != 0 {
+			t.Fatalf("expected the unmasked item of detector to be kept")
+		}
+		if vn.GetState(segment.ID, 20) != nil {
+			t.Fatalf("expected the state of %s to be cleared", node.Name)
+		}
+	}
+}
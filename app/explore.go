@@ -134,6 +134,7 @@ func init() {
 
 			log.Printf("[exec (%s) %v] beginning test for client %v", query.Name, vector, s.ID())
 			renderVectors := query.GetOutputVectors(vector)
+			renderNodes := query.GetOutputNodes()
 			stream := NewExecStream(query, vector, sampler, request.Count, vaas.ExecOptions{}, func(slice vaas.Slice, outputs [][]vaas.DataReader, err error) {
 				if err != nil {
 					s.Emit("exec-reject")
@@ -150,7 +151,7 @@ func init() {
 						Percent int
 					}
 					s.Emit("exec-progress", ProgressResponse{cacheID, percent})
-				}})
+				}, Nodes: renderNodes})
 				cache.Put(cacheID, r)
 				log.Printf("[exec (%s) %v] test: cached renderer with %d frames, uuid=%s", query.Name, slice, slice.Length(), cacheID)
 				var t vaas.DataType = vaas.VideoType
@@ -13,6 +13,16 @@ type ExecJob struct {
 	pending map[int]vaas.Slice
 	completed int
 
+	// if the query has stateful nodes, we apply it on the contiguous slices of
+	// each segment in order, one at a time, so that each slice can continue from
+	// the state at the end of the previous one
+	// chains are the pending slices in each run of contiguous slices
+	ordered bool
+	chains [][]vaas.Slice
+	// chain index of the slices being applied
+	applying map[vaas.Slice]int
+	busy map[int]bool
+
 	lines *LinesBuffer
 	mu sync.Mutex
 }
@@ -44,7 +54,11 @@ func NewExecJob(query *DBQuery, vector []*DBSeries, nframes int) *ExecJob {
 	}
 	bigSlices := SliceIntersection(sets)
 	j.pending = make(map[int]vaas.Slice)
+	j.ordered = query.IsStateful()
+	j.applying = make(map[vaas.Slice]int)
+	j.busy = make(map[int]bool)
 	for _, bigSlice := range bigSlices {
+		var chain []vaas.Slice
 		for start := bigSlice.Start; start < bigSlice.End; start += nframes {
 			end := start + nframes
 			if end > bigSlice.End {
@@ -62,11 +76,15 @@ func NewExecJob(query *DBQuery, vector []*DBSeries, nframes int) *ExecJob {
 				continue
 			}
 			j.pending[len(j.pending)] = slice
+			chain = append(chain, slice)
+		}
+		if len(chain) > 0 {
+			j.chains = append(j.chains, chain)
 		}
 	}
 
 	// create the exec stream
-	j.execStream = NewExecStream(query, vector, j.sample, 4, vaas.ExecOptions{}, j.callback)
+	j.execStream = NewExecStream(query, vector, j.sample, 4, vaas.ExecOptions{ChainStates: j.ordered}, j.callback)
 
 	return j
 }
@@ -74,6 +92,22 @@ func NewExecJob(query *DBQuery, vector []*DBSeries, nframes int) *ExecJob {
 func (j *ExecJob) sample() *vaas.Slice {
 	j.mu.Lock()
 	defer j.mu.Unlock()
+	if j.ordered {
+		// take the next slice of a chain that has no slice being applied
+		// if every chain is busy, the ExecStream thread exits, and the thread
+		// applying the previous slice of the chain will pick up the next one
+		for idx, chain := range j.chains {
+			if j.busy[idx] || len(chain) == 0 {
+				continue
+			}
+			slice := chain[0]
+			j.chains[idx] = chain[1:]
+			j.busy[idx] = true
+			j.applying[slice] = idx
+			return &slice
+		}
+		return nil
+	}
 	for id, slice := range j.pending {
 		delete(j.pending, id)
 		return &slice
@@ -93,6 +127,12 @@ func (j *ExecJob) callback(slice vaas.Slice, outputs [][]vaas.DataReader, err er
 			rd.Close()
 		}
 	}
+	// the outputs are done, so the stateful nodes have saved their state and the
+	// next slice of the chain can be applied
+	if idx, ok := j.applying[slice]; ok {
+		delete(j.applying, slice)
+		delete(j.busy, idx)
+	}
 	if err != nil {
 		j.lines.Append(fmt.Sprintf("error applying on slice %v: %v", slice, err))
 		return
@@ -108,9 +148,35 @@ func (j *ExecJob) Type() string {
 	return "cmd"
 }
 
+// Add container exit reasons to the job lines if the container belongs to our query.
+// Otherwise the slices would only fail with HTTP errors.
+func (j *ExecJob) onContainerExited(exit vaas.ContainerExit) {
+	setID := vaas.EnvSetID{"query", j.execStream.query.ID}
+	for _, clist := range GetAllocator().GetContainers(setID) {
+		for _, container := range clist {
+			if container.UUID != exit.UUID {
+				continue
+			}
+			var action string
+			if exit.Restarted {
+				action = "restarted"
+			} else {
+				action = "not restarted"
+			}
+			j.lines.Append(fmt.Sprintf("container %s (template=%s) %s, %s", exit.UUID, container.Environment.Template, exit.Reason, action))
+			return
+		}
+	}
+}
+
 func (j *ExecJob) Run(statusFunc func(string)) error {
 	statusFunc("Running")
 	log.Printf("[job %v] applying query on %d slices that need outputs", j.Name(), len(j.pending))
+	if j.ordered {
+		log.Printf("[job %v] query has stateful nodes, applying on %d runs of contiguous slices in order", j.Name(), len(j.chains))
+	}
+	listenerID := AddContainerExitListener(j.onContainerExited)
+	defer RemoveContainerExitListener(listenerID)
 	j.execStream.Get(len(j.pending))
 	j.execStream.Wait()
 	return nil
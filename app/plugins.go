@@ -0,0 +1,71 @@
+package app
+
+import (
+	"../vaas"
+
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Plugin load failures from the coordinator and containers, so that they are
+// visible in one place instead of only in the logs of each container.
+// Every container loads the same plugins, so we merge errors with the same
+// filename and message.
+var pluginErrors = make(map[[2]string]*vaas.PluginError)
+var pluginErrorsMu sync.Mutex
+
+func ReportPluginErrors(errors []vaas.PluginError) {
+	pluginErrorsMu.Lock()
+	defer pluginErrorsMu.Unlock()
+	for _, e := range errors {
+		k := [2]string{e.Filename, e.Error}
+		if pluginErrors[k] == nil {
+			pluginErrors[k] = &vaas.PluginError{
+				Filename: e.Filename,
+				Error: e.Error,
+			}
+		}
+		pluginErrors[k].Source = e.Source
+		pluginErrors[k].Time = e.Time
+		pluginErrors[k].Count++
+	}
+}
+
+// Load the plugins on the coordinator.
+// Must be called before queries are executed.
+func LoadPlugins() {
+	ReportPluginErrors(vaas.LoadPlugins(vaas.PluginDir, "coordinator"))
+}
+
+func GetPluginErrors() []vaas.PluginError {
+	pluginErrorsMu.Lock()
+	defer pluginErrorsMu.Unlock()
+	var errors []vaas.PluginError
+	for _, e := range pluginErrors {
+		errors = append(errors, *e)
+	}
+	sort.Slice(errors, func(i, j int) bool {
+		return errors[i].Time.After(errors[j].Time)
+	})
+	return errors
+}
+
+func init() {
+	http.HandleFunc("/plugins/errors", func(w http.ResponseWriter, r *http.Request) {
+		vaas.JsonResponse(w, GetPluginErrors())
+	})
+
+	// called from container
+	http.HandleFunc("/plugins/report-errors", vaas.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		var errors []vaas.PluginError
+		if err := vaas.ParseJsonRequest(w, r, &errors); err != nil {
+			return
+		}
+		ReportPluginErrors(errors)
+	}))
+}
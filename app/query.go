@@ -142,6 +142,32 @@ func (node *DBNode) ClearDescendants() {
 	}
 }
 
+// Clears the saved outputs that were computed under the per-frame mask of the
+// selector (see RunBuffer), and the states of their nodes, since they may be
+// missing frames that a different selector selects.
+// Outputs computed without a mask (e.g. the selector and its ancestors) are kept.
+func (query *DBQuery) ClearGatedOutputs() {
+	query.Load()
+	for _, node := range query.Nodes {
+		for _, vn := range (&DBNode{Node: *node}).ListVNodes() {
+			vn.Load()
+			if vn.Series == nil {
+				continue
+			}
+			rows := db.Query(ItemQuery + " WHERE series_id = ? AND masked = 1", vn.Series.ID)
+			items := itemListHelper(rows)
+			if len(items) == 0 {
+				continue
+			}
+			log.Printf("[exec (%s)] clearing %d masked outputs in series %s", node.Name, len(items), vn.Series.Name)
+			for _, item := range items {
+				item.Delete()
+			}
+			vn.ClearStates()
+		}
+	}
+}
+
 const VNodeQuery = "SELECT id, node_id, vector, series_id FROM vnodes"
 
 func vnodeListHelper(rows *Rows) []*DBVNode {
@@ -228,6 +254,7 @@ func (vn *DBVNode) Clear() {
 		log.Printf("[exec (%s)] clearing outputs series %s", vn.Node.Name, vn.Series.Name)
 		DBSeries{Series: *vn.Series}.Clear()
 	}
+	vn.ClearStates()
 }
 
 const QueryQuery = "SELECT id, name, outputs, selector, render_meta FROM queries"
@@ -328,6 +355,22 @@ func (query *DBQuery) GetOutputVectors(inputs []*DBSeries) [][]*DBSeries {
 	return outputs
 }
 
+// Returns the nodes corresponding to query.Outputs, with nil for series outputs.
+func (query *DBQuery) GetOutputNodes() [][]*vaas.Node {
+	query.Load()
+	nodes := make([][]*vaas.Node, len(query.Outputs))
+	for i, l := range query.Outputs {
+		for _, output := range l {
+			if output.Type == vaas.NodeParent {
+				nodes[i] = append(nodes[i], query.Nodes[output.NodeID])
+			} else {
+				nodes[i] = append(nodes[i], nil)
+			}
+		}
+	}
+	return nodes
+}
+
 func (query *DBQuery) AddNode(name string, t string, dataType vaas.DataType) *DBNode {
 	res := db.Exec(
 		"INSERT INTO nodes (name, parents, type, data_type, code, query_id, parent_types) VALUES (?, '', ?, ?, '', ?, '')",
@@ -347,6 +390,7 @@ func (query *DBQuery) RemoveNode(target *DBNode) {
 	for _, vnode := range target.ListVNodes() {
 		vnode.Load()
 		db.Exec("DELETE FROM vnodes WHERE id = ?", vnode.ID)
+		vnode.ClearStates()
 		if vnode.Series != nil {
 			series := &DBSeries{Series: *vnode.Series}
 			series.Delete()
@@ -521,6 +565,7 @@ func init() {
 			} else {
 				db.Exec("UPDATE queries SET selector = ? WHERE id = ?", selector, query.ID)
 			}
+			GetQuery(query.ID).ClearGatedOutputs()
 		}
 		OnQueryChanged(query)
 	})
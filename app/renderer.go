@@ -28,8 +28,19 @@ type VideoRenderer struct {
 
 type RenderOpts struct {
 	ProgressCallback func(progress int)
+	// nodes that produced the inputs, if known (nil for series inputs)
+	// used to look up RenderHooks
+	Nodes [][]*vaas.Node
 }
 
+// Draws extra information for a node's output on frame idx of data.
+// It is called on every rendered frame, in order.
+type RenderFunc func(im vaas.Image, data vaas.Data, idx int)
+
+// Node types can register hooks to draw things that are not part of their outputs,
+// like the configuration of the node. The hook is called once per rendered video.
+var RenderHooks = make(map[string]func(node vaas.Node) RenderFunc)
+
 func RenderVideo(slice vaas.Slice, inputs [][]vaas.DataReader, opts RenderOpts) *VideoRenderer {
 	r := &VideoRenderer{
 		slice: slice,
@@ -48,7 +59,8 @@ func (r *VideoRenderer) setErr(err error) {
 	r.mu.Unlock()
 }
 
-func RenderFrames(canvas vaas.Image, datas [][]vaas.Data, f func(int)) {
+// hooks, if set, has the same shape as datas, with nil for inputs without a hook.
+func RenderFrames(canvas vaas.Image, datas [][]vaas.Data, hooks [][]RenderFunc, f func(int)) {
 	renderOne := func(im vaas.Image, data vaas.Data, idx int) {
 		if data.Type() == vaas.DetectionType || data.Type() == vaas.TrackType {
 			detections := data.(vaas.DetectionData).Resize([2]int{im.Width, im.Height}).D
@@ -75,24 +87,31 @@ func RenderFrames(canvas vaas.Image, datas [][]vaas.Data, f func(int)) {
 		}
 	}
 
-	renderFrame := func(vdata vaas.VideoData, datas []vaas.Data, idx int) vaas.Image {
+	renderFrame := func(vdata vaas.VideoData, datas []vaas.Data, hooks []RenderFunc, idx int) vaas.Image {
 		im := vdata[idx]
-		for _, data := range datas {
+		for j, data := range datas {
 			renderOne(im, data, idx)
+			if hooks != nil && hooks[j] != nil {
+				hooks[j](im, data, idx)
+			}
 		}
 		return im
 	}
 
 	for i := 0; i < datas[0][0].Length(); i++ {
 		offset := 0
-		for _, l := range datas {
+		for k, l := range datas {
 			head := l[0]
 			if head.Type() != vaas.VideoType {
 				continue
 			}
 			vdata := head.(vaas.VideoData)
 			remaining := l[1:]
-			im := renderFrame(vdata, remaining, i)
+			var remainingHooks []RenderFunc
+			if hooks != nil && hooks[k] != nil {
+				remainingHooks = hooks[k][1:]
+			}
+			im := renderFrame(vdata, remaining, remainingHooks, i)
 			canvas.DrawImage(0, offset, im)
 			offset += im.Height
 		}
@@ -107,11 +126,20 @@ func (r *VideoRenderer) render() {
 	var canvas *vaas.Image
 
 	labels := make([][]vaas.Data, len(r.inputs))
+	hooks := make([][]RenderFunc, len(r.inputs))
 	var flatInputs []vaas.DataReader
 	for i, input := range r.inputs {
-		for _, rd := range input {
+		hooks[i] = make([]RenderFunc, len(input))
+		for j, rd := range input {
 			labels[i] = append(labels[i], vaas.NewData(rd.Type()))
 			flatInputs = append(flatInputs, rd)
+			if i >= len(r.opts.Nodes) || j >= len(r.opts.Nodes[i]) || r.opts.Nodes[i][j] == nil {
+				continue
+			}
+			node := *r.opts.Nodes[i][j]
+			if hook := RenderHooks[node.Type]; hook != nil {
+				hooks[i][j] = hook(node)
+			}
 		}
 	}
 
@@ -188,7 +216,7 @@ func (r *VideoRenderer) render() {
 			go writeFunc()
 		}
 
-		RenderFrames(*canvas, datas, func(i int) {
+		RenderFrames(*canvas, datas, hooks, func(i int) {
 			ch <- *canvas
 			if needPreview {
 				r.mu.Lock()
@@ -352,6 +352,19 @@ func GetItem(id int) *DBItem {
 	}
 }
 
+// Add an item to the outputs series of a node, creating the series if needed.
+func AddOutputItem(request vaas.AddOutputItemRequest) *DBItem {
+	node := &DBNode{Node: request.Node}
+	vector := VectorFromList(request.Vector)
+	vn := GetOrCreateVNode(node, vector)
+	vn.EnsureSeries()
+	item := DBSeries{Series: *vn.Series}.AddItem(request.Slice, request.Format, request.Dims, request.Freq)
+	if request.Masked {
+		db.Exec("UPDATE items SET masked = 1 WHERE id = ?", item.ID)
+	}
+	return item
+}
+
 func (series DBSeries) AddItem(slice vaas.Slice, format string, videoDims [2]int, freq int) *DBItem {
 	res := db.Exec(
 		"INSERT INTO items (segment_id, series_id, start, end, format, width, height, freq) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
@@ -511,6 +524,7 @@ func init() {
 			http.Error(w, "delete all series in the timeline first", 400)
 			return
 		}
+		db.Exec("DELETE FROM calibrations WHERE timeline_id = ?", timelineID)
 		db.Exec("DELETE FROM timelines WHERE id = ?", timelineID)
 	})
 
@@ -678,7 +692,7 @@ func init() {
 	})
 
 	// called from container
-	http.HandleFunc("/series/add-output-item", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/series/add-output-item", vaas.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(404)
 			return
@@ -688,15 +702,8 @@ func init() {
 		if err := vaas.ParseJsonRequest(w, r, &request); err != nil {
 			return
 		}
-
-		// if no outputs series, create one to store the exec outputs
-		node := &DBNode{Node: request.Node}
-		vector := VectorFromList(request.Vector)
-		vn := GetOrCreateVNode(node, vector)
-		vn.EnsureSeries()
-		item := DBSeries{Series: *vn.Series}.AddItem(request.Slice, request.Format, request.Dims, request.Freq)
-		vaas.JsonResponse(w, item)
-	})
+		vaas.JsonResponse(w, AddOutputItem(request))
+	}))
 
 	http.HandleFunc("/vectors", func(w http.ResponseWriter, r *http.Request) {
 		vaas.JsonResponse(w, ListVectors())
@@ -15,11 +15,14 @@ type QueryStats map[string]map[int]vaas.StatsSample
 type StatsManager struct {
 	mu sync.Mutex
 	stats map[int]QueryStats
+	// query ID -> container UUID -> buffer memory usage
+	memory map[int]map[string]vaas.BufferMemory
 }
 
 func (m *StatsManager) OnQueryChanged(query *DBQuery) {
 	m.mu.Lock()
 	delete(m.stats, query.ID)
+	delete(m.memory, query.ID)
 	m.mu.Unlock()
 }
 
@@ -32,24 +35,24 @@ func (m *StatsManager) iter() {
 			continue
 		}
 		queryID := setID.RefID
-		if m.stats[queryID] == nil {
-			m.stats[queryID] = make(QueryStats)
-		}
 
 		// collect stats
+		// we only keep stats from current containers since the autoscaler may remove some
 		containers := GetAllocator().GetContainers(setID)
 		if containers == nil {
 			continue
 		}
+		m.stats[queryID] = make(QueryStats)
+		m.memory[queryID] = make(map[string]vaas.BufferMemory)
 		for _, clist := range containers {
 			for _, container := range clist {
-				stats := make(map[int]vaas.StatsSample)
-				err := vaas.JsonPost(container.BaseURL, "/allstats", nil, &stats)
+				stats, err := vaas.GetContainerStats(container)
 				if err != nil {
 					log.Printf("[stats] warning: error reading stats from container %s (%s): %v", container.BaseURL, container.UUID, err)
 					continue
 				}
-				m.stats[queryID][container.UUID] = stats
+				m.stats[queryID][container.UUID] = stats.Nodes
+				m.memory[queryID][container.UUID] = stats.Memory
 			}
 		}
 	}
@@ -67,11 +70,22 @@ func (m *StatsManager) GetStatsByNode(queryID int) map[int]vaas.StatsSample {
 	return stats
 }
 
+func (m *StatsManager) GetMemory(queryID int) map[string]vaas.BufferMemory {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	memory := make(map[string]vaas.BufferMemory)
+	for uuid, usage := range m.memory[queryID] {
+		memory[uuid] = usage
+	}
+	return memory
+}
+
 var statsManager *StatsManager
 
 func init() {
 	statsManager = &StatsManager{
 		stats: make(map[int]QueryStats),
+		memory: make(map[int]map[string]vaas.BufferMemory),
 	}
 	go func() {
 		for {
@@ -85,4 +99,10 @@ func init() {
 		queryID := vaas.ParseInt(r.Form.Get("query_id"))
 		vaas.JsonResponse(w, statsManager.GetStatsByNode(queryID))
 	})
+
+	http.HandleFunc("/stats/memory", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		queryID := vaas.ParseInt(r.Form.Get("query_id"))
+		vaas.JsonResponse(w, statsManager.GetMemory(queryID))
+	})
 }
@@ -0,0 +1,112 @@
+package builtins_app
+
+import (
+	"../../builtins"
+	"../../app"
+	"../../vaas"
+	gomapinfer "github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"fmt"
+)
+
+// scale a point in canvasDims coordinates to the rendered image
+func scaleLinePoint(p [2]int, canvasDims [2]int, im vaas.Image) [2]int {
+	if canvasDims[0] == 0 || canvasDims[1] == 0 {
+		return p
+	}
+	return [2]int{
+		p[0] * im.Width / canvasDims[0],
+		p[1] * im.Height / canvasDims[1],
+	}
+}
+
+func drawCrossingLine(im vaas.Image, line builtins.CrossingLine, canvasDims [2]int) {
+	color := [3]uint8{255, 255, 0}
+	a := scaleLinePoint(line.Points[0], canvasDims, im)
+	b := scaleLinePoint(line.Points[1], canvasDims, im)
+	for _, p := range gomapinfer.DrawLineOnCells(a[0], a[1], b[0], b[1], im.Width, im.Height) {
+		im.FillRectangle(p[0]-1, p[1]-1, p[0]+1, p[1]+1, color)
+	}
+	// mark the end of the line to show its direction
+	im.FillRectangle(b[0]-4, b[1]-4, b[0]+4, b[1]+4, color)
+}
+
+func init() {
+	// draw the lines, and the number of crossings so far in each direction
+	app.RenderHooks["line-crossing"] = func(node vaas.Node) app.RenderFunc {
+		var cfg builtins.LineCrossingConfig
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return nil
+		}
+		counts := make(map[string]int)
+		// rendered frames may repeat the same output frame if the node ran at a lower
+		// sampling rate, so skip events that were also on the previous frame
+		var prev map[[2]interface{}]bool
+		return func(im vaas.Image, data vaas.Data, idx int) {
+			cur := make(map[[2]interface{}]bool)
+			for _, d := range data.(vaas.DetectionData).D[idx].Detections {
+				k := [2]interface{}{d.TrackID, d.Class}
+				cur[k] = true
+				if !prev[k] {
+					counts[d.Class]++
+				}
+			}
+			prev = cur
+
+			for _, line := range cfg.Lines {
+				drawCrossingLine(im, line, cfg.CanvasDims)
+				a := scaleLinePoint(line.Points[0], cfg.CanvasDims, im)
+				b := scaleLinePoint(line.Points[1], cfg.CanvasDims, im)
+				im.DrawText(vaas.RichText{
+					Text: fmt.Sprintf(
+						"%s: %d fwd, %d bwd", line.Name,
+						counts[builtins.CrossingClass(line.Name, builtins.CrossingForward)],
+						counts[builtins.CrossingClass(line.Name, builtins.CrossingBackward)],
+					),
+					X: (a[0]+b[0])/2,
+					Y: (a[1]+b[1])/2,
+				})
+			}
+		}
+	}
+
+	// draw the count next to the start of the line that it counts, if we can find it
+	app.RenderHooks["line-count"] = func(node vaas.Node) app.RenderFunc {
+		var cfg builtins.LineCountConfig
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return nil
+		}
+		label := cfg.Line
+		if label == "" {
+			label = "all lines"
+		}
+		if cfg.Direction != "" {
+			label += " " + cfg.Direction
+		}
+
+		var pos [2]int
+		var canvasDims [2]int
+		if len(node.Parents) == 1 && node.Parents[0].Type == vaas.NodeParent {
+			parent := app.GetNode(node.Parents[0].NodeID)
+			var parentCfg builtins.LineCrossingConfig
+			if parent != nil && parent.Type == "line-crossing" && json.Unmarshal([]byte(parent.Code), &parentCfg) == nil {
+				canvasDims = parentCfg.CanvasDims
+				for _, line := range parentCfg.Lines {
+					if line.Name == cfg.Line {
+						pos = line.Points[0]
+					}
+				}
+			}
+		}
+
+		return func(im vaas.Image, data vaas.Data, idx int) {
+			p := scaleLinePoint(pos, canvasDims, im)
+			im.DrawText(vaas.RichText{
+				Text: fmt.Sprintf("%s: %d", label, data.(vaas.IntData)[idx]),
+				X: p[0],
+				Y: p[1],
+			})
+		}
+	}
+}
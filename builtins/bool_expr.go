@@ -4,52 +4,111 @@ import (
 	"../vaas"
 
 	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
 )
 
-type BoolExprConfig struct {}
+type BoolExprConfig struct {
+	// see expr.go for the syntax
+	// if empty, the node outputs the logical AND of all of its parents
+	Expr string
+}
 
 type BoolExpr struct {
 	node vaas.Node
 	cfg BoolExprConfig
+	expr *Expr
 	stats *vaas.StatsHolder
 }
 
 func NewBoolExpr(node vaas.Node) vaas.Executor {
 	var cfg BoolExprConfig
-	err := json.Unmarshal([]byte(node.Code), &cfg)
+	if node.Code != "" {
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	if node.DataType != vaas.IntType && node.DataType != vaas.FloatType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("bool-expr node must output int or float, but got %s", node.DataType)}
+	}
+	if len(node.Parents) == 0 {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("bool-expr node must have at least one parent")}
+	}
+	str := cfg.Expr
+	if strings.TrimSpace(str) == "" {
+		var parts []string
+		for i := range node.Parents {
+			parts = append(parts, fmt.Sprintf("p%d", i))
+		}
+		str = strings.Join(parts, " and ")
+	}
+	expr, err := ParseExpr(str, len(node.Parents))
 	if err != nil {
-		cfg = BoolExprConfig{}
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error parsing expression: %v", err)}
 	}
 	return BoolExpr{
 		node: node,
 		cfg: cfg,
+		expr: expr,
 		stats: new(vaas.StatsHolder),
 	}
 }
 
+// State handed to the next slice, so that windowed functions like any_in_last
+// include the frames at the end of the previous slice.
+type BoolExprState struct {
+	History [][]float64
+}
+
 func (m BoolExpr) Run(ctx vaas.ExecContext) vaas.DataBuffer {
-	buf := vaas.NewSimpleBuffer(vaas.IntType)
-	buf.SetMeta(1)
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+func (m BoolExpr) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("bool-expr error reading parents: %v", err))
+	}
+	for i, parent := range parents {
+		if parent.Type() == vaas.VideoType || parent.Type() == vaas.ImListType {
+			return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("bool-expr: parent p%d has unsupported type %s", i, parent.Type()))
+		}
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
 
 	go func() {
-		for _, parent := range m.node.Parents {
-			rd, err := GetParent(ctx, parent)
-			if err != nil {
-				buf.Error(err)
-				return
-			}
-			data, err := rd.Read(ctx.Slice.Length())
-			if err != nil {
-				buf.Error(err)
-				return
-			}
-			if data.IsEmpty() {
-				buf.Write(vaas.IntData{0}.EnsureLength(ctx.Slice.Length()))
-				buf.Close()
-				return
+		freq := vaas.MinFreq(parents)
+		buf.SetMeta(freq)
+		evaluator := m.expr.NewEvaluator(freq)
+		if state != nil {
+			var s BoolExprState
+			vaas.JsonUnmarshal(state, &s)
+			evaluator.SetHistory(s.History)
+		}
+		err := vaas.ReadMultiple(ctx.Slice.Length(), freq, parents, vaas.ReadMultipleOptions{Stats: m.stats}, func(index int, datas []vaas.Data) error {
+			frame := make([]vaas.Data, len(datas))
+			for i := 0; i < datas[0].Length(); i++ {
+				for j := range datas {
+					frame[j] = datas[j].Slice(i, i+1)
+				}
+				x, err := evaluator.Eval(frame)
+				if err != nil {
+					return err
+				}
+				if m.node.DataType == vaas.IntType {
+					buf.Write(vaas.IntData{int(math.Round(x))})
+				} else {
+					buf.Write(vaas.FloatData{x})
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			buf.Error(fmt.Errorf("bool-expr: %v", err))
+			return
 		}
-		buf.Write(vaas.IntData{1}.EnsureLength(ctx.Slice.Length()))
+		export(vaas.JsonMarshal(BoolExprState{evaluator.History()}))
 		buf.Close()
 	}()
 
@@ -65,5 +124,6 @@ func (m BoolExpr) Stats() vaas.StatsSample {
 func init() {
 	vaas.Executors["bool-expr"] = vaas.ExecutorMeta{
 		New: NewBoolExpr,
+		Stateful: true,
 	}
 }
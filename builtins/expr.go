@@ -0,0 +1,517 @@
+package builtins
+
+// Expression language used by bool-expr nodes.
+//
+// Expressions are evaluated on every output frame and produce a number, where
+// zero is false and anything else is true. Parents are referenced by their
+// position as p0, p1, ..., and evaluate to:
+//   - detection, track: the number of detections in the frame
+//   - int, float: the value
+//   - string, text: 1 if non-empty, else 0
+//
+// Supported syntax, from lowest to highest precedence:
+//   or ||, and &&, not !, comparisons (== != < <= > >=), + -, * / %, unary -
+// Functions:
+//   count(pN, "class")  number of detections of pN with the class
+//   any_in_last(x, n)   1 if x was true in any of the last n frames, else 0
+//   sum_over(x, n)      sum of x over the last n frames
+//   abs(x), min(x, y), max(x, y)
+// Window lengths n are in frames of the original video, and include the current frame.
+
+import (
+	"../vaas"
+
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type exprTokenKind int
+const (
+	exprNumber exprTokenKind = iota
+	exprString
+	exprIdent
+	exprOp
+	exprEOF
+)
+
+type exprToken struct {
+	Kind exprTokenKind
+	Text string
+	Pos int
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(s)
+	i := 0
+	for i < len(runes) {
+		c := runes[i]
+		if unicode.IsSpace(c) {
+			i++
+		} else if unicode.IsDigit(c) || c == '.' {
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprNumber, string(runes[start:i]), start})
+		} else if unicode.IsLetter(c) || c == '_' {
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprIdent, string(runes[start:i]), start})
+		} else if c == '"' || c == '\'' {
+			start := i
+			i++
+			for i < len(runes) && runes[i] != c {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			tokens = append(tokens, exprToken{exprString, string(runes[start+1:i]), start})
+			i++
+		} else {
+			op := string(c)
+			if i+1 < len(runes) {
+				two := string(runes[i:i+2])
+				if two == "==" || two == "!=" || two == "<=" || two == ">=" || two == "&&" || two == "||" {
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/%()<>!,", op) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, exprToken{exprOp, op, i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, exprToken{exprEOF, "", len(runes)})
+	return tokens, nil
+}
+
+// A node in the parsed expression.
+type exprNode struct {
+	// "num", "parent", "count", "unary", "binary", "call"
+	Kind string
+	Value float64
+	// parent index for "parent" and "count"
+	Parent int
+	// class for "count", operator for "unary" and "binary", function name for "call"
+	Name string
+	Args []*exprNode
+	// window length in frames for windowed functions
+	Window int
+}
+
+// An expression over the parents of a node.
+type Expr struct {
+	root *exprNode
+	numParents int
+}
+
+var exprWindowFuncs = map[string]bool{
+	"any_in_last": true,
+	"sum_over": true,
+}
+
+var exprFuncArgs = map[string]int{
+	"abs": 1,
+	"min": 2,
+	"max": 2,
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos int
+	numParents int
+}
+
+func ParseExpr(s string, numParents int) (*Expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, numParents: numParents}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != exprEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.Text, tok.Pos)
+	}
+	return &Expr{root, numParents}, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != exprEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// Consumes the next token if it is one of the operators or keywords.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.Kind != exprOp && tok.Kind != exprIdent {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.Text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	tok := p.next()
+	if tok.Kind != exprOp || tok.Text != op {
+		return fmt.Errorf("expected %q at position %d", op, tok.Pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseBinary(ops []string, names map[string]string, sub func() (*exprNode, error)) (*exprNode, error) {
+	left, err := sub()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		if names[op] != "" {
+			op = names[op]
+		}
+		right, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{Kind: "binary", Name: op, Args: []*exprNode{left, right}}
+	}
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	return p.parseBinary([]string{"or", "||"}, map[string]string{"||": "or"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	return p.parseBinary([]string{"and", "&&"}, map[string]string{"&&": "and"}, p.parseNot)
+}
+
+func (p *exprParser) parseNot() (*exprNode, error) {
+	if _, ok := p.accept("not", "!"); ok {
+		arg, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{Kind: "unary", Name: "not", Args: []*exprNode{arg}}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (*exprNode, error) {
+	return p.parseBinary([]string{"==", "!=", "<=", ">=", "<", ">"}, nil, p.parseSum)
+}
+
+func (p *exprParser) parseSum() (*exprNode, error) {
+	return p.parseBinary([]string{"+", "-"}, nil, p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (*exprNode, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, nil, p.parseUnary)
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{Kind: "unary", Name: "-", Args: []*exprNode{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parseParent(tok exprToken) (int, bool) {
+	if len(tok.Text) < 2 || tok.Text[0] != 'p' {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(tok.Text[1:])
+	if err != nil {
+		return 0, false
+	}
+	return idx, true
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	tok := p.next()
+	if tok.Kind == exprNumber {
+		x, err := strconv.ParseFloat(tok.Text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.Text, tok.Pos)
+		}
+		return &exprNode{Kind: "num", Value: x}, nil
+	} else if tok.Kind == exprOp && tok.Text == "(" {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	} else if tok.Kind == exprEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	} else if tok.Kind != exprIdent {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.Text, tok.Pos)
+	}
+
+	if tok.Text == "true" {
+		return &exprNode{Kind: "num", Value: 1}, nil
+	} else if tok.Text == "false" {
+		return &exprNode{Kind: "num", Value: 0}, nil
+	} else if idx, ok := p.parseParent(tok); ok {
+		if idx >= p.numParents {
+			return nil, fmt.Errorf("%s at position %d is out of range (node has %d parents)", tok.Text, tok.Pos, p.numParents)
+		}
+		return &exprNode{Kind: "parent", Parent: idx}, nil
+	}
+
+	name := tok.Text
+	if err := p.expect("("); err != nil {
+		return nil, fmt.Errorf("unknown identifier %q at position %d", name, tok.Pos)
+	}
+	if name == "count" {
+		parentTok := p.next()
+		idx, ok := p.parseParent(parentTok)
+		if !ok || idx >= p.numParents {
+			return nil, fmt.Errorf("count expects a parent at position %d", parentTok.Pos)
+		}
+		node := &exprNode{Kind: "count", Parent: idx}
+		if _, ok := p.accept(","); ok {
+			classTok := p.next()
+			if classTok.Kind != exprString {
+				return nil, fmt.Errorf("count expects a class string at position %d", classTok.Pos)
+			}
+			node.Name = classTok.Text
+		}
+		return node, p.expect(")")
+	} else if exprWindowFuncs[name] {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		nTok := p.next()
+		n, err := strconv.Atoi(nTok.Text)
+		if nTok.Kind != exprNumber || err != nil || n < 1 {
+			return nil, fmt.Errorf("%s expects a positive integer window at position %d", name, nTok.Pos)
+		}
+		return &exprNode{Kind: "call", Name: name, Args: []*exprNode{arg}, Window: n}, p.expect(")")
+	} else if numArgs, ok := exprFuncArgs[name]; ok {
+		node := &exprNode{Kind: "call", Name: name}
+		for i := 0; i < numArgs; i++ {
+			if i > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			node.Args = append(node.Args, arg)
+		}
+		return node, p.expect(")")
+	}
+	return nil, fmt.Errorf("unknown function %q at position %d", name, tok.Pos)
+}
+
+func exprBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Evaluates an Expr frame by frame, keeping the history needed by windowed functions.
+type ExprEvaluator struct {
+	expr *Expr
+	// number of original frames per evaluated frame
+	freq int
+	// recent values of the argument of each windowed function, most recent last
+	history map[*exprNode][]float64
+}
+
+func (expr *Expr) NewEvaluator(freq int) *ExprEvaluator {
+	return &ExprEvaluator{
+		expr: expr,
+		freq: freq,
+		history: make(map[*exprNode][]float64),
+	}
+}
+
+// Returns the windowed function nodes in the order they appear in the expression.
+func (expr *Expr) windowNodes() []*exprNode {
+	var nodes []*exprNode
+	var visit func(node *exprNode)
+	visit = func(node *exprNode) {
+		if node.Kind == "call" && exprWindowFuncs[node.Name] {
+			nodes = append(nodes, node)
+		}
+		for _, arg := range node.Args {
+			visit(arg)
+		}
+	}
+	visit(expr.root)
+	return nodes
+}
+
+// Returns the recent values of each windowed function, so that evaluation can
+// continue on the next slice (see SetHistory).
+func (e *ExprEvaluator) History() [][]float64 {
+	var history [][]float64
+	for _, node := range e.expr.windowNodes() {
+		history = append(history, e.history[node])
+	}
+	return history
+}
+
+func (e *ExprEvaluator) SetHistory(history [][]float64) {
+	for i, node := range e.expr.windowNodes() {
+		if i < len(history) {
+			e.history[node] = history[i]
+		}
+	}
+}
+
+// Evaluates the expression on the next frame.
+// datas are the parents' data on that frame (each of length 1).
+func (e *ExprEvaluator) Eval(datas []vaas.Data) (float64, error) {
+	if len(datas) != e.expr.numParents {
+		return 0, fmt.Errorf("expected %d parents but got %d", e.expr.numParents, len(datas))
+	}
+	return e.eval(e.expr.root, datas)
+}
+
+func (e *ExprEvaluator) eval(node *exprNode, datas []vaas.Data) (float64, error) {
+	switch node.Kind {
+	case "num":
+		return node.Value, nil
+	case "parent":
+		return exprParentValue(datas[node.Parent], "")
+	case "count":
+		return exprParentValue(datas[node.Parent], node.Name)
+	}
+
+	args := make([]float64, len(node.Args))
+	for i, arg := range node.Args {
+		var err error
+		args[i], err = e.eval(arg, datas)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	switch node.Kind {
+	case "unary":
+		if node.Name == "not" {
+			return exprBool(args[0] == 0), nil
+		}
+		return -args[0], nil
+	case "binary":
+		a, b := args[0], args[1]
+		switch node.Name {
+		case "or": return exprBool(a != 0 || b != 0), nil
+		case "and": return exprBool(a != 0 && b != 0), nil
+		case "==": return exprBool(a == b), nil
+		case "!=": return exprBool(a != b), nil
+		case "<": return exprBool(a < b), nil
+		case "<=": return exprBool(a <= b), nil
+		case ">": return exprBool(a > b), nil
+		case ">=": return exprBool(a >= b), nil
+		case "+": return a + b, nil
+		case "-": return a - b, nil
+		case "*": return a * b, nil
+		case "/":
+			if b == 0 {
+				return 0, nil
+			}
+			return a / b, nil
+		case "%":
+			if b == 0 {
+				return 0, nil
+			}
+			return math.Mod(a, b), nil
+		}
+	case "call":
+		switch node.Name {
+		case "abs": return math.Abs(args[0]), nil
+		case "min": return math.Min(args[0], args[1]), nil
+		case "max": return math.Max(args[0], args[1]), nil
+		}
+		samples := (node.Window + e.freq-1) / e.freq
+		history := append(e.history[node], args[0])
+		if len(history) > samples {
+			history = history[len(history)-samples:]
+		}
+		e.history[node] = history
+		if node.Name == "any_in_last" {
+			for _, x := range history {
+				if x != 0 {
+					return 1, nil
+				}
+			}
+			return 0, nil
+		}
+		var sum float64
+		for _, x := range history {
+			sum += x
+		}
+		return sum, nil
+	}
+	return 0, fmt.Errorf("bad expression node %s %s", node.Kind, node.Name)
+}
+
+// Returns the value of a parent on a frame.
+// If class is set, only detections with that class are counted.
+func exprParentValue(data vaas.Data, class string) (float64, error) {
+	switch data := data.(type) {
+	case vaas.DetectionData:
+		if class == "" {
+			return float64(len(data.D[0].Detections)), nil
+		}
+		count := 0
+		for _, d := range data.D[0].Detections {
+			if d.Class == class {
+				count++
+			}
+		}
+		return float64(count), nil
+	}
+	if class != "" {
+		return 0, fmt.Errorf("count requires a detection or track parent, but got %s", data.Type())
+	}
+	switch data := data.(type) {
+	case vaas.IntData:
+		return float64(data[0]), nil
+	case vaas.FloatData:
+		return data[0], nil
+	}
+	switch data.Type() {
+	case vaas.StringType, vaas.TextType:
+		return exprBool(!data.IsEmpty()), nil
+	}
+	return 0, fmt.Errorf("expressions do not support %s parents", data.Type())
+}
@@ -0,0 +1,147 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Parents of one frame: p0 is detections (two cars and a bus), p1 is int 3, and
+// p2 is float 0.5.
+func testExprFrame() []vaas.Data {
+	return []vaas.Data{
+		vaas.DetectionData{T: vaas.DetectionType, D: []vaas.DetectionFrame{{
+			Detections: []vaas.Detection{{Class: "car"}, {Class: "car"}, {Class: "bus"}},
+		}}},
+		vaas.IntData{3},
+		vaas.FloatData{0.5},
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		expected float64
+	}{
+		{"p0", 3},
+		{"p1 + p2", 3.5},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 * 3 + 10 % 4", -4},
+		{"2 - 1 - 1", 0},
+		{"8 / 2 / 2", 2},
+		{"5 / 0", 0},
+		{"p1 > 2 and p2 < 1", 1},
+		{"p1 > 2 && p2 > 1", 0},
+		{"false or p1 == 3", 1},
+		{"1 + 1 == 2", 1},
+		{"p1 < 2 or p1 > 2 and p2 > 1", 0},
+		{"true || false && false", 1},
+		{"not p1 == 3", 0},
+		{"! (p1 == 3)", 0},
+		{"!p2", 0},
+		{"not not p1", 1},
+		{"p1 != 3 || !false", 1},
+		{"count(p0, \"car\")", 2},
+		{"count(p0, 'bus') == 1", 1},
+		{"count(p0, \"truck\")", 0},
+		{"count(p0)", 3},
+		{"abs(p2 - p1)", 2.5},
+		{"min(p1, p2) + max(p1, p2)", 3.5},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpr(test.expr, 3)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", test.expr, err)
+		}
+		x, err := expr.NewEvaluator(1).Eval(testExprFrame())
+		if err != nil {
+			t.Fatalf("error evaluating %s: %v", test.expr, err)
+		}
+		if x != test.expected {
+			t.Fatalf("expected %s = %v but got %v", test.expr, test.expected, x)
+		}
+	}
+}
+
+func TestExprParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err string
+	}{
+		{"p1 +", "unexpected end"},
+		{"(p1", "expected \")\""},
+		{"p1 p2", "unexpected \"p2\""},
+		{"p3", "out of range"},
+		{"foo", "unknown identifier"},
+		{"foo(p1)", "unknown function"},
+		{"count(p1, car)", "class string"},
+		{"count(3)", "expects a parent"},
+		{"any_in_last(p1, 0)", "positive integer window"},
+		{"sum_over(p1)", "expected \",\""},
+		{"min(p1)", "expected \",\""},
+		{"p1 = 2", "unexpected character"},
+		{"'car", "unterminated string"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.expr, 3)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("expected error containing %q when parsing %s but got %v", test.err, test.expr, err)
+		}
+	}
+
+	// count needs detections
+	expr, err := ParseExpr("count(p1, \"car\")", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.NewEvaluator(1).Eval(testExprFrame()); err == nil {
+		t.Fatalf("expected error counting classes of an int parent")
+	}
+}
+
+func TestExprWindows(t *testing.T) {
+	// windows are in frames, so at freq=2 a window of 4 frames covers 2 samples
+	// and a window of 5 frames covers 3 samples
+	expr, err := ParseExpr("any_in_last(p0 > 0, 4) * 100 + sum_over(p0, 5)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := expr.NewEvaluator(2)
+	var outputs []float64
+	for _, x := range []int{1, 0, 0, 2, 3, 0, 0, 0} {
+		y, err := e.Eval([]vaas.Data{vaas.IntData{x}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, y)
+	}
+	if fmt.Sprintf("%v", outputs) != "[101 101 1 102 105 105 3 0]" {
+		t.Fatalf("unexpected outputs %v", outputs)
+	}
+}
+
+func TestBoolExprAcrossSlices(t *testing.T) {
+	node := vaas.Node{
+		Type: "bool-expr",
+		DataType: vaas.IntType,
+		Parents: testParents(1),
+		Code: `{"Expr": "any_in_last(p0, 6)"}`,
+	}
+	e := NewBoolExpr(node)
+	inputs := vaas.IntData{0, 0, 1, 0, 0, 0, 0, 0}
+	var outputs vaas.IntData
+	var state []byte
+	// at freq=2 the window is 3 samples, so the value at the end of the first
+	// slice continues into the second slice
+	for _, slice := range []vaas.Slice{{Start: 0, End: 6}, {Start: 6, End: 16}} {
+		var data vaas.Data
+		data, state = testRunExecutor(t, e, slice, 2, state, inputs.Slice(slice.Start/2, slice.End/2))
+		outputs = append(outputs, data.(vaas.IntData)...)
+	}
+	if fmt.Sprintf("%v", outputs) != "[0 0 1 1 1 0 0 0]" {
+		t.Fatalf("unexpected outputs %v", outputs)
+	}
+}
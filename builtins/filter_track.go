@@ -2,41 +2,11 @@ package builtins
 
 import (
 	"../vaas"
-	"github.com/mitroadmaps/gomapinfer/common"
 	"encoding/json"
 	"fmt"
 	"time"
 )
 
-type Shape [][2]int
-
-func (shp Shape) Bounds() common.Rectangle {
-	r := common.EmptyRectangle
-	for _, p := range shp {
-		r = r.Extend(common.Point{float64(p[0]), float64(p[1])})
-	}
-	return r
-}
-
-func (shp Shape) Polygon() common.Polygon {
-	poly := common.Polygon{}
-	for _, p := range shp {
-		poly = append(poly, common.Point{float64(p[0]), float64(p[1])})
-	}
-	return poly
-}
-
-func (shp Shape) Contains(d vaas.Detection) bool {
-	cx := (d.Left + d.Right)/2
-	cy := (d.Top + d.Bottom)/2
-	point := common.Point{float64(cx), float64(cy)}
-	if len(shp) == 2 {
-		return shp.Bounds().Contains(point)
-	} else {
-		return shp.Polygon().Contains(point)
-	}
-}
-
 type TrackFilterConfig struct {
 	CanvasDims [2]int
 
@@ -44,7 +14,7 @@ type TrackFilterConfig struct {
 	// each shape is specified by a list of points
 	// each row is a different alternative that can satisfy the predicate
 	// within a row, the track must pass through all columns
-	Shapes [][]Shape
+	Shapes [][]vaas.Shape
 
 	// whether the track must pass through columns in a row in order, or in any order
 	Order bool
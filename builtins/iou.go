@@ -41,7 +41,19 @@ func NewIOU(node vaas.Node) vaas.Executor {
 	}
 }
 
+// State handed to the next slice: the active tracks continue with the same IDs.
+type IOUState struct {
+	NextID int
+	// active tracks with only their last detection, and LastFrame relative to the
+	// start of the next slice
+	Tracks []TrackWithID
+}
+
 func (m IOU) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+func (m IOU) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
 	parents, err := GetParents(ctx, m.node)
 	if err != nil {
 		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("iou error reading parents: %v", err))
@@ -53,7 +65,16 @@ func (m IOU) Run(ctx vaas.ExecContext) vaas.DataBuffer {
 
 		var nextID int = 1
 		activeTracks := make(map[int]*TrackWithID)
-		PerFrame(
+		if state != nil {
+			var s IOUState
+			vaas.JsonUnmarshal(state, &s)
+			nextID = s.NextID
+			for i := range s.Tracks {
+				activeTracks[s.Tracks[i].ID] = &s.Tracks[i]
+			}
+		}
+		numFrames := 0
+		PerFrameWithFinish(
 			parents, ctx.Slice, buf, vaas.DetectionType,
 			vaas.ReadMultipleOptions{Stats: m.stats},
 			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
@@ -93,6 +114,7 @@ func (m IOU) Run(ctx vaas.ExecContext) vaas.DataBuffer {
 					}
 					delete(activeTracks, track.ID)
 				}
+				numFrames = idx+1
 
 				ndata := vaas.DetectionData{
 					T: vaas.TrackType,
@@ -104,6 +126,17 @@ func (m IOU) Run(ctx vaas.ExecContext) vaas.DataBuffer {
 				buf.Write(ndata)
 				return nil
 			},
+			func() {
+				s := IOUState{NextID: nextID}
+				for _, track := range activeTracks {
+					s.Tracks = append(s.Tracks, TrackWithID{
+						ID: track.ID,
+						Detections: []vaas.Detection{track.Last()},
+						LastFrame: track.LastFrame - numFrames,
+					})
+				}
+				export(vaas.JsonMarshal(s))
+			},
 		)
 	}()
 
@@ -168,5 +201,8 @@ func (m IOU) Stats() vaas.StatsSample {
 }
 
 func init() {
-	vaas.Executors["iou"] = vaas.ExecutorMeta{New: NewIOU}
+	vaas.Executors["iou"] = vaas.ExecutorMeta{
+		New: NewIOU,
+		Stateful: true,
+	}
 }
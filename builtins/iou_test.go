@@ -0,0 +1,61 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"testing"
+)
+
+func TestIOUAcrossSlices(t *testing.T) {
+	node := vaas.Node{
+		Type: "iou",
+		DataType: vaas.TrackType,
+		Parents: testParents(1),
+	}
+	e := NewIOU(node)
+
+	// object A moves right on every frame, object B is missed on frames 4-6, and
+	// object C appears on frame 6, which is the first frame of the second slice
+	detections := vaas.DetectionData{T: vaas.DetectionType}
+	for i := 0; i < 12; i++ {
+		frame := []vaas.Detection{{Left: i, Top: 0, Right: i+40, Bottom: 40}}
+		if i < 4 || i > 6 {
+			frame = append(frame, vaas.Detection{Left: 100, Top: 0, Right: 140, Bottom: 40})
+		}
+		if i >= 6 {
+			frame = append(frame, vaas.Detection{Left: 300, Top: 0, Right: 340, Bottom: 40})
+		}
+		detections.D = append(detections.D, vaas.DetectionFrame{Detections: frame})
+	}
+
+	// track ID of the detection at each left coordinate on each frame
+	ids := make([]map[int]int, 12)
+	var state []byte
+	for _, slice := range []vaas.Slice{{Start: 0, End: 6}, {Start: 6, End: 12}} {
+		var data vaas.Data
+		data, state = testRunExecutor(t, e, slice, 1, state, detections.Slice(slice.Start, slice.End))
+		for i, df := range data.(vaas.DetectionData).D {
+			ids[slice.Start+i] = make(map[int]int)
+			for _, d := range df.Detections {
+				ids[slice.Start+i][d.Left] = d.TrackID
+			}
+		}
+	}
+
+	idA := ids[0][0]
+	idB := ids[0][100]
+	if idA == 0 || idB == 0 || idA == idB {
+		t.Fatalf("expected different track IDs for A and B but got %v", ids[0])
+	}
+	for i := 1; i < 12; i++ {
+		if ids[i][i] != idA {
+			t.Fatalf("expected A to keep track ID %d on frame %d but got %v", idA, i, ids[i])
+		}
+		if (i < 4 || i > 6) && ids[i][100] != idB {
+			t.Fatalf("expected B to keep track ID %d on frame %d but got %v", idB, i, ids[i])
+		}
+		if i >= 6 && ids[i][300] != 3 {
+			t.Fatalf("expected C to get the next track ID 3 on frame %d but got %v", i, ids[i])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package builtins
+
+// Counting tracks that cross directed line segments, e.g. vehicles crossing a stop line.
+// line-crossing emits a detection for each crossing, on the frame where it happens,
+// and line-count turns those events into a running count for one line.
+// Both are stateful so that crossings and counts carry over between contiguous slices.
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	CrossingForward = "forward"
+	CrossingBackward = "backward"
+)
+
+type CrossingLine struct {
+	Name string
+	// directed segment from the first point to the second
+	// a track crosses it forward when it moves from the left-hand side to the
+	// right-hand side, as seen when walking from the first point to the second
+	Points [2][2]int
+}
+
+// Returns which side of the line the point is on: positive for the right-hand
+// side, negative for the left-hand side, and zero if it is on the line.
+func (line CrossingLine) side(x float64, y float64) float64 {
+	ax, ay := float64(line.Points[0][0]), float64(line.Points[0][1])
+	bx, by := float64(line.Points[1][0]), float64(line.Points[1][1])
+	return (bx-ax)*(y-ay) - (by-ay)*(x-ax)
+}
+
+// Returns the direction in which the movement from p to q crosses the segment,
+// or "" if it does not cross.
+func (line CrossingLine) Crossing(p [2]float64, q [2]float64) string {
+	s1 := line.side(p[0], p[1])
+	s2 := line.side(q[0], q[1])
+	// a point exactly on the line counts as the left-hand side, so that a track
+	// stopping on the line is counted once when it leaves to the right
+	if (s1 > 0) == (s2 > 0) {
+		return ""
+	}
+	// the movement must also pass between the endpoints of the segment
+	a := [2]float64{float64(line.Points[0][0]), float64(line.Points[0][1])}
+	b := [2]float64{float64(line.Points[1][0]), float64(line.Points[1][1])}
+	cross := func(o, u, v [2]float64) float64 {
+		return (u[0]-o[0])*(v[1]-o[1]) - (u[1]-o[1])*(v[0]-o[0])
+	}
+	t1 := cross(p, q, a)
+	t2 := cross(p, q, b)
+	if (t1 > 0 && t2 > 0) || (t1 < 0 && t2 < 0) {
+		return ""
+	}
+	if s2 > 0 {
+		return CrossingForward
+	}
+	return CrossingBackward
+}
+
+type LineCrossingConfig struct {
+	// coordinates of the lines are relative to these dimensions
+	CanvasDims [2]int
+	Lines []CrossingLine
+}
+
+// Crossing events are detections whose class identifies the line and direction.
+func CrossingClass(line string, direction string) string {
+	return line + ":" + direction
+}
+
+func ParseCrossingClass(class string) (string, string) {
+	idx := strings.LastIndex(class, ":")
+	if idx == -1 {
+		return class, ""
+	}
+	return class[0:idx], class[idx+1:]
+}
+
+type LineCrossing struct {
+	node vaas.Node
+	cfg LineCrossingConfig
+	stats *vaas.StatsHolder
+}
+
+func NewLineCrossing(node vaas.Node) vaas.Executor {
+	var cfg LineCrossingConfig
+	err := json.Unmarshal([]byte(node.Code), &cfg)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+	}
+	return LineCrossing{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// State handed to the next slice, so that crossings between the last frame of a
+// slice and the first frame of the next one are detected.
+type LineCrossingState struct {
+	// last center of each track that appeared in the slice
+	Centers map[int][2]float64
+}
+
+func (m LineCrossing) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+func (m LineCrossing) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("line-crossing error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.DetectionType)
+
+	go func() {
+		buf.SetMeta(parents[0].Freq())
+
+		// last center of each track, in CanvasDims coordinates
+		lastCenters := make(map[int][2]float64)
+		if state != nil {
+			var s LineCrossingState
+			vaas.JsonUnmarshal(state, &s)
+			for trackID, center := range s.Centers {
+				lastCenters[trackID] = center
+			}
+		}
+		// tracks that appeared in this slice, only these are handed to the next
+		// slice so that the state doesn't grow with every track in the segment
+		seen := make(map[int]bool)
+		PerFrameWithFinish(
+			parents, ctx.Slice, buf, vaas.TrackType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				df := data.(vaas.DetectionData).D[0]
+				resized := data.(vaas.DetectionData).Resize(m.cfg.CanvasDims).D[0]
+				var out []vaas.Detection
+				for i, d := range resized.Detections {
+					if d.TrackID < 0 {
+						continue
+					}
+					cur := [2]float64{float64(d.Left+d.Right)/2, float64(d.Top+d.Bottom)/2}
+					prev, ok := lastCenters[d.TrackID]
+					lastCenters[d.TrackID] = cur
+					seen[d.TrackID] = true
+					if !ok {
+						continue
+					}
+					for _, line := range m.cfg.Lines {
+						direction := line.Crossing(prev, cur)
+						if direction == "" {
+							continue
+						}
+						event := df.Detections[i]
+						event.Class = CrossingClass(line.Name, direction)
+						out = append(out, event)
+					}
+				}
+				buf.Write(vaas.DetectionData{
+					T: vaas.DetectionType,
+					D: []vaas.DetectionFrame{{
+						Detections: out,
+						CanvasDims: df.CanvasDims,
+					}},
+				})
+				return nil
+			},
+			func() {
+				s := LineCrossingState{Centers: make(map[int][2]float64)}
+				for trackID := range seen {
+					s.Centers[trackID] = lastCenters[trackID]
+				}
+				export(vaas.JsonMarshal(s))
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m LineCrossing) Close() {}
+
+func (m LineCrossing) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+type LineCountConfig struct {
+	// name of the line to count, or empty to count all lines
+	Line string
+	// CrossingForward, CrossingBackward, or empty to count both directions
+	Direction string
+}
+
+type LineCount struct {
+	node vaas.Node
+	cfg LineCountConfig
+	stats *vaas.StatsHolder
+}
+
+func NewLineCount(node vaas.Node) vaas.Executor {
+	var cfg LineCountConfig
+	err := json.Unmarshal([]byte(node.Code), &cfg)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+	}
+	return LineCount{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+func (m LineCount) Matches(class string) bool {
+	line, direction := ParseCrossingClass(class)
+	if m.cfg.Line != "" && line != m.cfg.Line {
+		return false
+	}
+	if m.cfg.Direction != "" && direction != m.cfg.Direction {
+		return false
+	}
+	return true
+}
+
+// State handed to the next slice: the count so far in the segment.
+type LineCountState struct {
+	Count int
+}
+
+func (m LineCount) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+// Outputs the number of crossings so far on each frame.
+// The count continues from the previous contiguous slice of the segment, so it
+// only restarts from zero where the query starts running on a segment.
+func (m LineCount) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("line-count error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.IntType)
+
+	go func() {
+		buf.SetMeta(parents[0].Freq())
+		count := 0
+		if state != nil {
+			var s LineCountState
+			vaas.JsonUnmarshal(state, &s)
+			count = s.Count
+		}
+		PerFrameWithFinish(
+			parents, ctx.Slice, buf, vaas.DetectionType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				for _, d := range data.(vaas.DetectionData).D[0].Detections {
+					if m.Matches(d.Class) {
+						count++
+					}
+				}
+				buf.Write(vaas.IntData{count})
+				return nil
+			},
+			func() {
+				export(vaas.JsonMarshal(LineCountState{count}))
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m LineCount) Close() {}
+
+func (m LineCount) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["line-crossing"] = vaas.ExecutorMeta{New: NewLineCrossing, Stateful: true}
+	vaas.Executors["line-count"] = vaas.ExecutorMeta{New: NewLineCount, Stateful: true}
+}
@@ -0,0 +1,69 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"fmt"
+	"testing"
+)
+
+func TestLineCrossingAcrossSlices(t *testing.T) {
+	cfg := LineCrossingConfig{
+		CanvasDims: [2]int{100, 100},
+		Lines: []CrossingLine{{Name: "stop", Points: [2][2]int{{50, 0}, {50, 100}}}},
+	}
+	crossingNode := vaas.Node{
+		Type: "line-crossing",
+		DataType: vaas.DetectionType,
+		Parents: testParents(1),
+		Code: string(vaas.JsonMarshal(cfg)),
+	}
+	countNode := vaas.Node{
+		Type: "line-count",
+		DataType: vaas.IntType,
+		Parents: testParents(1),
+		Code: `{"Line": "stop"}`,
+	}
+	crossing := NewLineCrossing(crossingNode)
+	count := NewLineCount(countNode)
+
+	// track 1 moves right by 10 pixels per frame and crosses x=50 between the
+	// last frame of the first slice and the first frame of the second slice
+	// track 2 starts in the second slice and crosses the other way
+	tracks := vaas.DetectionData{T: vaas.TrackType}
+	for i := 0; i < 10; i++ {
+		x1 := 5 + 10*i
+		detections := []vaas.Detection{{Left: x1-5, Top: 0, Right: x1+5, Bottom: 10, TrackID: 1}}
+		if i >= 5 {
+			x2 := 75 - 10*(i-5)
+			detections = append(detections, vaas.Detection{Left: x2-5, Top: 50, Right: x2+5, Bottom: 60, TrackID: 2})
+		}
+		tracks.D = append(tracks.D, vaas.DetectionFrame{
+			Detections: detections,
+			CanvasDims: [2]int{100, 100},
+		})
+	}
+
+	var crossingState, countState []byte
+	var counts vaas.IntData
+	for _, slice := range []vaas.Slice{{Start: 0, End: 5}, {Start: 5, End: 10}} {
+		var events, data vaas.Data
+		events, crossingState = testRunExecutor(t, crossing, slice, 1, crossingState, tracks.Slice(slice.Start, slice.End))
+		if slice.Start == 5 {
+			// with y pointing down, moving right crosses this line backward
+			detections := events.(vaas.DetectionData).D[0].Detections
+			if len(detections) != 1 || detections[0].TrackID != 1 || detections[0].Class != "stop:backward" {
+				t.Fatalf("expected crossing on the first frame of the second slice but got %v", detections)
+			}
+			detections = events.(vaas.DetectionData).D[3].Detections
+			if len(detections) != 1 || detections[0].TrackID != 2 || detections[0].Class != "stop:forward" {
+				t.Fatalf("expected crossing by track 2 but got %v", detections)
+			}
+		}
+		data, countState = testRunExecutor(t, count, slice, 1, countState, events)
+		counts = append(counts, data.(vaas.IntData)...)
+	}
+	if fmt.Sprintf("%v", counts) != "[0 0 0 0 0 1 1 1 2 2]" {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
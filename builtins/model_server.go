@@ -0,0 +1,503 @@
+package builtins
+
+// Runs a model behind an HTTP inference server instead of in the container.
+
+import (
+	"../vaas"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ModelServerConfig struct {
+	// inference endpoint, e.g. http://models:8000/v1/detect
+	URL string
+	// how frames are sent to the server:
+	// - "jpeg": JSON body {"images": [base64 JPEG, ...]}
+	// - "rgb": raw RGB bytes of the batch (frames*height*width*3), with the dimensions
+	//   in the X-Frames, X-Height, and X-Width headers
+	Format string
+	// extra headers, e.g. for an API key
+	Headers map[string]string
+	// if set, rescale frames to this [width, height] before sending them
+	InputSize [2]int
+
+	// number of frames per request (default 1)
+	BatchSize int
+	// maximum number of concurrent requests from this node in each container (default 1)
+	Concurrency int
+	// number of times to retry requests that fail with network errors, 429, or 5xx
+	Retries int
+	// request timeout in seconds (default 60)
+	Timeout int
+
+	Response ModelServerResponse
+}
+
+// Describes how to get the outputs for each frame from the JSON response.
+// Paths are dot-separated keys or list indices, and an empty path refers to the value itself.
+type ModelServerResponse struct {
+	// path to the list with one element per frame
+	Frames string
+
+	// detection nodes: path in each frame element to the list of detections
+	Detections string
+	// detection nodes: keys in each detection
+	// Box is a [left, top, right, bottom] list, and if set it is used instead of Left/Top/Right/Bottom
+	Box string
+	Left string
+	Top string
+	Right string
+	Bottom string
+	Score string
+	Class string
+	// detection nodes: coordinates are fractions of the frame size instead of pixels
+	Normalized bool
+
+	// int and float nodes: path in each frame element to the value
+	Value string
+	// int nodes: if the value is a string, the output is its index in Labels
+	Labels []string
+}
+
+// Retried requests wait this long times the attempt number.
+const ModelServerRetryDelay = 500*time.Millisecond
+
+type ModelServer struct {
+	node vaas.Node
+	cfg ModelServerConfig
+	client *http.Client
+	// limits the number of concurrent requests
+	sem chan bool
+	stats *vaas.StatsHolder
+}
+
+func NewModelServer(node vaas.Node) vaas.Executor {
+	var cfg ModelServerConfig
+	err := json.Unmarshal([]byte(node.Code), &cfg)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+	}
+	if cfg.URL == "" {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("model-server node is not configured (no URL)")}
+	}
+	if cfg.Format != "jpeg" && cfg.Format != "rgb" {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("model-server node has invalid format %s (must be jpeg or rgb)", cfg.Format)}
+	}
+	if node.DataType != vaas.DetectionType && node.DataType != vaas.IntType && node.DataType != vaas.FloatType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("model-server node must output detection, int, or float, but got %s", node.DataType)}
+	}
+	if len(node.ParentTypes) != 1 || node.ParentTypes[0] != vaas.VideoType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("model-server node must have exactly one video parent")}
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Timeout < 1 {
+		cfg.Timeout = 60
+	}
+	r := &cfg.Response
+	defaultKey := func(key *string, def string) {
+		if *key == "" {
+			*key = def
+		}
+	}
+	defaultKey(&r.Left, "left")
+	defaultKey(&r.Top, "top")
+	defaultKey(&r.Right, "right")
+	defaultKey(&r.Bottom, "bottom")
+	defaultKey(&r.Score, "score")
+	defaultKey(&r.Class, "class")
+
+	return &ModelServer{
+		node: node,
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout)*time.Second,
+		},
+		sem: make(chan bool, cfg.Concurrency),
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// Get a value from decoded JSON by a dot-separated path.
+func jsonLookup(x interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return x, nil
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := x.(type) {
+		case map[string]interface{}:
+			var ok bool
+			x, ok = v[part]
+			if !ok {
+				return nil, fmt.Errorf("key %s not found", part)
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, fmt.Errorf("invalid list index %s", part)
+			}
+			x = v[idx]
+		default:
+			return nil, fmt.Errorf("cannot get %s from %v", part, x)
+		}
+	}
+	return x, nil
+}
+
+func jsonFloat(x interface{}, path string) (float64, error) {
+	v, err := jsonLookup(x, path)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expected number at %s but got %v", path, v)
+	}
+	return f, nil
+}
+
+func (m *ModelServer) encodeRequest(images []vaas.Image) (*http.Request, error) {
+	var body []byte
+	var contentType string
+	if m.cfg.Format == "jpeg" {
+		var request struct {
+			Images []string `json:"images"`
+		}
+		for _, im := range images {
+			request.Images = append(request.Images, base64.StdEncoding.EncodeToString(im.AsJPG()))
+		}
+		body = vaas.JsonMarshal(request)
+		contentType = "application/json"
+	} else {
+		body = make([]byte, 0, len(images)*images[0].Width*images[0].Height*3)
+		for _, im := range images {
+			body = append(body, im.ToBytes()...)
+		}
+		contentType = "application/octet-stream"
+	}
+	req, err := http.NewRequest("POST", m.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if m.cfg.Format == "rgb" {
+		req.Header.Set("X-Frames", strconv.Itoa(len(images)))
+		req.Header.Set("X-Height", strconv.Itoa(images[0].Height))
+		req.Header.Set("X-Width", strconv.Itoa(images[0].Width))
+	}
+	for k, v := range m.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Send one request, returning whether the error (if any) can be retried.
+func (m *ModelServer) request(images []vaas.Image) (interface{}, bool, error) {
+	req, err := m.encodeRequest(images)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry := resp.StatusCode == 429 || resp.StatusCode >= 500
+		return nil, retry, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var response interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, false, fmt.Errorf("error decoding response: %v", err)
+	}
+	return response, false, nil
+}
+
+// Run inference on a batch of frames, with retries.
+func (m *ModelServer) infer(images []vaas.Image) (vaas.Data, error) {
+	m.sem <- true
+	defer func() {
+		<- m.sem
+	}()
+
+	var response interface{}
+	var err error
+	for attempt := 0; attempt <= m.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt)*ModelServerRetryDelay)
+		}
+		var retry bool
+		response, retry, err = m.request(images)
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("model server error: %v", err)
+	}
+	data, err := m.decodeResponse(response, images)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping model server response: %v", err)
+	}
+	return data, nil
+}
+
+func (m *ModelServer) decodeResponse(response interface{}, images []vaas.Image) (vaas.Data, error) {
+	r := m.cfg.Response
+	frames_, err := jsonLookup(response, r.Frames)
+	if err != nil {
+		return nil, err
+	}
+	frames, ok := frames_.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list of frames but got %v", frames_)
+	}
+	if len(frames) != len(images) {
+		return nil, fmt.Errorf("sent %d frames but got outputs for %d", len(images), len(frames))
+	}
+
+	if m.node.DataType == vaas.DetectionType {
+		data := vaas.DetectionData{T: vaas.DetectionType}
+		for i, frame := range frames {
+			df, err := m.decodeDetections(frame, images[i])
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", i, err)
+			}
+			data.D = append(data.D, df)
+		}
+		return data, nil
+	}
+
+	var values []float64
+	for i, frame := range frames {
+		v, err := jsonLookup(frame, r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if label, ok := v.(string); ok && m.node.DataType == vaas.IntType && len(r.Labels) > 0 {
+			v = nil
+			for idx, l := range r.Labels {
+				if l == label {
+					v = float64(idx)
+				}
+			}
+			if v == nil {
+				return nil, fmt.Errorf("frame %d: unknown label %s", i, label)
+			}
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("frame %d: expected number but got %v", i, v)
+		}
+		values = append(values, f)
+	}
+	if m.node.DataType == vaas.IntType {
+		var data vaas.IntData
+		for _, f := range values {
+			data = append(data, int(f))
+		}
+		return data, nil
+	}
+	return vaas.FloatData(values), nil
+}
+
+func (m *ModelServer) decodeDetections(frame interface{}, im vaas.Image) (vaas.DetectionFrame, error) {
+	r := m.cfg.Response
+	df := vaas.DetectionFrame{
+		Detections: []vaas.Detection{},
+		CanvasDims: [2]int{im.Width, im.Height},
+	}
+	list_, err := jsonLookup(frame, r.Detections)
+	if err != nil {
+		return df, err
+	}
+	list, ok := list_.([]interface{})
+	if !ok {
+		return df, fmt.Errorf("expected list of detections but got %v", list_)
+	}
+	for _, x := range list {
+		var box [4]float64
+		if r.Box != "" {
+			for i := range box {
+				box[i], err = jsonFloat(x, r.Box + "." + strconv.Itoa(i))
+				if err != nil {
+					return df, err
+				}
+			}
+		} else {
+			for i, key := range []string{r.Left, r.Top, r.Right, r.Bottom} {
+				box[i], err = jsonFloat(x, key)
+				if err != nil {
+					return df, err
+				}
+			}
+		}
+		if r.Normalized {
+			box[0] *= float64(im.Width)
+			box[1] *= float64(im.Height)
+			box[2] *= float64(im.Width)
+			box[3] *= float64(im.Height)
+		}
+		d := vaas.Detection{
+			Left: int(box[0]),
+			Top: int(box[1]),
+			Right: int(box[2]),
+			Bottom: int(box[3]),
+		}
+		// score and class are optional
+		if score, err := jsonFloat(x, r.Score); err == nil {
+			d.Score = score
+		}
+		if class, err := jsonLookup(x, r.Class); err == nil {
+			if s, ok := class.(string); ok {
+				d.Class = s
+			} else if f, ok := class.(float64); ok {
+				d.Class = strconv.Itoa(int(f))
+			}
+		}
+		df.Detections = append(df.Detections, d)
+	}
+	return df, nil
+}
+
+type modelServerResult struct {
+	data vaas.Data
+	err error
+}
+
+func (m *ModelServer) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("model-server error reading parents: %v", err))
+	}
+	return m.run(parents, ctx.Slice.Length(), ctx.Mask)
+}
+
+// Run on the frames of a slice of the given length read from parents.
+func (m *ModelServer) run(parents []vaas.DataReader, length int, mask []bool) vaas.DataBuffer {
+	if len(parents) != 1 || parents[0].Type() != vaas.VideoType {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("model-server node must have exactly one video parent"))
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+
+	// batches are sent concurrently, but we need to write the outputs in order
+	// so the results of each batch go through a channel in this queue
+	queue := make(chan chan modelServerResult, m.cfg.Concurrency)
+
+	go func() {
+		parent := parents[0]
+		if m.cfg.InputSize[0] > 0 && m.cfg.InputSize[1] > 0 {
+			if vbufReader, ok := parent.(*vaas.VideoBufferReader); ok {
+				vbufReader.Rescale(m.cfg.InputSize)
+			}
+		}
+		buf.SetMeta(parent.Freq())
+
+		// only the frames selected by the frame-level selector are sent to the
+		// server, and the other frames of the batch get empty outputs
+		send := func(images []vaas.Image, selected []bool) {
+			ch := make(chan modelServerResult, 1)
+			queue <- ch
+			var inputs []vaas.Image
+			for i, im := range images {
+				if selected[i] {
+					inputs = append(inputs, im)
+				}
+			}
+			go func() {
+				var data vaas.Data
+				var err error
+				if len(inputs) > 0 {
+					data, err = m.infer(inputs)
+				}
+				if err != nil || len(inputs) == len(images) {
+					ch <- modelServerResult{data, err}
+					return
+				}
+				out := vaas.NewData(m.node.DataType)
+				j := 0
+				for i := range images {
+					if selected[i] {
+						out = out.Append(data.Slice(j, j+1))
+						j++
+					} else {
+						out = out.Append(vaas.NewData(m.node.DataType).EnsureLength(1))
+					}
+				}
+				ch <- modelServerResult{out, nil}
+			}()
+		}
+		// frames that don't fill a batch yet
+		var pending []vaas.Image
+		var pendingSelected []bool
+		opts := vaas.ReadMultipleOptions{Stats: m.stats, Mask: mask}
+		err := vaas.ReadMultipleMasked(length, parent.Freq(), parents, opts, func(index int, datas []vaas.Data, selected []bool) error {
+			pending = append(pending, datas[0].(vaas.VideoData)...)
+			pendingSelected = append(pendingSelected, selected...)
+			for len(pending) >= m.cfg.BatchSize {
+				send(pending[0:m.cfg.BatchSize], pendingSelected[0:m.cfg.BatchSize])
+				pending = pending[m.cfg.BatchSize:]
+				pendingSelected = pendingSelected[m.cfg.BatchSize:]
+			}
+			return nil
+		})
+		if err == nil && len(pending) > 0 {
+			send(pending, pendingSelected)
+		}
+		if err != nil {
+			ch := make(chan modelServerResult, 1)
+			ch <- modelServerResult{nil, err}
+			queue <- ch
+		}
+		close(queue)
+	}()
+
+	go func() {
+		var err error
+		for ch := range queue {
+			result := <- ch
+			// keep reading the queue after an error so that the sender doesn't block
+			if err != nil {
+				continue
+			}
+			if result.err != nil {
+				err = result.err
+				continue
+			}
+			buf.Write(result.data)
+		}
+		if err != nil {
+			buf.Error(err)
+		} else {
+			buf.Close()
+		}
+	}()
+
+	return buf
+}
+
+func (m *ModelServer) Close() {}
+
+func (m *ModelServer) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["model-server"] = vaas.ExecutorMeta{New: NewModelServer}
+}
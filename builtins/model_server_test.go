@@ -0,0 +1,347 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestModelServer(t *testing.T, dataType vaas.DataType, cfg ModelServerConfig) *ModelServer {
+	e := NewModelServer(vaas.Node{
+		Name: "test",
+		ParentTypes: []vaas.DataType{vaas.VideoType},
+		Type: "model-server",
+		DataType: dataType,
+		Code: string(vaas.JsonMarshal(cfg)),
+	})
+	m, ok := e.(*ModelServer)
+	if !ok {
+		t.Fatalf("error creating executor: %v", e.(vaas.ErrorExecutor).Error)
+	}
+	return m
+}
+
+func testImages(n int) []vaas.Image {
+	var images []vaas.Image
+	for i := 0; i < n; i++ {
+		images = append(images, vaas.NewImage(8, 4))
+	}
+	return images
+}
+
+func TestModelServerDetections(t *testing.T) {
+	// stand-in for a detection model that takes JPEGs and returns normalized boxes
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Images []string `json:"images"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if r.Header.Get(vaas.AuthHeader) != "" {
+			http.Error(w, "got vaas secret", 400)
+			return
+		}
+		var predictions []interface{}
+		for range request.Images {
+			predictions = append(predictions, map[string]interface{}{
+				"objects": []interface{}{map[string]interface{}{
+					"box": []float64{0.25, 0.5, 0.75, 1},
+					"label": "car",
+					"confidence": 0.9,
+				}},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"predictions": predictions})
+	}))
+	defer server.Close()
+
+	m := newTestModelServer(t, vaas.DetectionType, ModelServerConfig{
+		URL: server.URL,
+		Format: "jpeg",
+		Response: ModelServerResponse{
+			Frames: "predictions",
+			Detections: "objects",
+			Box: "box",
+			Class: "label",
+			Score: "confidence",
+			Normalized: true,
+		},
+	})
+	data, err := m.infer(testImages(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd := data.(vaas.DetectionData)
+	if len(dd.D) != 2 || len(dd.D[1].Detections) != 1 {
+		t.Fatalf("expected one detection in each of two frames but got %v", dd)
+	}
+	d := dd.D[1].Detections[0]
+	expected := vaas.Detection{Left: 2, Top: 2, Right: 6, Bottom: 4, Score: 0.9, Class: "car"}
+	if d != expected || dd.D[1].CanvasDims != [2]int{8, 4} {
+		t.Fatalf("expected %v but got %v (%v)", expected, d, dd.D[1].CanvasDims)
+	}
+}
+
+func TestModelServerRetries(t *testing.T) {
+	// stand-in for a classifier that takes raw RGB batches, and fails the first request
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n == 1 {
+			http.Error(w, "overloaded", 503)
+			return
+		}
+		frames, _ := strconv.Atoi(r.Header.Get("X-Frames"))
+		var labels []string
+		for i := 0; i < frames; i++ {
+			labels = append(labels, "dog")
+		}
+		json.NewEncoder(w).Encode(labels)
+	}))
+	defer server.Close()
+
+	m := newTestModelServer(t, vaas.IntType, ModelServerConfig{
+		URL: server.URL,
+		Format: "rgb",
+		Retries: 1,
+		Response: ModelServerResponse{
+			Labels: []string{"cat", "dog"},
+		},
+	})
+	data, err := m.infer(testImages(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", data) != "[1 1 1]" || requests != 2 {
+		t.Fatalf("expected [1 1 1] after 2 requests but got %v after %d requests", data, requests)
+	}
+
+	// client errors should not be retried
+	requests = 0
+	m = newTestModelServer(t, vaas.IntType, ModelServerConfig{
+		URL: server.URL + "/missing",
+		Format: "rgb",
+		Retries: 3,
+	})
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "not found", 404)
+	})
+	if _, err := m.infer(testImages(1)); err == nil || requests != 1 {
+		t.Fatalf("expected error after one request but got %v after %d requests", err, requests)
+	}
+}
+
+func TestModelServerConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inflight := 0
+	maxInflight := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+		time.Sleep(20*time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		frames, _ := strconv.Atoi(r.Header.Get("X-Frames"))
+		values := make([]float64, frames)
+		json.NewEncoder(w).Encode(map[string]interface{}{"scores": values})
+	}))
+	defer server.Close()
+
+	m := newTestModelServer(t, vaas.FloatType, ModelServerConfig{
+		URL: server.URL,
+		Format: "rgb",
+		Concurrency: 2,
+		Response: ModelServerResponse{
+			Frames: "scores",
+		},
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.infer(testImages(2)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInflight != 2 {
+		t.Fatalf("expected at most 2 concurrent requests but got %d", maxInflight)
+	}
+}
+
+func TestModelServerParentType(t *testing.T) {
+	e := NewModelServer(vaas.Node{
+		Name: "test",
+		ParentTypes: []vaas.DataType{vaas.DetectionType},
+		Type: "model-server",
+		DataType: vaas.IntType,
+		Code: string(vaas.JsonMarshal(ModelServerConfig{URL: "http://localhost", Format: "rgb"})),
+	})
+	if _, ok := e.(vaas.ErrorExecutor); !ok {
+		t.Fatalf("expected error executor for detection parent")
+	}
+}
+
+// Reads all the outputs of an executor.
+func testReadAll(buf vaas.DataBuffer) (vaas.Data, error) {
+	rd := buf.Reader()
+	defer rd.Close()
+	out := vaas.NewData(buf.Type())
+	for {
+		data, err := rd.Read(vaas.FPS)
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		out = out.Append(data)
+	}
+}
+
+// Reads frames from memory.
+type testVideoReader struct {
+	frames vaas.VideoData
+	pos int
+}
+
+func (rd *testVideoReader) Type() vaas.DataType {
+	return vaas.VideoType
+}
+
+func (rd *testVideoReader) Peek(n int) (vaas.Data, error) {
+	if rd.pos >= len(rd.frames) {
+		return nil, io.EOF
+	}
+	end := rd.pos+n
+	if end > len(rd.frames) {
+		end = len(rd.frames)
+	}
+	return rd.frames[rd.pos:end], nil
+}
+
+func (rd *testVideoReader) Read(n int) (vaas.Data, error) {
+	data, err := rd.Peek(n)
+	if data != nil {
+		rd.pos += data.Length()
+	}
+	return data, err
+}
+
+func (rd *testVideoReader) Freq() int {
+	return 1
+}
+
+func (rd *testVideoReader) Wait() error {
+	return nil
+}
+
+func (rd *testVideoReader) Close() {}
+
+// Returns n frames where every pixel of frame i is i.
+func testNumberedFrames(n int) vaas.VideoData {
+	var frames vaas.VideoData
+	for i := 0; i < n; i++ {
+		im := vaas.NewImage(2, 2)
+		for j := range im.Bytes {
+			im.Bytes[j] = byte(i)
+		}
+		frames = append(frames, im)
+	}
+	return frames
+}
+
+// Stand-in for a model that outputs the pixel value of each RGB frame.
+// Earlier requests take longer so that responses come back out of order.
+func testNumberServer(mu *sync.Mutex, received *[]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		frames, _ := strconv.Atoi(r.Header.Get("X-Frames"))
+		var values []int
+		for i := 0; i < frames; i++ {
+			values = append(values, int(body[i*len(body)/frames]))
+		}
+		mu.Lock()
+		*received = append(*received, values...)
+		mu.Unlock()
+		time.Sleep(time.Duration(20-values[0])*time.Millisecond)
+		json.NewEncoder(w).Encode(values)
+	}))
+}
+
+func TestModelServerRun(t *testing.T) {
+	var mu sync.Mutex
+	var received []int
+	server := testNumberServer(&mu, &received)
+	defer server.Close()
+
+	m := newTestModelServer(t, vaas.IntType, ModelServerConfig{
+		URL: server.URL,
+		Format: "rgb",
+		BatchSize: 3,
+		Concurrency: 4,
+	})
+	// 10 frames: three full batches and one partial batch
+	rd := &testVideoReader{frames: testNumberedFrames(10)}
+	data, err := testReadAll(m.run([]vaas.DataReader{rd}, 10, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", data) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("expected outputs in frame order but got %v", data)
+	}
+	if len(received) != 10 {
+		t.Fatalf("expected server to get 10 frames but got %v", received)
+	}
+}
+
+func TestModelServerRunMasked(t *testing.T) {
+	var mu sync.Mutex
+	var received []int
+	server := testNumberServer(&mu, &received)
+	defer server.Close()
+
+	m := newTestModelServer(t, vaas.IntType, ModelServerConfig{
+		URL: server.URL,
+		Format: "rgb",
+		BatchSize: 2,
+		Concurrency: 2,
+	})
+	// frames 2, 3, and 6 aren't selected, so the second batch isn't sent at all
+	mask := []bool{true, true, false, false, true, true, false, true}
+	rd := &testVideoReader{frames: testNumberedFrames(8)}
+	data, err := testReadAll(m.run([]vaas.DataReader{rd}, 8, mask))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", data) != "[0 1 0 0 4 5 0 7]" {
+		t.Fatalf("expected empty outputs on unselected frames but got %v", data)
+	}
+	if len(received) != 5 {
+		t.Fatalf("expected server to get the 5 selected frames but got %v", received)
+	}
+}
@@ -0,0 +1,208 @@
+package builtins
+
+// Cheap motion detection on downscaled video, e.g. as a selector so that expensive
+// models only run on the parts of static cameras where something is moving.
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+)
+
+type MotionConfig struct {
+	// frames are downscaled to these dimensions before computing motion
+	Width int
+	Height int
+	// "diff" compares each frame to the previous frame, and "background" to a
+	// running average of the previous frames
+	Mode string
+	// for "background": weight of each new frame in the running average
+	Alpha float64
+	// a pixel is moving if its grayscale value differs by more than this (0-255)
+	PixelThreshold float64
+	// for int output: 1 if at least this fraction of the pixels are moving
+	Threshold float64
+}
+
+var DefaultMotionConfig = MotionConfig{
+	Width: 160,
+	Height: 90,
+	Mode: "diff",
+	Alpha: 0.05,
+	PixelThreshold: 25,
+	Threshold: 0.01,
+}
+
+// Returns the grayscale image downscaled to width x height by averaging the
+// pixels in each block.
+func motionGray(im vaas.Image, width int, height int) []float64 {
+	gray := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		sy := y*im.Height/height
+		ey := (y+1)*im.Height/height
+		if ey <= sy {
+			ey = sy+1
+		}
+		for x := 0; x < width; x++ {
+			sx := x*im.Width/width
+			ex := (x+1)*im.Width/width
+			if ex <= sx {
+				ex = sx+1
+			}
+			var sum float64
+			for j := sy; j < ey; j++ {
+				for i := sx; i < ex; i++ {
+					c := im.Bytes[(j*im.Width+i)*3:]
+					sum += 0.299*float64(c[0]) + 0.587*float64(c[1]) + 0.114*float64(c[2])
+				}
+			}
+			gray[y*width+x] = sum / float64((ey-sy)*(ex-sx))
+		}
+	}
+	return gray
+}
+
+// Computes motion scores frame by frame.
+type MotionDetector struct {
+	cfg MotionConfig
+	// previous frame ("diff") or running average ("background")
+	reference []float64
+}
+
+func NewMotionDetector(cfg MotionConfig) *MotionDetector {
+	return &MotionDetector{cfg: cfg}
+}
+
+// Returns the fraction of pixels that are moving in the frame.
+// The first frame has no motion, unless the reference was handed over from the
+// previous slice (see MotionState).
+func (d *MotionDetector) Score(im vaas.Image) float64 {
+	gray := motionGray(im, d.cfg.Width, d.cfg.Height)
+	if d.reference == nil {
+		d.reference = gray
+		return 0
+	}
+	moving := 0
+	for i := range gray {
+		diff := gray[i] - d.reference[i]
+		if diff > d.cfg.PixelThreshold || diff < -d.cfg.PixelThreshold {
+			moving++
+		}
+	}
+	if d.cfg.Mode == "background" {
+		for i := range gray {
+			d.reference[i] = (1-d.cfg.Alpha)*d.reference[i] + d.cfg.Alpha*gray[i]
+		}
+	} else {
+		d.reference = gray
+	}
+	return float64(moving) / float64(len(gray))
+}
+
+type Motion struct {
+	node vaas.Node
+	cfg MotionConfig
+	stats *vaas.StatsHolder
+}
+
+func NewMotion(node vaas.Node) vaas.Executor {
+	cfg := DefaultMotionConfig
+	if node.Code != "" {
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("motion node is misconfigured (width or height is 0)")}
+	}
+	if cfg.Mode != "diff" && cfg.Mode != "background" {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("motion node has invalid mode %s", cfg.Mode)}
+	}
+	if node.DataType != vaas.FloatType && node.DataType != vaas.IntType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("motion node must output float or int, but got %s", node.DataType)}
+	}
+	return Motion{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// State handed to the next slice, so that its first frame is compared to the
+// end of the previous slice instead of always having no motion.
+type MotionState struct {
+	Reference []float64
+}
+
+func (m Motion) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+// Outputs the fraction of moving pixels in each frame (float), or 1 if the
+// fraction is at least the threshold and 0 otherwise (int).
+func (m Motion) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("motion error reading parents: %v", err))
+	}
+	return m.run(parents, ctx.Slice, state, export)
+}
+
+func (m Motion) run(parents []vaas.DataReader, slice vaas.Slice, state []byte, export func([]byte)) vaas.DataBuffer {
+	if parents[0].Type() != vaas.VideoType {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("motion: expected video parent but got %s", parents[0].Type()))
+	}
+	// push-down the downscaling if possible so that we decode at low resolution
+	if vbufReader, ok := parents[0].(*vaas.VideoBufferReader); ok {
+		vbufReader.Rescale([2]int{m.cfg.Width, m.cfg.Height})
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+
+	go func() {
+		buf.SetMeta(parents[0].Freq())
+		detector := NewMotionDetector(m.cfg)
+		if state != nil {
+			var s MotionState
+			vaas.JsonUnmarshal(state, &s)
+			// the reference is only valid if the dimensions are unchanged
+			if len(s.Reference) == m.cfg.Width*m.cfg.Height {
+				detector.reference = s.Reference
+			}
+		}
+		PerFrameWithFinish(
+			parents, slice, buf, vaas.VideoType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				score := detector.Score(data.(vaas.VideoData)[0])
+				if m.node.DataType == vaas.FloatType {
+					buf.Write(vaas.FloatData{score})
+				} else if score >= m.cfg.Threshold {
+					buf.Write(vaas.IntData{1})
+				} else {
+					buf.Write(vaas.IntData{0})
+				}
+				return nil
+			},
+			func() {
+				export(vaas.JsonMarshal(MotionState{detector.reference}))
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m Motion) Close() {}
+
+func (m Motion) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["motion"] = vaas.ExecutorMeta{
+		New: NewMotion,
+		HandleRescale: true,
+		Stateful: true,
+	}
+}
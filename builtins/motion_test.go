@@ -0,0 +1,107 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"fmt"
+	"testing"
+)
+
+// Returns an 8x4 frame where the first n columns are white and the others black.
+func testMotionFrame(n int) vaas.Image {
+	im := vaas.NewImage(8, 4)
+	for i := 0; i < n; i++ {
+		for j := 0; j < 4; j++ {
+			im.SetRGB(i, j, [3]uint8{255, 255, 255})
+		}
+	}
+	return im
+}
+
+// The frames are downscaled to 4x2, so every two columns of a frame are one
+// column of four pixels.
+var testMotionConfig = MotionConfig{
+	Width: 4,
+	Height: 2,
+	Mode: "diff",
+	Alpha: 0.5,
+	PixelThreshold: 25,
+	Threshold: 0.3,
+}
+
+func TestMotionDetectorScore(t *testing.T) {
+	d := NewMotionDetector(testMotionConfig)
+	var scores []float64
+	for _, n := range []int{0, 4, 4, 6} {
+		scores = append(scores, d.Score(testMotionFrame(n)))
+	}
+	if fmt.Sprintf("%v", scores) != "[0 0.5 0 0.25]" {
+		t.Fatalf("unexpected diff scores %v", scores)
+	}
+
+	// with a running average, a change stays moving until the average is
+	// within PixelThreshold of it
+	cfg := testMotionConfig
+	cfg.Mode = "background"
+	d = NewMotionDetector(cfg)
+	scores = nil
+	for _, n := range []int{0, 4, 4, 4, 4, 4} {
+		scores = append(scores, d.Score(testMotionFrame(n)))
+	}
+	if fmt.Sprintf("%v", scores) != "[0 0.5 0.5 0.5 0.5 0]" {
+		t.Fatalf("unexpected background scores %v", scores)
+	}
+}
+
+func TestMotionAcrossSlices(t *testing.T) {
+	run := func(cfg MotionConfig, dataType vaas.DataType, frames []int, state []byte) (string, []byte) {
+		node := vaas.Node{
+			Type: "motion",
+			DataType: dataType,
+			Parents: testParents(1),
+			Code: string(vaas.JsonMarshal(cfg)),
+		}
+		rd := &testVideoReader{}
+		for _, n := range frames {
+			rd.frames = append(rd.frames, testMotionFrame(n))
+		}
+		var exported []byte
+		buf := NewMotion(node).(Motion).run([]vaas.DataReader{rd}, vaas.Slice{Start: 0, End: len(frames)}, state, func(b []byte) {
+			exported = b
+		})
+		data, err := testReadAll(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%v", data), exported
+	}
+
+	outputs, _ := run(testMotionConfig, vaas.FloatType, []int{0, 0, 4, 6}, nil)
+	if outputs != "[0 0 0.5 0.25]" {
+		t.Fatalf("unexpected float outputs %v", outputs)
+	}
+	outputs, state := run(testMotionConfig, vaas.IntType, []int{0, 0, 4, 6}, nil)
+	if outputs != "[0 0 1 0]" {
+		t.Fatalf("unexpected int outputs %v", outputs)
+	}
+	var s MotionState
+	vaas.JsonUnmarshal(state, &s)
+	if len(s.Reference) != 8 {
+		t.Fatalf("expected the last frame as the reference but got %v", s.Reference)
+	}
+
+	// the first frame of the next slice is compared to the last frame of the
+	// previous slice
+	if outputs, _ := run(testMotionConfig, vaas.IntType, []int{0, 0}, state); outputs != "[1 0]" {
+		t.Fatalf("unexpected outputs with state %v", outputs)
+	}
+	if outputs, _ := run(testMotionConfig, vaas.IntType, []int{0, 0}, nil); outputs != "[0 0]" {
+		t.Fatalf("unexpected outputs without state %v", outputs)
+	}
+	// the reference isn't used if the dimensions changed
+	cfg := testMotionConfig
+	cfg.Width = 2
+	if outputs, _ := run(cfg, vaas.IntType, []int{0, 0}, state); outputs != "[0 0]" {
+		t.Fatalf("unexpected outputs with state of other dimensions %v", outputs)
+	}
+}
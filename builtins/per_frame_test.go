@@ -0,0 +1,56 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"fmt"
+	"testing"
+)
+
+func TestPerFrameMask(t *testing.T) {
+	// 6 samples at freq=2, which are read one sample at a time
+	parent := vaas.NewSimpleBuffer(vaas.IntType)
+	go func() {
+		parent.SetMeta(2)
+		for i := 1; i <= 6; i++ {
+			parent.Write(vaas.IntData{i})
+		}
+		parent.Close()
+	}()
+
+	// one frame of each of samples 1, 3 and 5 is selected
+	mask := make([]bool, 12)
+	mask[3], mask[6], mask[11] = true, true, true
+	out := vaas.NewSimpleBuffer(vaas.StringType)
+	out.SetMeta(2)
+	var processed []int
+	finished := false
+	go PerFrameWithFinish(
+		[]vaas.DataReader{parent.Reader()}, vaas.Slice{Start: 0, End: 12}, out, vaas.IntType,
+		vaas.ReadMultipleOptions{Mask: mask},
+		func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+			x := data.(vaas.IntData)[0]
+			processed = append(processed, x)
+			buf.Write(vaas.StringData{fmt.Sprintf("%d", x)})
+			return nil
+		},
+		func() {
+			finished = true
+		},
+	)
+	data, err := testReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the other samples are skipped and have empty outputs
+	if fmt.Sprintf("%v", processed) != "[2 4 6]" {
+		t.Fatalf("expected samples [2 4 6] to be processed but got %v", processed)
+	}
+	if fmt.Sprintf("%q", data) != `["" "2" "" "4" "" "6"]` {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+	if !finished {
+		t.Fatalf("expected finish to be called")
+	}
+}
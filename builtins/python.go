@@ -3,26 +3,60 @@ package builtins
 import (
 	"../vaas"
 
-	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// If a worker crashes this many times in a row without finishing any slice,
+// we stop restarting it.
+const PythonMaxRestarts = 3
+
+// Default for the maximum time a slice can wait for the process to output
+// anything after we sent it input.
+// This applies to all nodes that run on a PythonExecutor (python, subprocess,
+// selfsupervised-tracker and simple-classifier). Python nodes can set it with
+// a line like:
+//   # timeout: 600
+const PythonSliceTimeout = 5*time.Minute
+
+const PythonTimeoutCheckInterval = 5*time.Second
+
 type pendingSlice struct {
 	slice vaas.Slice
 	parents []vaas.DataReader
 	w vaas.DataWriter
+
+	// the following are protected by pythonWorker.mu
+	// samples sent to the process and samples it output
+	sent int
+	received int
+	// whether we sent the finish packet
+	finishing bool
+	// last time we sent input or received output for the slice
+	lastProgress time.Time
 }
 
-type PythonExecutor struct {
-	query *vaas.Query
-	node vaas.Node
-	tempFile *os.File
+// Returns whether the process has input of the slice that it hasn't answered,
+// and made no progress on the slice for the timeout.
+// A slice that is only waiting for its parents doesn't time out.
+func (ps *pendingSlice) timedOut(now time.Time, timeout time.Duration) bool {
+	outstanding := ps.finishing || ps.sent > ps.received
+	return outstanding && now.Sub(ps.lastProgress) >= timeout
+}
+
+// One process of a PythonExecutor, which we talk to with the protocol in vaas/exec_protocol.go.
+// When the process crashes, the worker is replaced by a new one with a new process.
+type pythonWorker struct {
+	e *PythonExecutor
+	// index in e.workers
+	idx int
 
 	// cmd is set to nil and err to "closed" after Close call
 	cmd *vaas.Cmd
@@ -34,53 +68,80 @@ type PythonExecutor struct {
 	counter int
 
 	// error running python template
-	// this error is returned to any future Run calls
+	// once set, no more slices are dispatched to this worker
 	err error
 
+	// number of consecutive crashes of previous workers at this index
+	crashes int
+	// number of slices finished by this worker
+	finished int
+	// last time we got an output packet (or the start time)
+	lastOutput time.Time
+
 	// lock on stdin
 	writeLock sync.Mutex
 
 	// lock on internal structures (pending, err, counter, etc.)
 	mu sync.Mutex
+}
+
+// Runs slices on a pool of Python processes.
+// Each slice is dispatched to the worker with the fewest pending slices.
+// This is also used for other processes that speak the executor protocol (see subprocess.go).
+type PythonExecutor struct {
+	node vaas.Node
+	tempFile *os.File
+	newCmd func(workerIdx int) *vaas.Cmd
+	timeout time.Duration
+
+	// lock for dispatching slices to workers and replacing crashed workers
+	mu sync.Mutex
+	workers []*pythonWorker
+	closed bool
 
+	// shared by the workers so that stats reflect the throughput of the whole pool
 	stats *vaas.StatsHolder
 }
 
-func (e *PythonExecutor) writeJSONPacket(x interface{}) {
-	bytes := vaas.JsonMarshal(x)
-	buf := make([]byte, 5)
-	binary.BigEndian.PutUint32(buf[0:4], uint32(len(bytes)))
-	buf[4] = 'j'
-	e.stdin.Write(buf)
-	e.stdin.Write(bytes)
+func (w *pythonWorker) Init() {
+	w.writeLock.Lock()
+	vaas.WriteExecJSON(w.stdin, vaas.ExecHello{
+		Type: w.e.node.DataType,
+		Parents: len(w.e.node.Parents),
+		Version: vaas.ExecProtocolVersion,
+		NodeName: w.e.node.Name,
+	})
+	w.writeLock.Unlock()
 }
 
-func (e *PythonExecutor) writeVideoPacket(images []vaas.Image) {
-	buf := make([]byte, 21)
-	l := 16+len(images)*images[0].Width*images[0].Height*3
-	binary.BigEndian.PutUint32(buf[0:4], uint32(l))
-	buf[4] = 'v'
-	binary.BigEndian.PutUint32(buf[5:9], uint32(len(images)))
-	binary.BigEndian.PutUint32(buf[9:13], uint32(images[0].Height))
-	binary.BigEndian.PutUint32(buf[13:17], uint32(images[0].Width))
-	binary.BigEndian.PutUint32(buf[17:21], 3)
-	e.stdin.Write(buf)
-	for _, image := range images {
-		e.stdin.Write(image.ToBytes())
+// Add the slice to the pending slices of the worker with the fewest pending slices.
+// Returns the worker and the slice ID on that worker.
+func (e *PythonExecutor) dispatch(ps *pendingSlice) (*pythonWorker, int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var best *pythonWorker
+	var bestPending int
+	var err error
+	for _, w := range e.workers {
+		w.mu.Lock()
+		pending := len(w.pending)
+		if w.err != nil {
+			err = w.err
+		} else if best == nil || pending < bestPending {
+			best = w
+			bestPending = pending
+		}
+		w.mu.Unlock()
 	}
-}
-
-func (e *PythonExecutor) Init() {
-	// prepare meta
-	var meta struct {
-		Type vaas.DataType
-		Parents int
-	}
-	meta.Type = e.node.DataType
-	meta.Parents = len(e.node.Parents)
-	e.writeLock.Lock()
-	e.writeJSONPacket(meta)
-	e.writeLock.Unlock()
+	if best == nil {
+		return nil, 0, err
+	}
+	best.mu.Lock()
+	defer best.mu.Unlock()
+	id := best.counter
+	best.counter++
+	best.pending[id] = ps
+	return best, id, nil
 }
 
 func (e *PythonExecutor) Run(ctx vaas.ExecContext) vaas.DataBuffer {
@@ -96,169 +157,358 @@ func (e *PythonExecutor) Run(ctx vaas.ExecContext) vaas.DataBuffer {
 		w = vaas.NewSimpleBuffer(e.node.DataType)
 	}
 
+	// prepare pendingSlice
+	// we dispatch before starting the goroutine so that the next Run sees this slice as pending
+	ps := &pendingSlice{
+		slice: ctx.Slice,
+		parents: parents,
+		w: w,
+		lastProgress: time.Now(),
+	}
+	worker, id, err := e.dispatch(ps)
+	if err != nil {
+		return vaas.GetErrorBuffer(e.node.DataType, err)
+	}
+
 	go func() {
 		slice := ctx.Slice
 		freq := vaas.MinFreq(parents)
 		w.SetMeta(freq)
 
-		// prepare pendingSlice
-		e.mu.Lock()
-		if e.err != nil {
-			w.Error(e.err)
-			e.mu.Unlock()
-			return
-		}
-		id := e.counter
-		e.counter++
-		ps := &pendingSlice{slice, parents, w}
-		e.pending[id] = ps
-		e.mu.Unlock()
-
 		// write init packet
-		var initPacket struct {
-			Type string
-			ID int
-			Length int
-		}
-		initPacket.Type = "init"
-		initPacket.ID = id
-		initPacket.Length = slice.Length()
-		e.writeLock.Lock()
-		e.writeJSONPacket(initPacket)
-		e.writeLock.Unlock()
+		// errors writing to stdin mean the process exited, which ReadLoop handles
+		worker.writeLock.Lock()
+		vaas.WriteExecJSON(worker.stdin, vaas.ExecInitPacket{
+			Type: "init",
+			ID: id,
+			Length: slice.Length(),
+		})
+		worker.writeLock.Unlock()
 
 		f := func(index int, datas []vaas.Data) error {
-			var job struct {
-				Type string
-				SliceIdx int
-				Range [2]int
-			}
-			job.Type = "job"
-			job.SliceIdx = id
-			// TODO: this range is not very meaningful if freq > 1
-			job.Range = [2]int{index, index+datas[0].Length()}
-
-			e.writeLock.Lock()
-			e.writeJSONPacket(job)
+			worker.writeLock.Lock()
+			vaas.WriteExecJSON(worker.stdin, vaas.ExecJobPacket{
+				Type: "job",
+				SliceIdx: id,
+				// TODO: this range is not very meaningful if freq > 1
+				Range: [2]int{index, index+datas[0].Length()},
+			})
 			for _, data := range datas {
-				if data.Type() == vaas.VideoType {
-					vdata := data.(vaas.VideoData)
-					e.writeVideoPacket(vdata)
-				} else {
-					e.writeJSONPacket(data)
-				}
+				vaas.WriteExecData(worker.stdin, data)
 			}
-			e.writeLock.Unlock()
+			worker.writeLock.Unlock()
+			worker.mu.Lock()
+			ps.sent += datas[0].Length()
+			ps.lastProgress = time.Now()
+			worker.mu.Unlock()
 			return nil
 		}
-		// TODO: look at the return error
-		// currently we don't because w is controlled by ReadLoop
 		// TODO: stats isn't quite right here since we write directly to python stdin
 		// instead the python skyhook_pylib should keep track of stats probably
 		err := vaas.ReadMultiple(slice.Length(), freq, parents, vaas.ReadMultipleOptions{Stats: e.stats}, f)
 		if err != nil {
-			panic(fmt.Errorf("ReadMultiple error at node %s: %v", e.node.Name, err))
+			// w is controlled by ReadLoop, so we only fail it if it is still pending
+			worker.mu.Lock()
+			if worker.pending[id] == ps {
+				delete(worker.pending, id)
+				w.Error(fmt.Errorf("python error reading parents: %v", err))
+			}
+			worker.mu.Unlock()
 		}
 		// we don't close w here since ReadLoop will close it
 		// just send a finish packet
-		var finishPacket struct {
-			Type string
-			ID int
-		}
-		finishPacket.Type = "finish"
-		finishPacket.ID = id
-		e.writeLock.Lock()
-		e.writeJSONPacket(finishPacket)
-		e.writeLock.Unlock()
+		// (on error, this still lets python free the state of the slice)
+		worker.writeLock.Lock()
+		vaas.WriteExecJSON(worker.stdin, vaas.ExecFinishPacket{
+			Type: "finish",
+			ID: id,
+		})
+		worker.writeLock.Unlock()
+		worker.mu.Lock()
+		ps.finishing = true
+		ps.lastProgress = time.Now()
+		worker.mu.Unlock()
 	}()
 
 	return w.Buffer()
 }
 
-func (e *PythonExecutor) ReadLoop() {
-	t := e.node.DataType
+func (w *pythonWorker) ReadLoop() {
+	t := w.e.node.DataType
 
-	header := make([]byte, 16)
-	for {
-		_, err := io.ReadFull(e.stdout, header)
+	// if the process doesn't speak our protocol version, restarting it won't help
+	// but if it exits before replying, we handle it like other crashes
+	var protocolErr error
+	err := vaas.ReadExecHelloReply(w.stdout)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		protocolErr = err
+	}
+	for err == nil {
+		var header vaas.ExecOutputHeader
+		var buf []byte
+		header, buf, err = vaas.ReadExecOutput(w.stdout)
 		if err != nil {
 			break
 		}
-		sliceIdx := int(binary.BigEndian.Uint32(header[0:4]))
-		start := int(binary.BigEndian.Uint32(header[4:8]))
-		end := int(binary.BigEndian.Uint32(header[8:12]))
-		size := int(binary.BigEndian.Uint32(header[12:16]))
-		if size > 0 {
-			buf := make([]byte, size)
-			_, err = io.ReadFull(e.stdout, buf)
+		sliceIdx := int(header.Slice)
+		if header.IsError() {
+			// the slice may have been removed already if it timed out
+			w.mu.Lock()
+			w.lastOutput = time.Now()
+			if ps := w.pending[sliceIdx]; ps != nil {
+				ps.w.Error(fmt.Errorf("%s error:\n%s", w.e.node.Type, strings.TrimSpace(string(buf))))
+				delete(w.pending, sliceIdx)
+			}
+			w.mu.Unlock()
+		} else if header.IsFinish() {
+			w.mu.Lock()
+			w.lastOutput = time.Now()
+			if ps := w.pending[sliceIdx]; ps != nil {
+				ps.w.Close()
+				delete(w.pending, sliceIdx)
+				w.finished++
+			}
+			w.mu.Unlock()
+		} else if header.Size > 0 {
+			var data vaas.Data
+			data, err = vaas.DecodeExecData(t, buf)
 			if err != nil {
+				protocolErr = err
 				break
 			}
-			var data vaas.Data
-			if t == vaas.VideoType {
-				nframes := int(binary.BigEndian.Uint32(buf[0:4]))
-				height := int(binary.BigEndian.Uint32(buf[4:8]))
-				width := int(binary.BigEndian.Uint32(buf[8:12]))
-				// TODO: channels buf[12:16]
-				chunkSize := width*height*3
-				buf = buf[16:]
-				var vdata vaas.VideoData
-				for i := 0; i < nframes; i++ {
-					vdata = append(vdata, vaas.ImageFromBytes(width, height, buf[i*chunkSize:(i+1)*chunkSize]))
-				}
-				data = vdata
-			} else {
-				data = vaas.DecodeData(t, buf)
+			data = data.EnsureLength(int(header.End)-int(header.Start))
+
+			w.mu.Lock()
+			w.lastOutput = time.Now()
+			if ps := w.pending[sliceIdx]; ps != nil {
+				ps.w.Write(data)
+				ps.received += data.Length()
+				ps.lastProgress = w.lastOutput
 			}
-			data = data.EnsureLength(end-start)
-
-			e.mu.Lock()
-			e.pending[sliceIdx].w.Write(data)
-			e.mu.Unlock()
-		} else if start == 0 && end == 0 {
-			// finish
-			e.mu.Lock()
-			e.pending[sliceIdx].w.Close()
-			delete(e.pending, sliceIdx)
-			e.mu.Unlock()
+			w.mu.Unlock()
 		}
 	}
 
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if len(e.pending) == 0 && e.err != nil && e.err.Error() == "closed" {
+	w.mu.Lock()
+	if w.cmd == nil {
+		// closed by Close
+		for _, ps := range w.pending {
+			ps.w.Error(w.err)
+		}
+		w.pending = make(map[int]*pendingSlice)
+		w.mu.Unlock()
 		return
 	}
-	if e.cmd != nil {
-		e.err = e.cmd.Wait()
-		e.cmd = nil
+	cmd := w.cmd
+	w.cmd = nil
+	w.mu.Unlock()
+
+	if protocolErr != nil {
+		cmd.Kill()
+	}
+	err = cmd.Wait()
+	if protocolErr != nil {
+		err = fmt.Errorf("protocol error: %v", protocolErr)
+	} else if err == nil {
+		err = fmt.Errorf("cmd closed unexpectdly")
 	}
-	if e.err == nil {
-		e.err = fmt.Errorf("cmd closed unexpectdly")
+	if traceback := pythonTraceback(cmd.StderrTail()); traceback != "" {
+		err = fmt.Errorf("%v\n%s", err, traceback)
+	}
+	log.Printf("[%s (%s)] error during execution: %v", w.e.node.Type, w.e.node.Name, err)
+
+	// start the replacement before failing the pending slices, so that
+	// the failed slices can be retried on it
+	if protocolErr == nil {
+		w.e.restart(w)
 	}
-	log.Printf("[python (%s)] error during python execution: %v", e.node.Name, e.err)
-	for _, ps := range e.pending {
-		ps.w.Error(e.err)
+
+	w.mu.Lock()
+	w.err = err
+	for _, ps := range w.pending {
+		ps.w.Error(err)
 	}
+	w.pending = make(map[int]*pendingSlice)
+	w.mu.Unlock()
 }
 
-func (e *PythonExecutor) Close() {
+// Fail slices where the process didn't answer input that we sent for longer
+// than the timeout.
+// If the process also did not produce any output in that time, we assume it is
+// stuck and kill it, which makes ReadLoop restart it.
+func (w *pythonWorker) watchdog() {
+	for {
+		time.Sleep(PythonTimeoutCheckInterval)
+		w.e.mu.Lock()
+		timeout := w.e.timeout
+		w.e.mu.Unlock()
+		w.mu.Lock()
+		if w.cmd == nil || w.err != nil {
+			w.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		timedOut := false
+		for id, ps := range w.pending {
+			if !ps.timedOut(now, timeout) {
+				continue
+			}
+			ps.w.Error(fmt.Errorf("slice timed out: no output for %v", timeout))
+			delete(w.pending, id)
+			timedOut = true
+		}
+		stuck := timedOut && now.Sub(w.lastOutput) >= timeout
+		cmd := w.cmd
+		w.mu.Unlock()
+		if stuck {
+			log.Printf("[%s (%s)] worker %d produced no output for %v, killing it", w.e.node.Type, w.e.node.Name, w.idx, timeout)
+			cmd.Kill()
+		}
+	}
+}
+
+// Returns the last Python traceback in the stderr lines, if any.
+func pythonTraceback(lines []string) string {
+	for i := len(lines)-1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], "Traceback (most recent call last):") {
+			return strings.Join(lines[i:], "\n")
+		}
+	}
+	return ""
+}
+
+func (w *pythonWorker) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stdin.Close()
+	w.stdout.Close()
+	if w.cmd != nil {
+		w.cmd.Wait()
+		w.cmd = nil
+		w.err = fmt.Errorf("closed")
+	}
+}
+
+// Replace a crashed worker with a new one, unless it keeps crashing.
+func (e *PythonExecutor) restart(old *pythonWorker) {
+	old.mu.Lock()
+	crashes := old.crashes+1
+	if old.finished > 0 {
+		crashes = 1
+	}
+	old.mu.Unlock()
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	e.stdin.Close()
-	e.stdout.Close()
-	if e.cmd != nil {
-		e.cmd.Wait()
-		e.cmd = nil
-		e.err = fmt.Errorf("closed")
+	if e.closed {
+		return
+	}
+	if crashes > PythonMaxRestarts {
+		log.Printf("[%s (%s)] worker %d crashed %d times in a row, not restarting it", e.node.Type, e.node.Name, old.idx, crashes)
+		return
+	}
+	log.Printf("[%s (%s)] restarting worker %d", e.node.Type, e.node.Name, old.idx)
+	e.workers[old.idx] = e.startWorker(old.idx, crashes)
+}
+
+func (e *PythonExecutor) Close() {
+	e.mu.Lock()
+	e.closed = true
+	workers := e.workers
+	e.mu.Unlock()
+	for _, w := range workers {
+		w.Close()
 	}
 	if e.tempFile != nil {
 		os.Remove(e.tempFile.Name())
 	}
 }
 
+func (e *PythonExecutor) startWorker(idx int, crashes int) *pythonWorker {
+	cmd := e.newCmd(idx)
+	w := &pythonWorker{
+		e: e,
+		idx: idx,
+		cmd: cmd,
+		stdin: cmd.Stdin(),
+		stdout: cmd.Stdout(),
+		pending: make(map[int]*pendingSlice),
+		crashes: crashes,
+		lastOutput: time.Now(),
+	}
+	w.Init()
+	go w.ReadLoop()
+	go w.watchdog()
+	return w
+}
+
+// Start a PythonExecutor with numWorkers processes created by newCmd.
+// newCmd is called again to restart a worker if its process crashes.
+func StartPythonExecutor(node vaas.Node, numWorkers int, newCmd func(workerIdx int) *vaas.Cmd) *PythonExecutor {
+	e := &PythonExecutor{
+		node: node,
+		stats: new(vaas.StatsHolder),
+		newCmd: newCmd,
+		timeout: PythonSliceTimeout,
+	}
+	e.mu.Lock()
+	for i := 0; i < numWorkers; i++ {
+		e.workers = append(e.workers, e.startWorker(i, 0))
+	}
+	e.mu.Unlock()
+	return e
+}
+
+// Python nodes can run several processes with a line like:
+//   # workers: 4
+const PythonWorkersPrefix = "# workers:"
+
+const PythonTimeoutPrefix = "# timeout:"
+
+// Python nodes can run in their own container in a Docker image (see
+// vaas.Environment.Image) with a line like:
+//   # image: my-python-image
+const PythonImagePrefix = "# image:"
+
+func parsePythonImage(node vaas.Node) string {
+	for _, line := range strings.Split(node.Code, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, PythonImagePrefix) {
+			return strings.TrimSpace(line[len(PythonImagePrefix):])
+		}
+	}
+	return ""
+}
+
+// Returns the positive integer on the first line with the prefix, or def.
+func parsePythonOption(code string, prefix string, def int) int {
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[len(prefix):]))
+		if err != nil || n < 1 {
+			continue
+		}
+		return n
+	}
+	return def
+}
+
 func NewPythonExecutor(node vaas.Node) vaas.Executor {
-	log.Printf("[python (%s)] launching python script", node.Name)
+	python := "/usr/bin/python3"
+	if requirements := parsePythonRequirements(node.Code); len(requirements) > 0 {
+		var err error
+		python, err = getPythonVenv(requirements)
+		if err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error preparing python requirements: %v", err)}
+		}
+	}
+	numWorkers := parsePythonOption(node.Code, PythonWorkersPrefix, 1)
+	timeout := time.Duration(parsePythonOption(node.Code, PythonTimeoutPrefix, int(PythonSliceTimeout/time.Second)))*time.Second
+
+	log.Printf("[python (%s)] launching python script with %d workers", node.Name, numWorkers)
 	template, err := ioutil.ReadFile("tmpl.py")
 	if err != nil {
 		panic(err)
@@ -274,22 +524,16 @@ func NewPythonExecutor(node vaas.Node) vaas.Executor {
 	if err := tempFile.Close(); err != nil {
 		panic(err)
 	}
-	cmd := vaas.Command(
-		fmt.Sprintf("exec-python-%s", node.Name), vaas.CommandOptions{},
-		"/usr/bin/python3", tempFile.Name(),
-	)
-
-	e := &PythonExecutor{
-		node: node,
-		tempFile: tempFile,
-		cmd: cmd,
-		stdin: cmd.Stdin(),
-		stdout: cmd.Stdout(),
-		pending: make(map[int]*pendingSlice),
-		stats: new(vaas.StatsHolder),
-	}
-	e.Init()
-	go e.ReadLoop()
+	e := StartPythonExecutor(node, numWorkers, func(workerIdx int) *vaas.Cmd {
+		return vaas.Command(
+			fmt.Sprintf("exec-python-%s-%d", node.Name, workerIdx), vaas.CommandOptions{},
+			python, tempFile.Name(),
+		)
+	})
+	e.tempFile = tempFile
+	e.mu.Lock()
+	e.timeout = timeout
+	e.mu.Unlock()
 	return e
 }
 
@@ -298,5 +542,8 @@ func (m *PythonExecutor) Stats() vaas.StatsSample {
 }
 
 func init() {
-	vaas.Executors["python"] = vaas.ExecutorMeta{New: NewPythonExecutor}
+	vaas.Executors["python"] = vaas.ExecutorMeta{
+		New: NewPythonExecutor,
+		NodeImage: parsePythonImage,
+	}
 }
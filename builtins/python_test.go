@@ -0,0 +1,29 @@
+package builtins
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingSliceTimeout(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2*time.Minute)
+	tests := []struct {
+		ps pendingSlice
+		expected bool
+	}{
+		// waiting for parents, so the process has nothing to answer
+		{pendingSlice{lastProgress: old}, false},
+		{pendingSlice{sent: 10, received: 10, lastProgress: old}, false},
+		// input without outputs
+		{pendingSlice{sent: 10, received: 4, lastProgress: old}, true},
+		{pendingSlice{sent: 10, received: 10, finishing: true, lastProgress: old}, true},
+		// recent progress
+		{pendingSlice{sent: 10, received: 4, lastProgress: now.Add(-30*time.Second)}, false},
+	}
+	for i, test := range tests {
+		if test.ps.timedOut(now, time.Minute) != test.expected {
+			t.Fatalf("test %d: expected timedOut=%v", i, test.expected)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package builtins
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Python nodes can declare requirements with lines like:
+//   # require: shapely==1.7.0
+// These are installed into a virtualenv that is cached by the hash of the
+// requirements, so nodes with the same requirements share a virtualenv.
+const PythonRequirePrefix = "# require:"
+
+// Requirements are installed only from wheels in this directory (no network access).
+const PythonWheelDir = "wheels"
+
+const PythonVenvDir = "node-data/venvs"
+
+func parsePythonRequirements(code string) []string {
+	seen := make(map[string]bool)
+	var requirements []string
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, PythonRequirePrefix) {
+			continue
+		}
+		requirement := strings.TrimSpace(line[len(PythonRequirePrefix):])
+		if requirement == "" || seen[requirement] {
+			continue
+		}
+		seen[requirement] = true
+		requirements = append(requirements, requirement)
+	}
+	sort.Strings(requirements)
+	return requirements
+}
+
+// Returns the python binary of a virtualenv with the requirements, creating it if needed.
+func getPythonVenv(requirements []string) (string, error) {
+	hash := sha256.Sum256([]byte(strings.Join(requirements, "\n")))
+	dir := filepath.Join(PythonVenvDir, fmt.Sprintf("%x", hash[:8]))
+	python := filepath.Join(dir, "bin", "python3")
+	completeFname := filepath.Join(dir, ".complete")
+
+	// several containers on the machine may need the same virtualenv, so we
+	// synchronize with a lock file
+	if err := os.MkdirAll(PythonVenvDir, 0755); err != nil {
+		return "", err
+	}
+	lockFile, err := os.Create(dir + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return "", err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	if _, err := os.Stat(completeFname); err == nil {
+		return python, nil
+	}
+
+	log.Printf("[python] creating virtualenv %s for requirements %v", dir, requirements)
+	// remove any partially created virtualenv
+	os.RemoveAll(dir)
+	run := func(name string, args ...string) error {
+		output, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+			if len(lines) > 10 {
+				lines = lines[len(lines)-10:]
+			}
+			return fmt.Errorf("%v\n%s", err, strings.Join(lines, "\n"))
+		}
+		return nil
+	}
+	// we include system packages since tmpl.py needs numpy and skimage
+	// packages installed in the virtualenv take precedence over them
+	if err := run("/usr/bin/python3", "-m", "venv", "--system-site-packages", dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("error creating virtualenv: %v", err)
+	}
+	requirementsFname := filepath.Join(dir, "requirements.txt")
+	if err := ioutil.WriteFile(requirementsFname, []byte(strings.Join(requirements, "\n") + "\n"), 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := run(python, "-m", "pip", "install", "--no-index", "--find-links", PythonWheelDir, "-r", requirementsFname); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("error installing requirements from %s: %v", PythonWheelDir, err)
+	}
+	if err := ioutil.WriteFile(completeFname, nil, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return python, nil
+}
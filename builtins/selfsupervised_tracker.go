@@ -18,23 +18,13 @@ func NewSelfSupervisedTracker(node vaas.Node) vaas.Executor {
 		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
 	}
 
-	cmd := vaas.Command(
-		"selfsupervised-tracker-run", vaas.CommandOptions{},
-		"python3", "models/selfsupervised-tracker/run.py",
-		cfg.ModelPath,
-	)
-
-	e := &PythonExecutor{
-		node: node,
-		cmd: cmd,
-		stdin: cmd.Stdin(),
-		stdout: cmd.Stdout(),
-		pending: make(map[int]*pendingSlice),
-		stats: new(vaas.StatsHolder),
-	}
-	e.Init()
-	go e.ReadLoop()
-	return e
+	return StartPythonExecutor(node, 1, func(int) *vaas.Cmd {
+		return vaas.Command(
+			"selfsupervised-tracker-run", vaas.CommandOptions{},
+			"python3", "models/selfsupervised-tracker/run.py",
+			cfg.ModelPath,
+		)
+	})
 }
 
 func init() {
@@ -30,23 +30,13 @@ func NewSimpleClassifier(node vaas.Node) vaas.Executor {
 	}
 	cfg := cfgs[0]
 
-	cmd := vaas.Command(
-		"simple-classifier-run", vaas.CommandOptions{},
-		"python3", "models/simple-classifier/run.py",
-		cfg.ModelPath, strconv.Itoa(cfg.NumClasses), strconv.Itoa(cfg.InputSize[0]), strconv.Itoa(cfg.InputSize[1]),
-	)
-
-	e := &PythonExecutor{
-		node: node,
-		cmd: cmd,
-		stdin: cmd.Stdin(),
-		stdout: cmd.Stdout(),
-		pending: make(map[int]*pendingSlice),
-		stats: new(vaas.StatsHolder),
-	}
-	e.Init()
-	go e.ReadLoop()
-	return e
+	return StartPythonExecutor(node, 1, func(int) *vaas.Cmd {
+		return vaas.Command(
+			"simple-classifier-run", vaas.CommandOptions{},
+			"python3", "models/simple-classifier/run.py",
+			cfg.ModelPath, strconv.Itoa(cfg.NumClasses), strconv.Itoa(cfg.InputSize[0]), strconv.Itoa(cfg.InputSize[1]),
+		)
+	})
 }
 
 func init() {
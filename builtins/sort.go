@@ -0,0 +1,488 @@
+package builtins
+
+// SORT multi-object tracker (Bewley et al., "Simple Online and Realtime Tracking").
+// Each track has a constant-velocity Kalman filter over its box, and detections
+// are assigned to the predicted boxes with the Hungarian algorithm. Unlike the IOU
+// tracker, tracks survive a few frames of occlusion or missed detections, and the
+// output boxes are the filtered estimates rather than the raw detections.
+
+import (
+	"../vaas"
+	goslgraph "github.com/cpmech/gosl/graph"
+
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+type SORTConfig struct {
+	// frames without a matching detection before a track is deleted
+	MaxAge int `json:"maxAge"`
+	// matched detections needed before a track is output
+	MinHits int `json:"minHits"`
+	// minimum overlap between a predicted box and a detection to match them
+	IOUThreshold float64 `json:"iouThreshold"`
+	// if positive, detections below IOUThreshold can still match when their center
+	// is within this many pixels of the predicted center (helps at low sample rates)
+	MaxDistance float64 `json:"maxDistance"`
+}
+
+var DefaultSORTConfig = SORTConfig{
+	MaxAge: 5,
+	MinHits: 3,
+	IOUThreshold: 0.3,
+}
+
+// Small dense matrices for the Kalman filter.
+type kmat [][]float64
+
+func newKmat(rows int, cols int) kmat {
+	m := make(kmat, rows)
+	for i := range m {
+		m[i] = make([]float64, cols)
+	}
+	return m
+}
+
+func kmatIdentity(n int, scale float64) kmat {
+	m := newKmat(n, n)
+	for i := 0; i < n; i++ {
+		m[i][i] = scale
+	}
+	return m
+}
+
+func (a kmat) Mul(b kmat) kmat {
+	c := newKmat(len(a), len(b[0]))
+	for i := range a {
+		for j := range b[0] {
+			for k := range b {
+				c[i][j] += a[i][k]*b[k][j]
+			}
+		}
+	}
+	return c
+}
+
+func (a kmat) Add(b kmat, scale float64) kmat {
+	c := newKmat(len(a), len(a[0]))
+	for i := range a {
+		for j := range a[i] {
+			c[i][j] = a[i][j] + scale*b[i][j]
+		}
+	}
+	return c
+}
+
+func (a kmat) T() kmat {
+	c := newKmat(len(a[0]), len(a))
+	for i := range a {
+		for j := range a[i] {
+			c[j][i] = a[i][j]
+		}
+	}
+	return c
+}
+
+// Inverse by Gauss-Jordan elimination.
+// The matrices we invert are covariances, so they are invertible.
+func (a kmat) Inv() kmat {
+	n := len(a)
+	m := newKmat(n, 2*n)
+	for i := 0; i < n; i++ {
+		copy(m[i], a[i])
+		m[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for i := col+1; i < n; i++ {
+			if math.Abs(m[i][col]) > math.Abs(m[pivot][col]) {
+				pivot = i
+			}
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		p := m[col][col]
+		for j := range m[col] {
+			m[col][j] /= p
+		}
+		for i := 0; i < n; i++ {
+			if i == col || m[i][col] == 0 {
+				continue
+			}
+			f := m[i][col]
+			for j := range m[i] {
+				m[i][j] -= f*m[col][j]
+			}
+		}
+	}
+	inv := newKmat(n, n)
+	for i := 0; i < n; i++ {
+		copy(inv[i], m[i][n:])
+	}
+	return inv
+}
+
+// Kalman filter with state [cx, cy, area, aspect ratio, vx, vy, varea] and
+// measurement [cx, cy, area, aspect ratio], like in the SORT paper.
+type kalmanBox struct {
+	x kmat
+	p kmat
+}
+
+var kalmanF, kalmanH, kalmanQ, kalmanR kmat
+
+func init() {
+	kalmanF = kmatIdentity(7, 1)
+	kalmanF[0][4] = 1
+	kalmanF[1][5] = 1
+	kalmanF[2][6] = 1
+
+	kalmanH = newKmat(4, 7)
+	for i := 0; i < 4; i++ {
+		kalmanH[i][i] = 1
+	}
+
+	kalmanQ = kmatIdentity(7, 1)
+	kalmanQ[4][4] = 0.01
+	kalmanQ[5][5] = 0.01
+	kalmanQ[6][6] = 0.0001
+
+	kalmanR = kmatIdentity(4, 1)
+	kalmanR[2][2] = 10
+	kalmanR[3][3] = 10
+}
+
+func boxToMeasurement(d vaas.Detection) kmat {
+	w := float64(d.Right - d.Left)
+	h := float64(d.Bottom - d.Top)
+	if h < 1 {
+		h = 1
+	}
+	return kmat{
+		{float64(d.Left) + w/2},
+		{float64(d.Top) + h/2},
+		{w*h},
+		{w/h},
+	}
+}
+
+func newKalmanBox(d vaas.Detection) *kalmanBox {
+	z := boxToMeasurement(d)
+	k := &kalmanBox{
+		x: newKmat(7, 1),
+		// high uncertainty for the unobserved velocities
+		p: kmatIdentity(7, 10),
+	}
+	for i := 0; i < 4; i++ {
+		k.x[i][0] = z[i][0]
+	}
+	for i := 4; i < 7; i++ {
+		k.p[i][i] = 10000
+	}
+	return k
+}
+
+func (k *kalmanBox) Predict() {
+	// don't let the area become negative
+	if k.x[2][0] + k.x[6][0] <= 0 {
+		k.x[6][0] = 0
+	}
+	k.x = kalmanF.Mul(k.x)
+	k.p = kalmanF.Mul(k.p).Mul(kalmanF.T()).Add(kalmanQ, 1)
+}
+
+func (k *kalmanBox) Update(d vaas.Detection) {
+	z := boxToMeasurement(d)
+	y := z.Add(kalmanH.Mul(k.x), -1)
+	s := kalmanH.Mul(k.p).Mul(kalmanH.T()).Add(kalmanR, 1)
+	gain := k.p.Mul(kalmanH.T()).Mul(s.Inv())
+	k.x = k.x.Add(gain.Mul(y), 1)
+	k.p = kmatIdentity(7, 1).Add(gain.Mul(kalmanH), -1).Mul(k.p)
+}
+
+// Returns the current box estimate.
+func (k *kalmanBox) Box() vaas.Detection {
+	cx, cy := k.x[0][0], k.x[1][0]
+	area, ratio := math.Max(k.x[2][0], 0), math.Max(k.x[3][0], 0)
+	w := math.Sqrt(area*ratio)
+	h := 0.0
+	if w > 0 {
+		h = area/w
+	}
+	return vaas.Detection{
+		Left: int(math.Round(cx - w/2)),
+		Top: int(math.Round(cy - h/2)),
+		Right: int(math.Round(cx + w/2)),
+		Bottom: int(math.Round(cy + h/2)),
+	}
+}
+
+// Returns the detection with its box replaced by the current estimate, so that
+// the output is smoothed over noisy detections.
+func (k *kalmanBox) Filter(d vaas.Detection) vaas.Detection {
+	box := k.Box()
+	d.Left, d.Top, d.Right, d.Bottom = box.Left, box.Top, box.Right, box.Bottom
+	return d
+}
+
+type sortTrack struct {
+	id int
+	kf *kalmanBox
+	// total matched detections
+	hits int
+	// frames since the last matched detection
+	age int
+}
+
+type SORT struct {
+	node vaas.Node
+	cfg SORTConfig
+	stats *vaas.StatsHolder
+}
+
+func NewSORT(node vaas.Node) vaas.Executor {
+	cfg := DefaultSORTConfig
+	if node.Code != "" {
+		err := json.Unmarshal([]byte(node.Code), &cfg)
+		if err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	return SORT{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// Returns map from index in tracks to the index of the matching detection.
+func (m SORT) match(tracks []*sortTrack, detections []vaas.Detection) map[int]int {
+	if len(tracks) == 0 || len(detections) == 0 {
+		return nil
+	}
+
+	// cost is 1-IoU for detections that overlap enough, and 1+distance/MaxDistance
+	// for detections that are only close enough, so overlapping detections are preferred
+	const invalid = 1000
+	costMatrix := make([][]float64, len(tracks))
+	for i, track := range tracks {
+		costMatrix[i] = make([]float64, len(detections))
+		predicted := track.kf.Box()
+		predictedRect := vaas.DetectionToRectangle(predicted)
+		for j, detection := range detections {
+			rect := vaas.DetectionToRectangle(detection)
+			iou := predictedRect.IOU(rect)
+			if iou >= m.cfg.IOUThreshold && iou > 0 {
+				costMatrix[i][j] = 1 - iou
+				continue
+			}
+			costMatrix[i][j] = invalid
+			if m.cfg.MaxDistance > 0 {
+				dx := float64(predicted.Left+predicted.Right-detection.Left-detection.Right)/2
+				dy := float64(predicted.Top+predicted.Bottom-detection.Top-detection.Bottom)/2
+				distance := math.Sqrt(dx*dx+dy*dy)
+				if distance <= m.cfg.MaxDistance {
+					costMatrix[i][j] = 1 + distance/m.cfg.MaxDistance
+				}
+			}
+		}
+	}
+
+	munkres := &goslgraph.Munkres{}
+	munkres.Init(len(tracks), len(detections))
+	munkres.SetCostMatrix(costMatrix)
+	munkres.Run()
+
+	matches := make(map[int]int)
+	for i, j := range munkres.Links {
+		if j < 0 || costMatrix[i][j] >= invalid {
+			continue
+		}
+		matches[i] = j
+	}
+	return matches
+}
+
+type SORTTrackState struct {
+	ID int
+	X [][]float64
+	P [][]float64
+	Hits int
+	Age int
+}
+
+// State handed to the next slice: the active tracks continue with the same IDs.
+type SORTState struct {
+	NextID int
+	Tracks []SORTTrackState
+}
+
+func (m SORT) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+func (m SORT) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("sort error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.TrackType)
+
+	go func() {
+		buf.SetMeta(parents[0].Freq())
+
+		var nextID int = 1
+		var tracks []*sortTrack
+		if state != nil {
+			var s SORTState
+			vaas.JsonUnmarshal(state, &s)
+			nextID = s.NextID
+			for _, t := range s.Tracks {
+				tracks = append(tracks, &sortTrack{
+					id: t.ID,
+					kf: &kalmanBox{x: t.X, p: t.P},
+					hits: t.Hits,
+					age: t.Age,
+				})
+			}
+		}
+		// tracks at the start of the segment are output right away, but tracks
+		// continuing from the previous slice were already confirmed there
+		outputEarly := func(idx int) bool {
+			return state == nil && idx < m.cfg.MinHits
+		}
+		PerFrameWithFinish(
+			parents, ctx.Slice, buf, vaas.DetectionType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				df := data.(vaas.DetectionData).D[0]
+				detections := df.Detections
+
+				for _, track := range tracks {
+					track.kf.Predict()
+					track.age++
+				}
+
+				matches := m.match(tracks, detections)
+				matched := make(map[int]bool)
+				out := []vaas.Detection{}
+				for trackIdx, detectionIdx := range matches {
+					track := tracks[trackIdx]
+					detection := detections[detectionIdx]
+					matched[detectionIdx] = true
+					track.kf.Update(detection)
+					track.hits++
+					track.age = 0
+					// like SORT, tracks are output once they are confirmed, except
+					// at the start (see outputEarly)
+					if track.hits >= m.cfg.MinHits || outputEarly(idx) {
+						detection = track.kf.Filter(detection)
+						detection.TrackID = track.id
+						out = append(out, detection)
+					}
+				}
+				for detectionIdx, detection := range detections {
+					if matched[detectionIdx] {
+						continue
+					}
+					track := &sortTrack{
+						id: nextID,
+						kf: newKalmanBox(detection),
+						hits: 1,
+					}
+					nextID++
+					tracks = append(tracks, track)
+					if track.hits >= m.cfg.MinHits || outputEarly(idx) {
+						detection.TrackID = track.id
+						out = append(out, detection)
+					}
+				}
+
+				var alive []*sortTrack
+				for _, track := range tracks {
+					if track.age <= m.cfg.MaxAge {
+						alive = append(alive, track)
+					}
+				}
+				tracks = alive
+
+				buf.Write(vaas.DetectionData{
+					T: vaas.TrackType,
+					D: []vaas.DetectionFrame{{
+						Detections: out,
+						CanvasDims: df.CanvasDims,
+					}},
+				})
+				return nil
+			},
+			func() {
+				s := SORTState{NextID: nextID}
+				for _, track := range tracks {
+					s.Tracks = append(s.Tracks, SORTTrackState{
+						ID: track.id,
+						X: track.kf.x,
+						P: track.kf.p,
+						Hits: track.hits,
+						Age: track.age,
+					})
+				}
+				export(vaas.JsonMarshal(s))
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m SORT) Close() {}
+
+func (m SORT) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["sort"] = vaas.ExecutorMeta{
+		New: NewSORT,
+		Stateful: true,
+		// vary one parameter at a time around the current configuration
+		Tune: func(node vaas.Node, gtlist []vaas.Data) [][2]string {
+			cfg := DefaultSORTConfig
+			if node.Code != "" {
+				vaas.JsonUnmarshal([]byte(node.Code), &cfg)
+			}
+			var candidates []SORTConfig
+			for _, maxAge := range []int{1, 5, 10, 30} {
+				cp := cfg
+				cp.MaxAge = maxAge
+				candidates = append(candidates, cp)
+			}
+			for _, minHits := range []int{1, 3, 5} {
+				cp := cfg
+				cp.MinHits = minHits
+				candidates = append(candidates, cp)
+			}
+			for _, threshold := range []float64{0.1, 0.3, 0.5} {
+				cp := cfg
+				cp.IOUThreshold = threshold
+				candidates = append(candidates, cp)
+			}
+			for _, distance := range []float64{0, 50, 100} {
+				cp := cfg
+				cp.MaxDistance = distance
+				candidates = append(candidates, cp)
+			}
+
+			seen := make(map[SORTConfig]bool)
+			var cfgs [][2]string
+			for _, cp := range candidates {
+				if seen[cp] {
+					continue
+				}
+				seen[cp] = true
+				desc := fmt.Sprintf("maxAge=%d minHits=%d iou=%.1f distance=%v", cp.MaxAge, cp.MinHits, cp.IOUThreshold, cp.MaxDistance)
+				cfgs = append(cfgs, [2]string{string(vaas.JsonMarshal(cp)), desc})
+			}
+			return cfgs
+		},
+	}
+}
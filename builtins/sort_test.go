@@ -0,0 +1,120 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"math"
+	"testing"
+)
+
+func TestKmatInv(t *testing.T) {
+	a := kmat{
+		{0, 2, 1},
+		{4, 7, 2},
+		{3, 6, 5},
+	}
+	product := a.Mul(a.Inv())
+	for i := range product {
+		for j := range product[i] {
+			expected := 0.0
+			if i == j {
+				expected = 1
+			}
+			if math.Abs(product[i][j] - expected) > 1e-9 {
+				t.Fatalf("expected identity but got %v", product)
+			}
+		}
+	}
+}
+
+func TestSORTMatch(t *testing.T) {
+	m := NewSORT(vaas.Node{Type: "sort", DataType: vaas.TrackType}).(SORT)
+	boxA := vaas.Detection{Left: 0, Top: 0, Right: 20, Bottom: 20}
+	boxB := vaas.Detection{Left: 100, Top: 0, Right: 120, Bottom: 20}
+	tracks := []*sortTrack{
+		{id: 1, kf: newKalmanBox(boxA)},
+		{id: 2, kf: newKalmanBox(boxB)},
+	}
+	// detections in the other order, plus one that overlaps neither track
+	detections := []vaas.Detection{
+		{Left: 102, Top: 0, Right: 122, Bottom: 20},
+		{Left: 2, Top: 1, Right: 22, Bottom: 21},
+		{Left: 300, Top: 300, Right: 320, Bottom: 320},
+	}
+	matches := m.match(tracks, detections)
+	if len(matches) != 2 || matches[0] != 1 || matches[1] != 0 {
+		t.Fatalf("expected tracks matched to detections 1 and 0 but got %v", matches)
+	}
+}
+
+// Two objects move right at 4 pixels per frame, with noise on the first one,
+// and the second one is missed for two frames.
+func testSORTDetections(frames int) vaas.DetectionData {
+	data := vaas.DetectionData{T: vaas.DetectionType}
+	for i := 0; i < frames; i++ {
+		noise := 3
+		if i%2 == 1 {
+			noise = -3
+		}
+		detections := []vaas.Detection{{Left: 4*i+noise, Top: 0, Right: 4*i+noise+40, Bottom: 40}}
+		if i != 8 && i != 9 {
+			detections = append(detections, vaas.Detection{Left: 4*i, Top: 200, Right: 4*i+40, Bottom: 240})
+		}
+		data.D = append(data.D, vaas.DetectionFrame{
+			Detections: detections,
+			CanvasDims: [2]int{640, 480},
+		})
+	}
+	return data
+}
+
+func TestSORTTracking(t *testing.T) {
+	node := vaas.Node{
+		Type: "sort",
+		DataType: vaas.TrackType,
+		Parents: testParents(1),
+	}
+	e := NewSORT(node)
+	detections := testSORTDetections(40)
+
+	// run on two contiguous slices, so the tracks continue through the state
+	var outputs []vaas.DetectionFrame
+	var state []byte
+	for _, slice := range []vaas.Slice{{Start: 0, End: 20}, {Start: 20, End: 40}} {
+		var data vaas.Data
+		data, state = testRunExecutor(t, e, slice, 1, state, detections.Slice(slice.Start, slice.End))
+		outputs = append(outputs, data.(vaas.DetectionData).D...)
+	}
+	if len(outputs) != 40 {
+		t.Fatalf("expected 40 frames but got %d", len(outputs))
+	}
+
+	var noisyError, filteredError float64
+	for i, df := range outputs {
+		expected := 2
+		if i == 8 || i == 9 {
+			expected = 1
+		}
+		if len(df.Detections) != expected {
+			t.Fatalf("expected %d tracks on frame %d but got %v", expected, i, df.Detections)
+		}
+		for _, d := range df.Detections {
+			// the first object is at the top of the frame
+			expectedID := 1
+			if d.Top > 100 {
+				expectedID = 2
+			}
+			if d.TrackID != expectedID {
+				t.Fatalf("expected track %d on frame %d but got %v", expectedID, i, d)
+			}
+			if expectedID == 1 && i >= 10 {
+				noisyError += math.Abs(float64(detections.D[i].Detections[0].Left - 4*i))
+				filteredError += math.Abs(float64(d.Left - 4*i))
+			}
+		}
+	}
+	// the output should be the filtered box, which is closer to the true box than the noisy detection
+	if filteredError >= noisyError/2 {
+		t.Fatalf("expected filtered boxes to reduce the error %v but got %v", noisyError, filteredError)
+	}
+}
@@ -0,0 +1,319 @@
+package builtins
+
+// Speed, heading and distance travelled of tracks, measured on the ground plane
+// using the calibration of the timeline (see vaas.Calibration).
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Motion of a track at one of its detections.
+type TrackMotion struct {
+	// km/h
+	Speed float64
+	// degrees from the ground x axis towards the y axis, in [0, 360)
+	Heading float64
+	// metres travelled since the first detection of the track
+	Distance float64
+}
+
+// Computes the motion of a track at each of its detections.
+// Speed and heading are computed over a window of about window samples centered
+// on each detection, which reduces noise from jittery boxes.
+// frameSeconds is the duration of one sample (including the sampling frequency).
+func ComputeTrackMotion(track []vaas.DetectionWithFrame, calib vaas.Calibration, canvasDims [2]int, frameSeconds float64, window int) []TrackMotion {
+	points := make([][2]float64, len(track))
+	for i, d := range track {
+		u, v := calib.DetectionToGround(d.Detection, canvasDims)
+		points[i] = [2]float64{u, v}
+	}
+	radius := window/2
+	if radius < 1 {
+		radius = 1
+	}
+
+	motion := make([]TrackMotion, len(track))
+	for i := range track {
+		if i > 0 {
+			motion[i].Distance = motion[i-1].Distance + math.Hypot(points[i][0]-points[i-1][0], points[i][1]-points[i-1][1])
+		}
+	}
+	for i := range track {
+		// use the detections closest to radius samples before and after this one
+		a, b := i, i
+		for a > 0 && track[i].FrameIdx - track[a-1].FrameIdx <= radius {
+			a--
+		}
+		for b < len(track)-1 && track[b+1].FrameIdx - track[i].FrameIdx <= radius {
+			b++
+		}
+		if a == b {
+			continue
+		}
+		dt := float64(track[b].FrameIdx - track[a].FrameIdx) * frameSeconds
+		dx := points[b][0] - points[a][0]
+		dy := points[b][1] - points[a][1]
+		motion[i].Speed = math.Hypot(dx, dy) / dt * 3.6
+		motion[i].Heading = math.Mod(math.Atan2(dy, dx)*180/math.Pi + 360, 360)
+	}
+	return motion
+}
+
+// Returns the duration of one sample of the slice's data.
+func sampleSeconds(slice vaas.Slice, freq int) float64 {
+	fps := slice.Segment.FPS
+	if fps <= 0 {
+		fps = float64(vaas.FPS)
+	}
+	return float64(freq) / fps
+}
+
+// Reads all of the tracks in the slice from the parent.
+func readSliceTracks(ctx vaas.ExecContext, parent vaas.DataReader) (vaas.DetectionData, error) {
+	data, err := parent.Read(ctx.Slice.Length())
+	if err != nil {
+		return vaas.DetectionData{}, err
+	}
+	parent.Close()
+	return data.(vaas.DetectionData), nil
+}
+
+type TrackSpeedConfig struct {
+	// "speed", "heading", or "distance"
+	Metric string
+	// window, in frames, over which speed and heading are computed
+	Window int
+	// "max", "min", or "mean" over the tracks in each frame
+	Aggregate string
+}
+
+type TrackSpeed struct {
+	node vaas.Node
+	cfg TrackSpeedConfig
+	stats *vaas.StatsHolder
+}
+
+func NewTrackSpeed(node vaas.Node) vaas.Executor {
+	cfg := TrackSpeedConfig{
+		Metric: "speed",
+		Window: 10,
+		Aggregate: "max",
+	}
+	if node.Code != "" {
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	if cfg.Metric != "speed" && cfg.Metric != "heading" && cfg.Metric != "distance" {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("track-speed node has invalid metric %s", cfg.Metric)}
+	}
+	// the metric isn't stored in the tracks since the detection Score is the
+	// detector confidence, which downstream nodes may filter on
+	if node.DataType != vaas.FloatType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("track-speed node must output float, but got %s", node.DataType)}
+	}
+	return TrackSpeed{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+func (m TrackSpeed) value(motion TrackMotion) float64 {
+	if m.cfg.Metric == "heading" {
+		return motion.Heading
+	} else if m.cfg.Metric == "distance" {
+		return motion.Distance
+	}
+	return motion.Speed
+}
+
+// Outputs the metric aggregated over the tracks in each frame (0 if there are none).
+func (m TrackSpeed) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	if ctx.Calibration == nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("track-speed: timeline is not calibrated"))
+	}
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("track-speed error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+
+	go func() {
+		t0 := time.Now()
+		freq := parents[0].Freq()
+		buf.SetMeta(freq)
+		data, err := readSliceTracks(ctx, parents[0])
+		if err != nil {
+			buf.Error(fmt.Errorf("track-speed error reading parent: %v", err))
+			return
+		}
+
+		t1 := time.Now()
+		window := (m.cfg.Window + freq-1) / freq
+		values := make([][]float64, data.Length())
+		for _, track := range vaas.DetectionsToTracks(data.D) {
+			canvasDims := data.D[track[0].FrameIdx].CanvasDims
+			motion := ComputeTrackMotion(track, *ctx.Calibration, canvasDims, sampleSeconds(ctx.Slice, freq), window)
+			for i, d := range track {
+				values[d.FrameIdx] = append(values[d.FrameIdx], m.value(motion[i]))
+			}
+		}
+		out := make(vaas.FloatData, data.Length())
+		for i, l := range values {
+			out[i] = aggregateFloats(l, m.cfg.Aggregate)
+		}
+		buf.Write(out)
+		buf.Close()
+
+		t2 := time.Now()
+		sample := vaas.StatsSample{}
+		sample.Idle.Fraction = float64(t1.Sub(t0)) / float64(t2.Sub(t0))
+		sample.Idle.Count = ctx.Slice.Length()
+		m.stats.Add(sample)
+	}()
+
+	return buf
+}
+
+func aggregateFloats(l []float64, mode string) float64 {
+	if len(l) == 0 {
+		return 0
+	}
+	out := l[0]
+	for _, x := range l[1:] {
+		if mode == "min" {
+			out = math.Min(out, x)
+		} else if mode == "mean" {
+			out += x
+		} else {
+			out = math.Max(out, x)
+		}
+	}
+	if mode == "mean" {
+		out /= float64(len(l))
+	}
+	return out
+}
+
+func (m TrackSpeed) Close() {}
+
+func (m TrackSpeed) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+type SpeedFilterConfig struct {
+	// km/h; tracks must be at least MinSpeed and at most MaxSpeed (if positive)
+	MinSpeed float64
+	MaxSpeed float64
+	// "max" to compare the fastest speed of the track over any window, or "mean"
+	// to compare its average speed over its whole duration
+	Mode string
+	// window, in frames, over which speed is computed for "max"
+	Window int
+}
+
+type SpeedFilter struct {
+	node vaas.Node
+	cfg SpeedFilterConfig
+	stats *vaas.StatsHolder
+}
+
+func NewSpeedFilter(node vaas.Node) vaas.Executor {
+	cfg := SpeedFilterConfig{
+		Mode: "max",
+		Window: 10,
+	}
+	if node.Code != "" {
+		if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	return SpeedFilter{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+func (m SpeedFilter) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	if ctx.Calibration == nil {
+		return vaas.GetErrorBuffer(vaas.TrackType, fmt.Errorf("filter-speed: timeline is not calibrated"))
+	}
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(vaas.TrackType, fmt.Errorf("filter-speed error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.TrackType)
+
+	go func() {
+		t0 := time.Now()
+		freq := parents[0].Freq()
+		buf.SetMeta(freq)
+		data, err := readSliceTracks(ctx, parents[0])
+		if err != nil {
+			buf.Error(fmt.Errorf("filter-speed error reading parent: %v", err))
+			return
+		}
+
+		t1 := time.Now()
+		window := (m.cfg.Window + freq-1) / freq
+		frameSeconds := sampleSeconds(ctx.Slice, freq)
+		var out [][]vaas.DetectionWithFrame
+		for _, track := range vaas.DetectionsToTracks(data.D) {
+			if len(track) < 2 {
+				continue
+			}
+			canvasDims := data.D[track[0].FrameIdx].CanvasDims
+			motion := ComputeTrackMotion(track, *ctx.Calibration, canvasDims, frameSeconds, window)
+			var speed float64
+			if m.cfg.Mode == "mean" {
+				duration := float64(track[len(track)-1].FrameIdx - track[0].FrameIdx) * frameSeconds
+				speed = motion[len(motion)-1].Distance / duration * 3.6
+			} else {
+				for _, x := range motion {
+					speed = math.Max(speed, x.Speed)
+				}
+			}
+			if speed < m.cfg.MinSpeed || (m.cfg.MaxSpeed > 0 && speed > m.cfg.MaxSpeed) {
+				continue
+			}
+			out = append(out, track)
+		}
+
+		detections := vaas.TracksToDetections(out)
+		ndata := vaas.DetectionData{T: vaas.TrackType}
+		for i := 0; i < len(data.D) && i < len(detections); i++ {
+			ndata.D = append(ndata.D, vaas.DetectionFrame{
+				Detections: detections[i],
+				CanvasDims: data.D[i].CanvasDims,
+			})
+		}
+		buf.Write(ndata.EnsureLength(data.Length()))
+		buf.Close()
+
+		t2 := time.Now()
+		sample := vaas.StatsSample{}
+		sample.Idle.Fraction = float64(t1.Sub(t0)) / float64(t2.Sub(t0))
+		sample.Idle.Count = ctx.Slice.Length()
+		m.stats.Add(sample)
+	}()
+
+	return buf
+}
+
+func (m SpeedFilter) Close() {}
+
+func (m SpeedFilter) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["track-speed"] = vaas.ExecutorMeta{New: NewTrackSpeed}
+	vaas.Executors["filter-speed"] = vaas.ExecutorMeta{New: NewSpeedFilter}
+}
@@ -0,0 +1,70 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// Runs an arbitrary executable (C++, Rust, a shell script, ...) that speaks the
+// executor protocol documented in vaas/exec_protocol.go.
+type SubprocessConfig struct {
+	// executable to run, either in the PATH or relative to the container's working directory
+	Command string
+	Args []string
+	// number of processes to run (default 1)
+	Workers int
+	// seconds that a slice can wait for outputs after sending input before it
+	// fails (default PythonSliceTimeout)
+	Timeout int
+	// optional Docker image to run the node in its own container (see vaas.Environment.Image)
+	Image string
+}
+
+func NewSubprocessExecutor(node vaas.Node) vaas.Executor {
+	var cfg SubprocessConfig
+	err := json.Unmarshal([]byte(node.Code), &cfg)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+	}
+	if cfg.Command == "" {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("subprocess node is not configured (no command)")}
+	}
+	// vaas.Command panics if the executable doesn't exist, so check it here
+	command, err := exec.LookPath(cfg.Command)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("subprocess command %s not found: %v", cfg.Command, err)}
+	}
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+
+	log.Printf("[subprocess (%s)] launching %s with %d workers", node.Name, command, cfg.Workers)
+	e := StartPythonExecutor(node, cfg.Workers, func(workerIdx int) *vaas.Cmd {
+		return vaas.Command(
+			fmt.Sprintf("exec-subprocess-%s-%d", node.Name, workerIdx), vaas.CommandOptions{},
+			command, cfg.Args...,
+		)
+	})
+	if cfg.Timeout > 0 {
+		e.mu.Lock()
+		e.timeout = time.Duration(cfg.Timeout)*time.Second
+		e.mu.Unlock()
+	}
+	return e
+}
+
+func init() {
+	vaas.Executors["subprocess"] = vaas.ExecutorMeta{
+		New: NewSubprocessExecutor,
+		NodeImage: func(node vaas.Node) string {
+			var cfg SubprocessConfig
+			json.Unmarshal([]byte(node.Code), &cfg)
+			return cfg.Image
+		},
+	}
+}
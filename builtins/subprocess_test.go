@@ -0,0 +1,206 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// When this environment variable is set, the test binary runs referenceProcess
+// instead of the tests, so that the subprocess executor can run it.
+const referenceProcessEnv = "VAAS_TEST_REFERENCE_PROCESS"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(referenceProcessEnv); mode != "" {
+		referenceProcess(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Reference implementation of the process side of the executor protocol.
+// It outputs its int parent multiplied by two, and fails slices with negative values.
+// With mode "old-version", it replies to the handshake with the wrong version.
+func referenceProcess(mode string) {
+	stdin := os.Stdin
+	stdout := os.Stdout
+
+	_, payload, err := vaas.ReadExecPacket(stdin)
+	if err != nil {
+		panic(err)
+	}
+	var hello vaas.ExecHello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		panic(err)
+	}
+	reply := vaas.ExecHelloReply{Version: vaas.ExecProtocolVersion}
+	if mode == "old-version" {
+		reply.Version = vaas.ExecProtocolVersion-1
+	}
+	vaas.WriteExecOutput(stdout, vaas.ExecOutputHeader{Slice: vaas.ExecControlSlice}, vaas.JsonMarshal(reply))
+	if reply.Version != hello.Version {
+		return
+	}
+
+	failed := make(map[int]bool)
+	for {
+		_, payload, err := vaas.ReadExecPacket(stdin)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		var packet struct {
+			Type string
+			ID int
+			SliceIdx int
+			Range [2]int
+		}
+		if err := json.Unmarshal(payload, &packet); err != nil {
+			panic(err)
+		}
+		if packet.Type == "job" {
+			var inputs []vaas.Data
+			for i := 0; i < hello.Parents; i++ {
+				_, payload, err := vaas.ReadExecPacket(stdin)
+				if err != nil {
+					panic(err)
+				}
+				inputs = append(inputs, vaas.DecodeData(vaas.IntType, payload))
+			}
+			if failed[packet.SliceIdx] {
+				continue
+			}
+			var outputs vaas.IntData
+			for _, x := range inputs[0].(vaas.IntData) {
+				if x < 0 {
+					failed[packet.SliceIdx] = true
+					break
+				}
+				outputs = append(outputs, 2*x)
+			}
+			if failed[packet.SliceIdx] {
+				header := vaas.ExecOutputHeader{uint32(packet.SliceIdx), vaas.ExecErrorMarker, vaas.ExecErrorMarker, 0}
+				vaas.WriteExecOutput(stdout, header, []byte("negative input"))
+				continue
+			}
+			vaas.WriteExecOutputData(stdout, packet.SliceIdx, packet.Range[0], packet.Range[1], outputs)
+		} else if packet.Type == "finish" {
+			if failed[packet.ID] {
+				delete(failed, packet.ID)
+				continue
+			}
+			vaas.WriteExecOutput(stdout, vaas.ExecOutputHeader{Slice: uint32(packet.ID)}, nil)
+		}
+	}
+}
+
+func TestSubprocessExecutor(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parent is loaded from items/ in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "vaas-subprocess-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir("items", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(mode string, inputs vaas.IntData) (vaas.Data, error) {
+		os.Setenv(referenceProcessEnv, mode)
+		defer os.Unsetenv(referenceProcessEnv)
+
+		slice := vaas.Slice{Start: 0, End: len(inputs)}
+		item := vaas.Item{
+			ID: 1,
+			Slice: slice,
+			Series: vaas.Series{ID: 1, DataType: vaas.IntType},
+			Format: "json",
+			Freq: 1,
+		}
+		item.UpdateData(inputs)
+
+		node := vaas.Node{
+			Name: "test",
+			Type: "subprocess",
+			DataType: vaas.IntType,
+			Parents: []vaas.Parent{{Type: vaas.SeriesParent, SeriesIdx: 0}},
+			Code: string(vaas.JsonMarshal(SubprocessConfig{
+				Command: exe,
+				Args: []string{"-test.run=^$"},
+			})),
+		}
+		e := NewSubprocessExecutor(node)
+		defer e.Close()
+		rd := e.Run(vaas.ExecContext{
+			Node: node,
+			Slice: slice,
+			Inputs: []vaas.Item{item},
+		}).Reader()
+		defer rd.Close()
+		outputs := vaas.NewData(vaas.IntType)
+		for {
+			data, err := rd.Read(len(inputs))
+			if err == io.EOF {
+				return outputs, nil
+			} else if err != nil {
+				return nil, err
+			}
+			outputs = outputs.Append(data)
+		}
+	}
+
+	outputs, err := run("ok", vaas.IntData{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", outputs) != "[2 4 6]" {
+		t.Fatalf("expected [2 4 6] but got %v", outputs)
+	}
+
+	_, err = run("ok", vaas.IntData{1, -2, 3})
+	if err == nil || !strings.Contains(err.Error(), "negative input") {
+		t.Fatalf("expected error from the slice but got %v", err)
+	}
+
+	_, err = run("old-version", vaas.IntData{1, 2, 3})
+	if err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Fatalf("expected protocol error but got %v", err)
+	}
+}
+
+func TestNodeImageEnvironment(t *testing.T) {
+	node := vaas.Node{ID: 5, Type: "subprocess", Code: `{"Command": "true"}`}
+	if env := vaas.NodeEnvironment(node); env != nil {
+		t.Fatalf("expected default container but got %v", env)
+	}
+	node.Code = `{"Command": "true", "Image": "my-image"}`
+	env := vaas.NodeEnvironment(node)
+	if env == nil || env.Image != "my-image" || env.RefID != 5 {
+		t.Fatalf("expected own container with image my-image but got %v", env)
+	}
+
+	node = vaas.Node{ID: 6, Type: "python", Code: "# image: other-image\ndef f(x):\n\treturn x\n"}
+	env = vaas.NodeEnvironment(node)
+	if env == nil || env.Image != "other-image" || env.RefID != 6 {
+		t.Fatalf("expected own container with image other-image but got %v", env)
+	}
+}
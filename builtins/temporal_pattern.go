@@ -0,0 +1,352 @@
+package builtins
+
+// Matches ordered sequences of per-frame predicates, e.g. "a person enters zone A,
+// then within 10 seconds a car enters zone B". Each step of the pattern is an
+// expression over the node's parents (see expr.go).
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type PatternStep struct {
+	Name string
+	// predicate over the parents, see expr.go
+	Expr string
+	// only match on the frame where the predicate becomes true, e.g. when an
+	// object enters a zone rather than on every frame that it is in the zone
+	Rising bool
+	// for steps after the first: the step must match within this many seconds
+	// after the previous step (0 for no limit)
+	Within float64
+}
+
+type TemporalPatternConfig struct {
+	Steps []PatternStep
+}
+
+// A complete match of the pattern.
+// Frames are sample indices in the slice, and negative for steps that matched in
+// the previous slice.
+type PatternMatch struct {
+	// the frame where each step matched
+	Frames []int
+}
+
+func (match PatternMatch) Start() int {
+	return match.Frames[0]
+}
+
+func (match PatternMatch) End() int {
+	return match.Frames[len(match.Frames)-1]
+}
+
+// Incrementally matches a pattern, one frame at a time.
+// Each step matches on a later frame than the previous step. When several
+// partial matches reach the same step, only the one whose last step matched
+// most recently is kept, since it can satisfy every time constraint that the
+// others can.
+type PatternMatcher struct {
+	steps []PatternStep
+	// maximum number of frames between each step and the previous step, or 0
+	within []int
+	// partial[k] is the partial match that is waiting for step k, if any
+	partial []*PatternMatch
+	// predicate values on the previous frame, for rising edges
+	prev []bool
+}
+
+// frameSeconds is the duration of one frame (including the sampling frequency).
+func NewPatternMatcher(steps []PatternStep, frameSeconds float64) *PatternMatcher {
+	m := &PatternMatcher{
+		steps: steps,
+		within: make([]int, len(steps)),
+		partial: make([]*PatternMatch, len(steps)),
+		prev: make([]bool, len(steps)),
+	}
+	for i, step := range steps {
+		if step.Within > 0 {
+			m.within[i] = int(step.Within/frameSeconds + 0.5)
+			if m.within[i] < 1 {
+				m.within[i] = 1
+			}
+		}
+	}
+	return m
+}
+
+// Processes the predicate values of each step on the next frame, and returns
+// the matches that completed on this frame.
+func (m *PatternMatcher) Step(idx int, values []bool) []PatternMatch {
+	fired := make([]bool, len(m.steps))
+	for k, value := range values {
+		fired[k] = value && (!m.steps[k].Rising || !m.prev[k])
+		m.prev[k] = value
+	}
+
+	var matches []PatternMatch
+	// go through later steps first so that a partial match advances at most once per frame
+	for k := len(m.steps)-1; k >= 1; k-- {
+		p := m.partial[k]
+		if p == nil {
+			continue
+		}
+		if m.within[k] > 0 && idx - p.End() > m.within[k] {
+			m.partial[k] = nil
+			continue
+		}
+		if !fired[k] {
+			continue
+		}
+		m.partial[k] = nil
+		advanced := PatternMatch{Frames: append(append([]int{}, p.Frames...), idx)}
+		if k == len(m.steps)-1 {
+			matches = append(matches, advanced)
+		} else {
+			m.partial[k+1] = &advanced
+		}
+	}
+	if fired[0] {
+		match := PatternMatch{Frames: []int{idx}}
+		if len(m.steps) == 1 {
+			matches = append(matches, match)
+		} else {
+			m.partial[1] = &match
+		}
+	}
+	return matches
+}
+
+// State of a PatternMatcher, with frames relative to the start of the next slice.
+type PatternMatcherState struct {
+	Partial []*PatternMatch
+	Prev []bool
+}
+
+// Returns the state after numFrames frames, relative to the start of the next slice.
+func (m *PatternMatcher) Export(numFrames int) PatternMatcherState {
+	state := PatternMatcherState{Prev: m.prev}
+	for _, p := range m.partial {
+		if p == nil {
+			state.Partial = append(state.Partial, nil)
+			continue
+		}
+		shifted := PatternMatch{}
+		for _, frame := range p.Frames {
+			shifted.Frames = append(shifted.Frames, frame - numFrames)
+		}
+		state.Partial = append(state.Partial, &shifted)
+	}
+	return state
+}
+
+func (m *PatternMatcher) Import(state PatternMatcherState) {
+	if len(state.Partial) != len(m.steps) || len(state.Prev) != len(m.steps) {
+		// the steps changed
+		return
+	}
+	m.partial = state.Partial
+	m.prev = state.Prev
+}
+
+// Returns the earliest start frame of the partial matches, and false if there are none.
+// Output before this frame is final.
+func (m *PatternMatcher) EarliestPending() (int, bool) {
+	var earliest int
+	ok := false
+	for _, p := range m.partial {
+		if p != nil && (!ok || p.Start() < earliest) {
+			earliest = p.Start()
+			ok = true
+		}
+	}
+	return earliest, ok
+}
+
+type TemporalPattern struct {
+	node vaas.Node
+	cfg TemporalPatternConfig
+	exprs []*Expr
+	stats *vaas.StatsHolder
+}
+
+func NewTemporalPattern(node vaas.Node) vaas.Executor {
+	var cfg TemporalPatternConfig
+	if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+	}
+	if node.DataType != vaas.IntType && node.DataType != vaas.TextType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("temporal-pattern node must output int or text, but got %s", node.DataType)}
+	}
+	if len(cfg.Steps) == 0 {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("temporal-pattern node has no steps")}
+	}
+	exprs := make([]*Expr, len(cfg.Steps))
+	for i, step := range cfg.Steps {
+		if cfg.Steps[i].Name == "" {
+			cfg.Steps[i].Name = fmt.Sprintf("step%d", i+1)
+		}
+		var err error
+		exprs[i], err = ParseExpr(step.Expr, len(node.Parents))
+		if err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error parsing expression of %s: %v", cfg.Steps[i].Name, err)}
+		}
+	}
+	return TemporalPattern{
+		node: node,
+		cfg: cfg,
+		exprs: exprs,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// Describes a match, e.g. "person_in_a -> car_in_b (+4.2s)".
+func (m TemporalPattern) describe(match PatternMatch, frameSeconds float64) string {
+	var parts []string
+	for i, frame := range match.Frames {
+		if i == 0 {
+			parts = append(parts, m.cfg.Steps[i].Name)
+		} else {
+			seconds := float64(frame - match.Frames[i-1]) * frameSeconds
+			parts = append(parts, fmt.Sprintf("%s (+%.1fs)", m.cfg.Steps[i].Name, seconds))
+		}
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// State handed to the next slice: partial matches, and the history of the
+// windowed functions of each step.
+type TemporalPatternState struct {
+	Matcher PatternMatcherState
+	History [][][]float64
+}
+
+func (m TemporalPattern) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	return m.RunWithState(ctx, nil, func([]byte) {})
+}
+
+// Outputs, on every frame from the first to the last step of each match, 1 (int)
+// or a description of the match (text). Matches that started in the previous
+// slice are only output on the frames in this slice.
+func (m TemporalPattern) RunWithState(ctx vaas.ExecContext, state []byte, export func([]byte)) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("temporal-pattern error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+
+	go func() {
+		freq := vaas.MinFreq(parents)
+		buf.SetMeta(freq)
+		frameSeconds := sampleSeconds(ctx.Slice, freq)
+		evaluators := make([]*ExprEvaluator, len(m.exprs))
+		for i, expr := range m.exprs {
+			evaluators[i] = expr.NewEvaluator(freq)
+		}
+		matcher := NewPatternMatcher(m.cfg.Steps, frameSeconds)
+		if state != nil {
+			var s TemporalPatternState
+			vaas.JsonUnmarshal(state, &s)
+			matcher.Import(s.Matcher)
+			for i, history := range s.History {
+				if i < len(evaluators) {
+					evaluators[i].SetHistory(history)
+				}
+			}
+		}
+
+		// output for frames [flushed, flushed+len(pending)) that has not been written
+		// yet because a partial match may still cover it
+		flushed := 0
+		var pending [][]string
+		flush := func(end int) {
+			n := end - flushed
+			if n <= 0 {
+				return
+			}
+			if m.node.DataType == vaas.IntType {
+				out := make(vaas.IntData, n)
+				for i := range out {
+					if len(pending[i]) > 0 {
+						out[i] = 1
+					}
+				}
+				buf.Write(out)
+			} else {
+				out := make(vaas.TextData, n)
+				for i := range out {
+					out[i] = vaas.RichText{Text: strings.Join(pending[i], "; ")}
+				}
+				buf.Write(out)
+			}
+			pending = pending[n:]
+			flushed = end
+		}
+
+		idx := 0
+		err := vaas.ReadMultiple(ctx.Slice.Length(), freq, parents, vaas.ReadMultipleOptions{Stats: m.stats}, func(index int, datas []vaas.Data) error {
+			frame := make([]vaas.Data, len(datas))
+			values := make([]bool, len(evaluators))
+			for i := 0; i < datas[0].Length(); i++ {
+				for j := range datas {
+					frame[j] = datas[j].Slice(i, i+1)
+				}
+				for k, evaluator := range evaluators {
+					x, err := evaluator.Eval(frame)
+					if err != nil {
+						return err
+					}
+					values[k] = x != 0
+				}
+				pending = append(pending, nil)
+				for _, match := range matcher.Step(idx, values) {
+					text := m.describe(match, frameSeconds)
+					start := match.Start()
+					if start < flushed {
+						start = flushed
+					}
+					for f := start; f <= match.End(); f++ {
+						pending[f-flushed] = append(pending[f-flushed], text)
+					}
+				}
+				idx++
+			}
+
+			if earliest, ok := matcher.EarliestPending(); ok {
+				flush(earliest)
+			} else {
+				flush(idx)
+			}
+			return nil
+		})
+		if err != nil {
+			buf.Error(fmt.Errorf("temporal-pattern: %v", err))
+			return
+		}
+		flush(idx)
+		s := TemporalPatternState{Matcher: matcher.Export(idx)}
+		for _, evaluator := range evaluators {
+			s.History = append(s.History, evaluator.History())
+		}
+		export(vaas.JsonMarshal(s))
+		buf.Close()
+	}()
+
+	return buf
+}
+
+func (m TemporalPattern) Close() {}
+
+func (m TemporalPattern) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["temporal-pattern"] = vaas.ExecutorMeta{
+		New: NewTemporalPattern,
+		Stateful: true,
+	}
+}
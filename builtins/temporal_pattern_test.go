@@ -0,0 +1,123 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"fmt"
+	"testing"
+)
+
+// Runs the matcher on the values of two steps, starting at frame start.
+func testPatternSteps(m *PatternMatcher, start int, a []int, b []int) []PatternMatch {
+	var matches []PatternMatch
+	for i := range a {
+		matches = append(matches, m.Step(start+i, []bool{a[i] == 1, b[i] == 1})...)
+	}
+	return matches
+}
+
+func TestPatternMatcherWithin(t *testing.T) {
+	// A holds on frames 0-3 and rises again on frame 6, and B is true on frames
+	// 4 and 8; B must match within 3 frames of A
+	a := []int{1, 1, 1, 1, 0, 0, 1, 0, 0}
+	b := []int{0, 0, 0, 0, 1, 0, 0, 0, 1}
+	steps := []PatternStep{
+		{Name: "a", Rising: true},
+		{Name: "b", Within: 3},
+	}
+	// with a rising edge, A only matches on frame 0, which is too long before
+	// frame 4
+	matches := testPatternSteps(NewPatternMatcher(steps, 1), 0, a, b)
+	if fmt.Sprintf("%v", matches) != "[{[6 8]}]" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	// otherwise A matches on every frame that it is true
+	steps[0].Rising = false
+	matches = testPatternSteps(NewPatternMatcher(steps, 1), 0, a, b)
+	if fmt.Sprintf("%v", matches) != "[{[3 4]} {[6 8]}]" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	// Within is in seconds, so at 0.5 seconds per frame B must match within 6 frames
+	steps[0].Rising = true
+	matches = testPatternSteps(NewPatternMatcher(steps, 0.5), 0, a, b)
+	if fmt.Sprintf("%v", matches) != "[{[0 4]} {[6 8]}]" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+}
+
+func TestPatternMatcherExportImport(t *testing.T) {
+	steps := []PatternStep{
+		{Name: "a", Rising: true},
+		{Name: "b", Within: 3},
+	}
+	// A rises on frame 7 of a slice of 10 frames and is still true at the end
+	m := NewPatternMatcher(steps, 1)
+	testPatternSteps(m, 0, []int{0, 0, 0, 0, 0, 0, 0, 1, 1, 1}, make([]int, 10))
+	state := m.Export(10)
+	if len(state.Partial) != 2 || state.Partial[0] != nil || fmt.Sprintf("%v", state.Partial[1].Frames) != "[-3]" {
+		t.Fatalf("expected partial match at frame -3 but got %v", state.Partial)
+	}
+	vaas.JsonUnmarshal(vaas.JsonMarshal(state), &state)
+
+	// A is still true on the first frame of the next slice, which isn't a rising
+	// edge, so B on frame 0 continues the partial match from the previous slice
+	m = NewPatternMatcher(steps, 1)
+	m.Import(state)
+	if earliest, ok := m.EarliestPending(); !ok || earliest != -3 {
+		t.Fatalf("expected earliest pending frame -3 but got %v, %v", earliest, ok)
+	}
+	matches := testPatternSteps(m, 0, []int{1}, []int{1})
+	if fmt.Sprintf("%v", matches) != "[{[-3 0]}]" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	if _, ok := m.EarliestPending(); ok {
+		t.Fatalf("expected no partial matches")
+	}
+
+	// the time limit also counts the frames in the previous slice
+	m = NewPatternMatcher(steps, 1)
+	m.Import(state)
+	matches = testPatternSteps(m, 0, []int{1, 0}, []int{0, 1})
+	if len(matches) != 0 {
+		t.Fatalf("expected no matches after the time limit but got %v", matches)
+	}
+
+	// the state is ignored if the steps changed
+	m = NewPatternMatcher(append(steps, PatternStep{Name: "c"}), 1)
+	m.Import(state)
+	if _, ok := m.EarliestPending(); ok {
+		t.Fatalf("expected state for other steps to be ignored")
+	}
+}
+
+func TestTemporalPatternAcrossSlices(t *testing.T) {
+	cfg := TemporalPatternConfig{Steps: []PatternStep{
+		{Name: "a", Expr: "p0 == 1"},
+		{Name: "b", Expr: "p1 == 1", Within: 3},
+	}}
+	node := vaas.Node{
+		Type: "temporal-pattern",
+		DataType: vaas.IntType,
+		Parents: testParents(2),
+		Code: string(vaas.JsonMarshal(cfg)),
+	}
+	e := NewTemporalPattern(node)
+
+	// A-B matches on frames 1-3, and on frames 6-9 across the two slices
+	// A on frame 11 has no B within 3 seconds
+	a := vaas.IntData{0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0}
+	b := vaas.IntData{0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+	segment := vaas.Segment{ID: 1, FPS: 1}
+	var outputs []string
+	var state []byte
+	for _, slice := range []vaas.Slice{{segment, 0, 8}, {segment, 8, 16}} {
+		var data vaas.Data
+		data, state = testRunExecutor(t, e, slice, 1, state, a.Slice(slice.Start, slice.End), b.Slice(slice.Start, slice.End))
+		outputs = append(outputs, fmt.Sprintf("%v", data))
+	}
+	// the outputs on frames 1-2 are held until B matches on frame 3, and the
+	// match that started in the first slice is only output in the second slice
+	if outputs[0] != "[0 1 1 1 0 0 0 0]" || outputs[1] != "[1 1 0 0 0 0 0 0]" {
+		t.Fatalf("unexpected outputs %v", outputs)
+	}
+}
@@ -0,0 +1,338 @@
+package builtins
+
+// Post-processing for tracks from IOU, SORT, or the self-supervised tracker:
+// joins fragments of the same object, fills missing frames by interpolation,
+// smooths the boxes, and drops short tracks.
+// All frame counts in the configuration are in frames of the original video, so
+// the same configuration works regardless of the input sampling frequency.
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+type TrackCleanupConfig struct {
+	// fill gaps of up to this many missing frames within a track (0 disables)
+	MaxGap int `json:"maxGap"`
+	// width, in frames, of the moving average applied to box coordinates (0 disables)
+	SmoothWindow int `json:"smoothWindow"`
+	// join a fragment that ends with one that starts at most this many frames
+	// later (0 disables)
+	JoinFrames int `json:"joinFrames"`
+	// and whose first box is within this many pixels of where the earlier
+	// fragment is expected to be, based on its velocity
+	JoinDistance float64 `json:"joinDistance"`
+	// drop tracks spanning fewer than this many frames (after joining)
+	MinLength int `json:"minLength"`
+}
+
+var DefaultTrackCleanupConfig = TrackCleanupConfig{
+	MaxGap: 10,
+	SmoothWindow: 5,
+	JoinFrames: 30,
+	JoinDistance: 50,
+	MinLength: 10,
+}
+
+type TrackCleanup struct {
+	node vaas.Node
+	cfg TrackCleanupConfig
+	stats *vaas.StatsHolder
+}
+
+func NewTrackCleanup(node vaas.Node) vaas.Executor {
+	cfg := DefaultTrackCleanupConfig
+	if node.Code != "" {
+		err := json.Unmarshal([]byte(node.Code), &cfg)
+		if err != nil {
+			return vaas.ErrorExecutor{node.DataType, fmt.Errorf("error decoding node configuration: %v", err)}
+		}
+	}
+	return TrackCleanup{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+func (m TrackCleanup) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("track-cleanup error reading parents: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.TrackType)
+
+	go func() {
+		t0 := time.Now()
+		freq := parents[0].Freq()
+		buf.SetMeta(freq)
+		data, err := parents[0].Read(ctx.Slice.Length())
+		if err != nil {
+			buf.Error(fmt.Errorf("track-cleanup error reading parent: %v", err))
+			return
+		}
+		parents[0].Close()
+
+		t1 := time.Now()
+		data_ := data.(vaas.DetectionData)
+		tracks := m.cfg.Cleanup(vaas.DetectionsToTracks(data_.D), freq)
+		detections := vaas.TracksToDetections(tracks)
+		ndata := vaas.DetectionData{T: vaas.TrackType}
+		for i := 0; i < len(data_.D) && i < len(detections); i++ {
+			ndata.D = append(ndata.D, vaas.DetectionFrame{
+				Detections: detections[i],
+				CanvasDims: data_.D[i].CanvasDims,
+			})
+		}
+		buf.Write(ndata.EnsureLength(data.Length()))
+		buf.Close()
+
+		t2 := time.Now()
+		sample := vaas.StatsSample{}
+		sample.Idle.Fraction = float64(t1.Sub(t0)) / float64(t2.Sub(t0))
+		sample.Idle.Count = ctx.Slice.Length()
+		m.stats.Add(sample)
+	}()
+
+	return buf
+}
+
+func (m TrackCleanup) Close() {}
+
+func (m TrackCleanup) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+// Applies the configured post-processing to tracks whose FrameIdx are sample
+// indices at the given sampling frequency.
+func (cfg TrackCleanupConfig) Cleanup(tracks [][]vaas.DetectionWithFrame, freq int) [][]vaas.DetectionWithFrame {
+	if freq < 1 {
+		freq = 1
+	}
+	for i := range tracks {
+		sort.Slice(tracks[i], func(a, b int) bool {
+			return tracks[i][a].FrameIdx < tracks[i][b].FrameIdx
+		})
+		tracks[i] = interpolateTrack(tracks[i], cfg.MaxGap, freq)
+	}
+	// sort by track ID so that the output is deterministic
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i][0].TrackID < tracks[j][0].TrackID
+	})
+	if cfg.JoinFrames > 0 {
+		tracks = cfg.joinFragments(tracks, freq)
+	}
+	var out [][]vaas.DetectionWithFrame
+	for _, track := range tracks {
+		// each sample covers freq frames of the original video
+		length := (track[len(track)-1].FrameIdx - track[0].FrameIdx + 1) * freq
+		if length < cfg.MinLength {
+			continue
+		}
+		if cfg.SmoothWindow > 1 {
+			// round the radius up to whole samples so that smoothing still
+			// applies when freq is larger than the window
+			radius := (cfg.SmoothWindow/2 + freq-1) / freq
+			if radius < 1 {
+				radius = 1
+			}
+			track = smoothTrack(track, radius)
+		}
+		out = append(out, track)
+	}
+	return out
+}
+
+// Fills gaps of up to maxGap frames by linear interpolation between the
+// detections on either side. maxGap < 0 fills every gap.
+func interpolateTrack(track []vaas.DetectionWithFrame, maxGap int, freq int) []vaas.DetectionWithFrame {
+	if maxGap == 0 || len(track) < 2 {
+		return track
+	}
+	out := []vaas.DetectionWithFrame{track[0]}
+	for _, cur := range track[1:] {
+		prev := out[len(out)-1]
+		missing := cur.FrameIdx - prev.FrameIdx - 1
+		if missing > 0 && (maxGap < 0 || missing*freq <= maxGap) {
+			for idx := prev.FrameIdx+1; idx < cur.FrameIdx; idx++ {
+				t := float64(idx - prev.FrameIdx) / float64(cur.FrameIdx - prev.FrameIdx)
+				d := prev.Detection
+				d.Left = interpolateInt(prev.Left, cur.Left, t)
+				d.Top = interpolateInt(prev.Top, cur.Top, t)
+				d.Right = interpolateInt(prev.Right, cur.Right, t)
+				d.Bottom = interpolateInt(prev.Bottom, cur.Bottom, t)
+				out = append(out, vaas.DetectionWithFrame{
+					Detection: d,
+					FrameIdx: idx,
+				})
+			}
+		}
+		out = append(out, cur)
+	}
+	return out
+}
+
+func interpolateInt(a int, b int, t float64) int {
+	return int(math.Round(float64(a) + t*float64(b-a)))
+}
+
+// Replaces each box with the average of the boxes within radius samples of it.
+// The window shrinks near the ends of the track so that it stays centered,
+// otherwise the endpoints would be pulled towards the rest of the track.
+func smoothTrack(track []vaas.DetectionWithFrame, radius int) []vaas.DetectionWithFrame {
+	if radius <= 0 {
+		return track
+	}
+	first := track[0].FrameIdx
+	last := track[len(track)-1].FrameIdx
+	out := make([]vaas.DetectionWithFrame, len(track))
+	for i, cur := range track {
+		r := radius
+		if cur.FrameIdx - first < r {
+			r = cur.FrameIdx - first
+		}
+		if last - cur.FrameIdx < r {
+			r = last - cur.FrameIdx
+		}
+		var sum [4]float64
+		var count float64
+		for j := i; j >= 0 && cur.FrameIdx - track[j].FrameIdx <= r; j-- {
+			sum = addBox(sum, track[j].Detection)
+			count++
+		}
+		for j := i+1; j < len(track) && track[j].FrameIdx - cur.FrameIdx <= r; j++ {
+			sum = addBox(sum, track[j].Detection)
+			count++
+		}
+		out[i] = cur
+		out[i].Left = int(math.Round(sum[0] / count))
+		out[i].Top = int(math.Round(sum[1] / count))
+		out[i].Right = int(math.Round(sum[2] / count))
+		out[i].Bottom = int(math.Round(sum[3] / count))
+	}
+	return out
+}
+
+func addBox(sum [4]float64, d vaas.Detection) [4]float64 {
+	sum[0] += float64(d.Left)
+	sum[1] += float64(d.Top)
+	sum[2] += float64(d.Right)
+	sum[3] += float64(d.Bottom)
+	return sum
+}
+
+// Returns the center of the box, and its velocity in pixels per sample estimated
+// from the last (or first) few detections.
+func trackEndpoint(track []vaas.DetectionWithFrame, end bool) (float64, float64, float64, float64) {
+	const window = 5
+	var a, b vaas.DetectionWithFrame
+	if end {
+		b = track[len(track)-1]
+		a = track[0]
+		if len(track) > window {
+			a = track[len(track)-window]
+		}
+	} else {
+		a = track[0]
+		b = track[len(track)-1]
+		if len(track) > window {
+			b = track[window-1]
+		}
+	}
+	ax, ay := detectionCenter(a.Detection)
+	bx, by := detectionCenter(b.Detection)
+	var vx, vy float64
+	if b.FrameIdx > a.FrameIdx {
+		vx = (bx-ax) / float64(b.FrameIdx-a.FrameIdx)
+		vy = (by-ay) / float64(b.FrameIdx-a.FrameIdx)
+	}
+	if end {
+		return bx, by, vx, vy
+	}
+	return ax, ay, vx, vy
+}
+
+func detectionCenter(d vaas.Detection) (float64, float64) {
+	return float64(d.Left+d.Right)/2, float64(d.Top+d.Bottom)/2
+}
+
+// Greedily joins pairs of fragments, closest pairs first, where the later fragment
+// starts shortly after the earlier one ends near its extrapolated position.
+// The joined track keeps the ID of its first fragment, and the gap between the
+// fragments is always interpolated.
+func (cfg TrackCleanupConfig) joinFragments(tracks [][]vaas.DetectionWithFrame, freq int) [][]vaas.DetectionWithFrame {
+	type candidate struct {
+		prev int
+		next int
+		distance float64
+	}
+	var candidates []candidate
+	for i, prev := range tracks {
+		end := prev[len(prev)-1].FrameIdx
+		ex, ey, vx, vy := trackEndpoint(prev, true)
+		for j, next := range tracks {
+			start := next[0].FrameIdx
+			if start <= end || (start-end)*freq > cfg.JoinFrames {
+				continue
+			}
+			sx, sy, _, _ := trackEndpoint(next, false)
+			dt := float64(start-end)
+			dx := ex + vx*dt - sx
+			dy := ey + vy*dt - sy
+			distance := math.Sqrt(dx*dx + dy*dy)
+			if distance > cfg.JoinDistance {
+				continue
+			}
+			candidates = append(candidates, candidate{i, j, distance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	// successor[i] is the fragment appended after fragment i
+	successor := make(map[int]int)
+	hasPredecessor := make(map[int]bool)
+	for _, c := range candidates {
+		if _, ok := successor[c.prev]; ok || hasPredecessor[c.next] {
+			continue
+		}
+		successor[c.prev] = c.next
+		hasPredecessor[c.next] = true
+	}
+
+	var out [][]vaas.DetectionWithFrame
+	for i := range tracks {
+		if hasPredecessor[i] {
+			continue
+		}
+		track := append([]vaas.DetectionWithFrame{}, tracks[i]...)
+		trackID := track[0].TrackID
+		for cur := i; ; {
+			next, ok := successor[cur]
+			if !ok {
+				break
+			}
+			var fragment []vaas.DetectionWithFrame
+			for _, d := range tracks[next] {
+				d.TrackID = trackID
+				fragment = append(fragment, d)
+			}
+			joined := interpolateTrack([]vaas.DetectionWithFrame{track[len(track)-1], fragment[0]}, -1, freq)
+			track = append(track, joined[1:len(joined)-1]...)
+			track = append(track, fragment...)
+			cur = next
+		}
+		out = append(out, track)
+	}
+	return out
+}
+
+func init() {
+	vaas.Executors["track-cleanup"] = vaas.ExecutorMeta{New: NewTrackCleanup}
+}
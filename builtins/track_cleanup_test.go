@@ -0,0 +1,89 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"testing"
+)
+
+// Returns a track with a 10x10 box at x=left[i] on each of the sample indices.
+func testTrack(id int, samples []int, left []int) []vaas.DetectionWithFrame {
+	var track []vaas.DetectionWithFrame
+	for i, idx := range samples {
+		track = append(track, vaas.DetectionWithFrame{
+			Detection: vaas.Detection{Left: left[i], Top: 0, Right: left[i]+10, Bottom: 10, TrackID: id},
+			FrameIdx: idx,
+		})
+	}
+	return track
+}
+
+func testFrameIdxs(track []vaas.DetectionWithFrame) []int {
+	var idxs []int
+	for _, d := range track {
+		idxs = append(idxs, d.FrameIdx)
+	}
+	return idxs
+}
+
+func TestTrackCleanupInterpolate(t *testing.T) {
+	cfg := TrackCleanupConfig{MaxGap: 10}
+	// at freq=2, the gap of 4 samples is 8 frames so it is filled, but the gap
+	// of 6 samples is 12 frames so it isn't
+	track := testTrack(1, []int{0, 5, 12}, []int{0, 50, 120})
+	tracks := cfg.Cleanup([][]vaas.DetectionWithFrame{track}, 2)
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track but got %v", tracks)
+	}
+	idxs := testFrameIdxs(tracks[0])
+	if len(idxs) != 7 || idxs[4] != 4 || idxs[5] != 5 || idxs[6] != 12 {
+		t.Fatalf("expected samples 0-5 and 12 but got %v", idxs)
+	}
+	if tracks[0][2].Left != 20 {
+		t.Fatalf("expected interpolated box at 20 but got %v", tracks[0][2])
+	}
+}
+
+func TestTrackCleanupJoin(t *testing.T) {
+	// the second fragment continues the first one at 10 pixels per sample
+	// after a gap of 4 samples
+	first := testTrack(1, []int{0, 1, 2, 3}, []int{0, 10, 20, 30})
+	second := testTrack(2, []int{7, 8, 9}, []int{70, 80, 90})
+
+	// at freq=3, the gap is 12 frames
+	cfg := TrackCleanupConfig{JoinFrames: 15, JoinDistance: 5}
+	tracks := cfg.Cleanup([][]vaas.DetectionWithFrame{first, second}, 3)
+	if len(tracks) != 1 || len(tracks[0]) != 10 {
+		t.Fatalf("expected fragments joined into one track of 10 samples but got %v", tracks)
+	}
+	for i, d := range tracks[0] {
+		if d.TrackID != 1 || d.FrameIdx != i || d.Left != 10*i {
+			t.Fatalf("unexpected detection %v at sample %d of joined track", d, i)
+		}
+	}
+
+	cfg.JoinFrames = 10
+	first = testTrack(1, []int{0, 1, 2, 3}, []int{0, 10, 20, 30})
+	second = testTrack(2, []int{7, 8, 9}, []int{70, 80, 90})
+	tracks = cfg.Cleanup([][]vaas.DetectionWithFrame{first, second}, 3)
+	if len(tracks) != 2 {
+		t.Fatalf("expected fragments 12 frames apart not to be joined but got %v", tracks)
+	}
+}
+
+func TestTrackCleanupSmooth(t *testing.T) {
+	// the window of 5 frames is less than one sample at freq=3, but it should
+	// still average each box with its neighbors
+	cfg := TrackCleanupConfig{SmoothWindow: 5}
+	track := testTrack(1, []int{0, 1, 2, 3, 4}, []int{0, 30, 0, 30, 0})
+	tracks := cfg.Cleanup([][]vaas.DetectionWithFrame{track}, 3)
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track but got %v", tracks)
+	}
+	expected := []int{0, 10, 20, 10, 0}
+	for i, d := range tracks[0] {
+		if d.Left != expected[i] {
+			t.Fatalf("expected smoothed lefts %v but got %v at sample %d", expected, d.Left, i)
+		}
+	}
+}
@@ -40,14 +40,27 @@ func GetParents(ctx vaas.ExecContext, node vaas.Node) ([]vaas.DataReader, error)
 
 type PerFrameFunc func(idx int, data vaas.Data, outBuf vaas.DataWriter) error
 
+// PerFrame only calls f on the frames selected by opts.Mask (see
+// ExecContext.Mask), and writes empty data on the other frames.
+// Executors with video output shouldn't set opts.Mask since they can't skip frames.
 func PerFrame(parents []vaas.DataReader, slice vaas.Slice, buf vaas.DataWriter, t vaas.DataType, opts vaas.ReadMultipleOptions, f PerFrameFunc) {
-	err := vaas.ReadMultiple(slice.Length(), vaas.MinFreq(parents), parents, opts, func(index int, datas []vaas.Data) error {
+	PerFrameWithFinish(parents, slice, buf, t, opts, f, nil)
+}
+
+// Like PerFrame, but if there is no error, calls finish after the last frame and
+// before closing buf, e.g. to export the state of a StatefulExecutor.
+func PerFrameWithFinish(parents []vaas.DataReader, slice vaas.Slice, buf vaas.DataWriter, t vaas.DataType, opts vaas.ReadMultipleOptions, f PerFrameFunc, finish func()) {
+	err := vaas.ReadMultipleMasked(slice.Length(), vaas.MinFreq(parents), parents, opts, func(index int, datas []vaas.Data, selected []bool) error {
 		if len(datas) != 1 {
 			panic(fmt.Errorf("expected exactly one input, but got %d", len(datas)))
 		} else if datas[0].Type() != t {
 			panic(fmt.Errorf("expected type %v", t))
 		}
 		for i := 0; i < datas[0].Length(); i++ {
+			if !selected[i] {
+				buf.Write(vaas.NewData(buf.Buffer().Type()).EnsureLength(1))
+				continue
+			}
 			err := f(index+i, datas[0].Slice(i, i+1), buf)
 			if err != nil {
 				return err
@@ -58,6 +71,8 @@ func PerFrame(parents []vaas.DataReader, slice vaas.Slice, buf vaas.DataWriter,
 	if err != nil {
 		log.Printf("[models (%v)] error reading: %v", slice, err)
 		buf.Error(err)
+	} else if finish != nil {
+		finish()
 	}
 	buf.Close()
 }
@@ -0,0 +1,96 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"testing"
+)
+
+// Returns parents referring to the nodes that testRunExecutor provides.
+func testParents(n int) []vaas.Parent {
+	var parents []vaas.Parent
+	for i := 0; i < n; i++ {
+		parents = append(parents, vaas.Parent{Type: vaas.NodeParent, NodeID: i+1})
+	}
+	return parents
+}
+
+type testDataConfig struct {
+	Freq int
+	Data []byte
+}
+
+// Outputs the data in its configuration one sample at a time, so that its
+// children read it in several chunks like a parent that is still running.
+type testDataExecutor struct {
+	node vaas.Node
+}
+
+func (m testDataExecutor) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	var cfg testDataConfig
+	vaas.JsonUnmarshal([]byte(m.node.Code), &cfg)
+	data := vaas.DecodeData(m.node.DataType, cfg.Data)
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+	go func() {
+		buf.SetMeta(cfg.Freq)
+		for i := 0; i < data.Length(); i++ {
+			buf.Write(data.Slice(i, i+1))
+		}
+		buf.Close()
+	}()
+	return buf
+}
+
+func (m testDataExecutor) Close() {}
+
+func init() {
+	vaas.Executors["test-data"] = vaas.ExecutorMeta{
+		New: func(node vaas.Node) vaas.Executor {
+			return testDataExecutor{node}
+		},
+	}
+}
+
+// Runs an executor on a slice where its parents (see testParents) output the
+// given data, sampled at freq.
+// The parents run in an in-process container, so the executor reads them through
+// the same streams as in a real query.
+// Stateful executors start from state, and the state they export is returned.
+func testRunExecutor(t *testing.T, e vaas.Executor, slice vaas.Slice, freq int, state []byte, parents ...vaas.Data) (vaas.Data, []byte) {
+	rt := vaas.NewContainerRuntime("builtins-test", nil)
+	vaas.RegisterLocalContainer(rt)
+	defer vaas.UnregisterLocalContainer(rt.UUID)
+
+	ctx := vaas.ExecContext{
+		Nodes: make(map[int]*vaas.Node),
+		Containers: make(map[int]vaas.Container),
+		UUID: "builtins-test",
+		Slice: slice,
+		Opts: vaas.ExecOptions{NoPersist: true},
+	}
+	for i, data := range parents {
+		ctx.Nodes[i+1] = &vaas.Node{
+			ID: i+1,
+			Name: "test-data",
+			Type: "test-data",
+			DataType: data.Type(),
+			Code: string(vaas.JsonMarshal(testDataConfig{freq, data.Encode()})),
+		}
+		ctx.Containers[i+1] = vaas.Container{UUID: rt.UUID}
+	}
+
+	var buf vaas.DataBuffer
+	var exported []byte
+	if stateful, ok := e.(vaas.StatefulExecutor); ok {
+		buf = stateful.RunWithState(ctx, state, func(b []byte) {
+			exported = b
+		})
+	} else {
+		buf = e.Run(ctx)
+	}
+	data, err := testReadAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, exported
+}
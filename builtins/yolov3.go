@@ -137,7 +137,7 @@ func (m *Yolov3) Run(ctx vaas.ExecContext) vaas.DataBuffer {
 		buf.SetMeta(parent.Freq())
 		PerFrame(
 			parents, ctx.Slice, buf, vaas.VideoType,
-			vaas.ReadMultipleOptions{Stats: m.stats},
+			vaas.ReadMultipleOptions{Stats: m.stats, Mask: ctx.Mask},
 			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
 				im := data.(vaas.VideoData)[0]
 				m.mu.Lock()
@@ -0,0 +1,273 @@
+package builtins
+
+// Occupancy and dwell time of named zones, e.g. parking spaces or a queue area.
+// zone-occupancy counts the objects in each zone on every frame, and zone-dwell
+// outputs when each track entered and left each zone.
+
+import (
+	"../vaas"
+
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type ZoneConfig struct {
+	CanvasDims [2]int
+	Zones []vaas.Zone
+
+	// for zone-occupancy nodes with int output: the zone to count, or empty to
+	// count across all zones
+	Zone string
+}
+
+func NewZoneConfig(node vaas.Node) (ZoneConfig, error) {
+	var cfg ZoneConfig
+	if err := json.Unmarshal([]byte(node.Code), &cfg); err != nil {
+		return cfg, fmt.Errorf("error decoding node configuration: %v", err)
+	}
+	for _, zone := range cfg.Zones {
+		if len(zone.Shape) < 2 {
+			return cfg, fmt.Errorf("zone %s has no shape", zone.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// Returns the indices of the zones containing the center of each detection.
+func (cfg ZoneConfig) Locate(df vaas.DetectionFrame) [][]int {
+	resized := vaas.DetectionData{D: []vaas.DetectionFrame{df}}.Resize(cfg.CanvasDims).D[0]
+	zones := make([][]int, len(resized.Detections))
+	for i, d := range resized.Detections {
+		for zoneIdx, zone := range cfg.Zones {
+			if zone.Shape.Contains(d) {
+				zones[i] = append(zones[i], zoneIdx)
+			}
+		}
+	}
+	return zones
+}
+
+func zoneParentType(parents []vaas.DataReader) (vaas.DataType, error) {
+	t := parents[0].Type()
+	if t != vaas.DetectionType && t != vaas.TrackType {
+		return t, fmt.Errorf("expected detection or track parent but got %s", t)
+	}
+	return t, nil
+}
+
+type ZoneOccupancy struct {
+	node vaas.Node
+	cfg ZoneConfig
+	stats *vaas.StatsHolder
+}
+
+func NewZoneOccupancy(node vaas.Node) vaas.Executor {
+	cfg, err := NewZoneConfig(node)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, err}
+	}
+	if node.DataType != vaas.IntType && node.DataType != vaas.StringType {
+		return vaas.ErrorExecutor{node.DataType, fmt.Errorf("zone-occupancy node must output int or string, but got %s", node.DataType)}
+	}
+	return ZoneOccupancy{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// Outputs the number of objects in the configured zone (int), or a JSON object
+// from zone name to the number of objects in the zone (string).
+func (m ZoneOccupancy) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("zone-occupancy error reading parents: %v", err))
+	}
+	parentType, err := zoneParentType(parents)
+	if err != nil {
+		return vaas.GetErrorBuffer(m.node.DataType, fmt.Errorf("zone-occupancy: %v", err))
+	}
+	buf := vaas.NewSimpleBuffer(m.node.DataType)
+
+	go func() {
+		buf.SetMeta(parents[0].Freq())
+		PerFrame(
+			parents, ctx.Slice, buf, parentType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				counts := make(map[string]int)
+				for _, zone := range m.cfg.Zones {
+					counts[zone.Name] = 0
+				}
+				total := 0
+				for _, zones := range m.cfg.Locate(data.(vaas.DetectionData).D[0]) {
+					for _, zoneIdx := range zones {
+						counts[m.cfg.Zones[zoneIdx].Name]++
+						total++
+					}
+				}
+				if m.node.DataType == vaas.IntType {
+					if m.cfg.Zone == "" {
+						buf.Write(vaas.IntData{total})
+					} else {
+						buf.Write(vaas.IntData{counts[m.cfg.Zone]})
+					}
+				} else {
+					buf.Write(vaas.StringData{string(vaas.JsonMarshal(counts))})
+				}
+				return nil
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m ZoneOccupancy) Close() {}
+
+func (m ZoneOccupancy) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+// One visit of a track to a zone.
+// Frames are indices in the segment, so visits from different slices can be combined.
+type ZoneVisit struct {
+	TrackID int
+	Zone string
+	// first and last frame where the track was in the zone
+	Enter int
+	Exit int
+	// dwell duration
+	Frames int
+	Seconds float64
+	// the visit continues past the start or end of the slice, so the actual
+	// dwell time may be longer
+	Partial bool
+}
+
+type ZoneDwell struct {
+	node vaas.Node
+	cfg ZoneConfig
+	stats *vaas.StatsHolder
+}
+
+func NewZoneDwell(node vaas.Node) vaas.Executor {
+	cfg, err := NewZoneConfig(node)
+	if err != nil {
+		return vaas.ErrorExecutor{node.DataType, err}
+	}
+	return ZoneDwell{
+		node: node,
+		cfg: cfg,
+		stats: new(vaas.StatsHolder),
+	}
+}
+
+// Outputs, on the frame where a visit ends, a JSON list of the visits that ended.
+// A visit ends when the track is seen outside the zone; visits that are still
+// ongoing at the end of the slice are output on the last frame.
+func (m ZoneDwell) Run(ctx vaas.ExecContext) vaas.DataBuffer {
+	parents, err := GetParents(ctx, m.node)
+	if err != nil {
+		return vaas.GetErrorBuffer(vaas.StringType, fmt.Errorf("zone-dwell error reading parents: %v", err))
+	}
+	if parents[0].Type() != vaas.TrackType {
+		return vaas.GetErrorBuffer(vaas.StringType, fmt.Errorf("zone-dwell: expected track parent but got %s", parents[0].Type()))
+	}
+	buf := vaas.NewSimpleBuffer(vaas.StringType)
+
+	go func() {
+		freq := parents[0].Freq()
+		buf.SetMeta(freq)
+		numSamples := (ctx.Slice.Length() + freq-1) / freq
+
+		// visits in progress, by track ID and zone index
+		// Enter and Exit are sample indices until the visit is output
+		active := make(map[[2]int]*ZoneVisit)
+		finish := func(visit ZoneVisit) ZoneVisit {
+			visit.Partial = visit.Partial || visit.Exit == numSamples-1
+			visit.Frames = (visit.Exit - visit.Enter + 1) * freq
+			visit.Seconds = float64(visit.Frames) / float64(vaas.FPS)
+			visit.Enter = ctx.Slice.Start + visit.Enter*freq
+			visit.Exit = ctx.Slice.Start + visit.Exit*freq
+			return visit
+		}
+
+		// the idx passed by PerFrame counts frames read before the current chunk
+		// plus samples within it, so it is only a sample index at freq=1
+		sample := 0
+		PerFrame(
+			parents, ctx.Slice, buf, vaas.TrackType,
+			vaas.ReadMultipleOptions{Stats: m.stats},
+			func(idx int, data vaas.Data, buf vaas.DataWriter) error {
+				defer func() {
+					sample++
+				}()
+				df := data.(vaas.DetectionData).D[0]
+				inside := make(map[[2]int]bool)
+				seen := make(map[int]bool)
+				for i, zones := range m.cfg.Locate(df) {
+					trackID := df.Detections[i].TrackID
+					seen[trackID] = true
+					for _, zoneIdx := range zones {
+						k := [2]int{trackID, zoneIdx}
+						inside[k] = true
+						if active[k] == nil {
+							active[k] = &ZoneVisit{
+								TrackID: trackID,
+								Zone: m.cfg.Zones[zoneIdx].Name,
+								Enter: sample,
+								Partial: sample == 0,
+							}
+						}
+						active[k].Exit = sample
+					}
+				}
+
+				// tracks may be missing on some frames, so visits only end when
+				// the track is seen outside the zone
+				var visits []ZoneVisit
+				for k, visit := range active {
+					if !seen[k[0]] || inside[k] {
+						continue
+					}
+					visits = append(visits, finish(*visit))
+					delete(active, k)
+				}
+				if sample == numSamples-1 {
+					for k, visit := range active {
+						visits = append(visits, finish(*visit))
+						delete(active, k)
+					}
+				}
+
+				sort.Slice(visits, func(i, j int) bool {
+					if visits[i].TrackID != visits[j].TrackID {
+						return visits[i].TrackID < visits[j].TrackID
+					}
+					return visits[i].Zone < visits[j].Zone
+				})
+				if len(visits) == 0 {
+					buf.Write(vaas.StringData{""})
+				} else {
+					buf.Write(vaas.StringData{string(vaas.JsonMarshal(visits))})
+				}
+				return nil
+			},
+		)
+	}()
+
+	return buf
+}
+
+func (m ZoneDwell) Close() {}
+
+func (m ZoneDwell) Stats() vaas.StatsSample {
+	return m.stats.Get()
+}
+
+func init() {
+	vaas.Executors["zone-occupancy"] = vaas.ExecutorMeta{New: NewZoneOccupancy}
+	vaas.Executors["zone-dwell"] = vaas.ExecutorMeta{New: NewZoneDwell}
+}
@@ -0,0 +1,69 @@
+package builtins
+
+import (
+	"../vaas"
+
+	"testing"
+)
+
+func TestZoneDwellFreq(t *testing.T) {
+	cfg := ZoneConfig{
+		CanvasDims: [2]int{100, 100},
+		Zones: []vaas.Zone{{Name: "queue", Shape: vaas.Shape{{0, 0}, {50, 0}, {50, 100}, {0, 100}}}},
+	}
+	node := vaas.Node{
+		Type: "zone-dwell",
+		DataType: vaas.StringType,
+		Parents: testParents(1),
+		Code: string(vaas.JsonMarshal(cfg)),
+	}
+	e := NewZoneDwell(node)
+
+	// 100 samples at freq=2, which are read in several chunks: track 1 is in the
+	// zone on samples 43-49, and track 2 enters on sample 95 and is still there
+	// at the end of the slice
+	tracks := vaas.DetectionData{T: vaas.TrackType}
+	for i := 0; i < 100; i++ {
+		x1 := 80
+		if i >= 43 && i < 50 {
+			x1 = 20
+		}
+		detections := []vaas.Detection{{Left: x1-5, Top: 0, Right: x1+5, Bottom: 10, TrackID: 1}}
+		if i >= 80 {
+			x2 := 80
+			if i >= 95 {
+				x2 = 20
+			}
+			detections = append(detections, vaas.Detection{Left: x2-5, Top: 50, Right: x2+5, Bottom: 60, TrackID: 2})
+		}
+		tracks.D = append(tracks.D, vaas.DetectionFrame{
+			Detections: detections,
+			CanvasDims: [2]int{100, 100},
+		})
+	}
+
+	slice := vaas.Slice{Start: 100, End: 300}
+	data, _ := testRunExecutor(t, e, slice, 2, nil, tracks)
+	outputs := data.(vaas.StringData)
+	if len(outputs) != 100 {
+		t.Fatalf("expected 100 outputs but got %d", len(outputs))
+	}
+	for i, s := range outputs {
+		if s != "" && i != 50 && i != 99 {
+			t.Fatalf("unexpected visits on sample %d: %s", i, s)
+		}
+	}
+
+	var visits []ZoneVisit
+	vaas.JsonUnmarshal([]byte(outputs[50]), &visits)
+	expected := ZoneVisit{TrackID: 1, Zone: "queue", Enter: 186, Exit: 198, Frames: 14, Seconds: 14/float64(vaas.FPS)}
+	if len(visits) != 1 || visits[0] != expected {
+		t.Fatalf("expected %v on sample 50 but got %s", expected, outputs[50])
+	}
+	visits = nil
+	vaas.JsonUnmarshal([]byte(outputs[99]), &visits)
+	expected = ZoneVisit{TrackID: 2, Zone: "queue", Enter: 290, Exit: 298, Frames: 10, Seconds: 10/float64(vaas.FPS), Partial: true}
+	if len(visits) != 1 || visits[0] != expected {
+		t.Fatalf("expected %v on the last sample but got %s", expected, outputs[99])
+	}
+}
@@ -5,27 +5,190 @@ import (
 	gouuid "github.com/google/uuid"
 
 	"bufio"
+	"crypto/sha1"
+	"flag"
 	"fmt"
 	"log"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
+// how often we poll the /health endpoint of each container
+const HealthInterval = 5*time.Second
+
+// container is killed and restarted after this many consecutive failed health checks
+const HealthFailures = 3
+
+// give up on restarting a container after this many crashes
+const MaxRestarts = 5
+
+// Keeps the last few lines that a container wrote to stderr.
+// We use this to report why a container exited.
+type stderrTail struct {
+	lines []string
+	partial string
+	mu sync.Mutex
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := strings.Split(t.partial + string(p), "\n")
+	t.partial = parts[len(parts)-1]
+	for _, line := range parts[0:len(parts)-1] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		t.lines = append(t.lines, line)
+	}
+	if len(t.lines) > 50 {
+		t.lines = append([]string{}, t.lines[len(t.lines)-50:]...)
+	}
+	return len(p), nil
+}
+
+// Returns the panic message if the container panicked, or otherwise the last line.
+func (t *stderrTail) Reason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.lines)-1; i >= 0; i-- {
+		if strings.HasPrefix(t.lines[i], "panic:") {
+			return t.lines[i]
+		}
+	}
+	if len(t.lines) > 0 {
+		return t.lines[len(t.lines)-1]
+	}
+	return ""
+}
+
+// Returns total memory of this machine in MB, or 0 if it couldn't be determined.
+// In that case we don't report memory to the coordinator, so that memory
+// requirements aren't enforced on this machine.
+func totalMemoryMB() int {
+	bytes, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		log.Printf("[machine] warning: could not read total memory: %v", err)
+		return 0
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 || parts[0] != "MemTotal:" {
+			continue
+		}
+		return vaas.ParseInt(parts[1]) / 1024
+	}
+	return 0
+}
+
+// Parent cgroup (v2) under which we create one cgroup per container.
+const CgroupRoot = "/sys/fs/cgroup/vaas"
+
+// Create a cgroup that limits memory (MB) and cpu (cores) to the environment requirements.
+func createCgroup(uuid string, requirements map[string]int) (string, error) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not available")
+	}
+	if err := os.MkdirAll(CgroupRoot, 0755); err != nil {
+		return "", err
+	}
+	// enable the controllers for our parent cgroup and then for its children
+	// the first write may fail if they are already enabled higher up
+	ioutil.WriteFile("/sys/fs/cgroup/cgroup.subtree_control", []byte("+memory +cpu"), 0644)
+	if err := ioutil.WriteFile(filepath.Join(CgroupRoot, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+		return "", err
+	}
+	path := filepath.Join(CgroupRoot, uuid)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return "", err
+	}
+	if requirements["memory"] > 0 {
+		limit := fmt.Sprintf("%d", requirements["memory"]*1024*1024)
+		if err := ioutil.WriteFile(filepath.Join(path, "memory.max"), []byte(limit), 0644); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	if requirements["cpu"] > 0 {
+		limit := fmt.Sprintf("%d 100000", requirements["cpu"]*100000)
+		if err := ioutil.WriteFile(filepath.Join(path, "cpu.max"), []byte(limit), 0644); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// Images that we built from directories with a Dockerfile, by directory.
+var builtImages = make(map[string]string)
+var builtImagesMu sync.Mutex
+
+// Returns the Docker image to run for Environment.Image, building it if it's a
+// directory containing a Dockerfile.
+func prepareImage(image string) (string, error) {
+	if _, err := os.Stat(filepath.Join(image, "Dockerfile")); err != nil {
+		// it should be an image name, which docker run pulls if needed
+		return image, nil
+	}
+	builtImagesMu.Lock()
+	defer builtImagesMu.Unlock()
+	if tag := builtImages[image]; tag != "" {
+		return tag, nil
+	}
+	absPath, err := filepath.Abs(image)
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(filepath.Base(absPath)))
+	// include a hash of the path in case different directories have the same name
+	hash := sha1.Sum([]byte(absPath))
+	tag := fmt.Sprintf("vaas-env-%s-%x", name, hash[:4])
+	log.Printf("[machine] building image %s from %s", tag, image)
+	output, err := exec.Command("docker", "build", "-t", tag, image).CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		if len(lines) > 10 {
+			lines = lines[len(lines)-10:]
+		}
+		return "", fmt.Errorf("error building image from %s: %v\n%s", image, err, strings.Join(lines, "\n"))
+	}
+	builtImages[image] = tag
+	return tag, nil
+}
+
+// Name of the Docker container that runs the container with this UUID.
+func dockerName(uuid string) string {
+	return "vaas-" + uuid
+}
+
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("usage: ./machine [external IP] [port] [coordinator URL] [CUDA GPU list]")
+	secret := vaas.AuthFlag()
+	flag.Parse()
+	vaas.SetupAuth(*secret)
+	args := flag.Args()
+	if len(args) < 4 {
+		fmt.Println("usage: ./machine [-secret SECRET] [external IP] [port] [coordinator URL] [CUDA GPU list]")
 		fmt.Println("example: ./machine localhost 8081 http://localhost:8080 0,1")
 		return
 	}
-	myIP := os.Args[1]
-	port := vaas.ParseInt(os.Args[2])
-	coordinatorURL := os.Args[3]
-	gpulist := strings.Split(os.Args[4], ",")
+	myIP := args[0]
+	port := vaas.ParseInt(args[1])
+	coordinatorURL := args[2]
+	gpulist := strings.Split(args[3], ",")
 
 	// set gpulist correctly if it's empty
 	if len(gpulist) == 1 && gpulist[0] == "" {
@@ -36,8 +199,27 @@ func main() {
 		cmd *exec.Cmd
 		stdin io.WriteCloser
 		gpuIndexes []int
+
+		// needed to restart the container with the same environment
+		env []string
+		port int
+		// resource limits: either a cgroup, or a ulimit on virtual memory (KB) if cgroups are unavailable
+		cgroup string
+		ulimitKB int
+		// MB that the container may use for buffers before spilling or releasing them
+		bufferBudget int
+		// if set, the Docker image that we run the container in
+		image string
+		requirements map[string]int
+		stderr *stderrTail
+		restarts int
+
+		// set when the container is being de-allocated, so that we don't restart it
+		stopping bool
+		// closed after the container process exits for the last time
+		done chan bool
 	}
-	containers := make(map[string]Cmd)
+	containers := make(map[string]*Cmd)
 	var mu sync.Mutex
 
 	// indexes in gpulist that are in use
@@ -71,6 +253,226 @@ func main() {
 		return gpuIndexes, cudaStr, nil
 	}
 
+	// Release the GPUs and cgroup of a container that has exited.
+	// Caller must have the lock.
+	releaseResources := func(c *Cmd) {
+		for _, gpuIdx := range c.gpuIndexes {
+			log.Printf("[machine] ... release GPU idx=%d gpu=%s", gpuIdx, gpulist[gpuIdx])
+			gpusInUse[gpuIdx] = false
+		}
+		c.gpuIndexes = nil
+		if c.cgroup != "" {
+			if err := os.Remove(c.cgroup); err != nil {
+				log.Printf("[machine] warning: error removing cgroup %s: %v", c.cgroup, err)
+			}
+			c.cgroup = ""
+		}
+	}
+
+	// Start the container process, and set c.cmd/c.stdin/c.port.
+	// If c.port is already set, the container is asked to listen on that port.
+	// Starting may take a while (e.g. pulling the image), so the caller must not
+	// have the lock; we only take it to set the fields.
+	startContainer := func(uuid string, c *Cmd) error {
+		var args []string
+		if c.bufferBudget > 0 {
+			args = append(args, "-buffer-budget", fmt.Sprintf("%d", c.bufferBudget))
+		}
+		args = append(args, uuid, coordinatorURL)
+		if c.port != 0 {
+			args = append(args, fmt.Sprintf("%d", c.port))
+		}
+		var cmd *exec.Cmd
+		if c.image != "" {
+			// remove the previous Docker container if we are restarting
+			exec.Command("docker", "rm", "-f", dockerName(uuid)).Run()
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			dockerArgs := []string{
+				"run", "--rm", "-i",
+				"--name", dockerName(uuid),
+				"--network", "host",
+				"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+				"-v", wd + ":" + wd, "-w", wd,
+			}
+			if vaas.AuthSecret() != "" {
+				// the value comes from cmd.Env
+				dockerArgs = append(dockerArgs, "-e", vaas.AuthSecretEnv)
+			}
+			if len(c.gpuIndexes) > 0 {
+				var gpus []string
+				for _, idx := range c.gpuIndexes {
+					gpus = append(gpus, gpulist[idx])
+				}
+				dockerArgs = append(dockerArgs, "--gpus", fmt.Sprintf("\"device=%s\"", strings.Join(gpus, ",")))
+			}
+			if c.requirements["memory"] > 0 {
+				dockerArgs = append(dockerArgs, "--memory", fmt.Sprintf("%dm", c.requirements["memory"]))
+			}
+			if c.requirements["cpu"] > 0 {
+				dockerArgs = append(dockerArgs, "--cpus", fmt.Sprintf("%d", c.requirements["cpu"]))
+			}
+			dockerArgs = append(dockerArgs, c.image, "./container")
+			cmd = exec.Command("docker", append(dockerArgs, args...)...)
+		} else if c.ulimitKB > 0 {
+			script := fmt.Sprintf("ulimit -v %d && exec ./container \"$@\"", c.ulimitKB)
+			cmd = exec.Command("/bin/sh", append([]string{"-c", script, "container"}, args...)...)
+		} else {
+			cmd = exec.Command("./container", args...)
+		}
+		cmd.Env = c.env
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		cmd.Stderr = io.MultiWriter(os.Stderr, c.stderr)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if c.cgroup != "" {
+			// the container starts executors lazily, so any processes it creates will inherit the cgroup
+			pid := fmt.Sprintf("%d", cmd.Process.Pid)
+			if err := ioutil.WriteFile(filepath.Join(c.cgroup, "cgroup.procs"), []byte(pid), 0644); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return fmt.Errorf("error adding container to cgroup: %v", err)
+			}
+		}
+		rd := bufio.NewReader(stdout)
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("error reading container port: %v (%s)", err, c.stderr.Reason())
+		}
+		mu.Lock()
+		c.cmd = cmd
+		c.stdin = stdin
+		c.port = vaas.ParseInt(strings.TrimSpace(line))
+		mu.Unlock()
+		return nil
+	}
+
+	reportExit := func(uuid string, c *Cmd, reason string, restarted bool) {
+		exit := vaas.ContainerExit{
+			UUID: uuid,
+			BaseURL: fmt.Sprintf("http://%s:%d", myIP, c.port),
+			Reason: reason,
+			Restarted: restarted,
+		}
+		err := vaas.JsonPost(coordinatorURL, "/container-exited", exit, nil)
+		if err != nil {
+			log.Printf("[machine] warning: error reporting exit of container %s: %v", uuid, err)
+		}
+	}
+
+	// Wait for the container to exit, polling its /health endpoint in the meantime.
+	// Containers that crash or fail health checks are restarted with the same environment.
+	monitorContainer := func(uuid string, c *Cmd) {
+		client := &http.Client{Transport: vaas.InternalTransport, Timeout: HealthInterval}
+		for {
+			mu.Lock()
+			cmd := c.cmd
+			baseURL := fmt.Sprintf("http://localhost:%d", c.port)
+			mu.Unlock()
+
+			exitCh := make(chan error, 1)
+			go func() {
+				exitCh <- cmd.Wait()
+			}()
+
+			var exitErr error
+			var healthErr error
+			failures := 0
+			ticker := time.NewTicker(HealthInterval)
+			func() {
+				defer ticker.Stop()
+				for {
+					select {
+					case exitErr = <- exitCh:
+						return
+					case <- ticker.C:
+						resp, err := client.Get(baseURL + "/health")
+						if err == nil {
+							resp.Body.Close()
+							if resp.StatusCode != 200 {
+								err = fmt.Errorf("got status code %d", resp.StatusCode)
+							}
+						}
+						if err == nil {
+							failures = 0
+							continue
+						}
+						failures++
+						log.Printf("[machine] container %s failed health check (%d/%d): %v", uuid, failures, HealthFailures, err)
+						if failures >= HealthFailures && healthErr == nil {
+							healthErr = err
+							cmd.Process.Kill()
+							if c.image != "" {
+								// killing docker run doesn't stop the Docker container
+								exec.Command("docker", "kill", dockerName(uuid)).Run()
+							}
+						}
+					}
+				}
+			}()
+
+			mu.Lock()
+			if c.stopping {
+				mu.Unlock()
+				close(c.done)
+				return
+			}
+
+			var reason string
+			if healthErr != nil {
+				reason = fmt.Sprintf("killed after failed health checks: %v", healthErr)
+			} else if exitErr != nil {
+				reason = fmt.Sprintf("exited: %v", exitErr)
+			} else {
+				reason = "exited unexpectedly"
+			}
+			if tail := c.stderr.Reason(); tail != "" {
+				reason += " (" + tail + ")"
+			}
+			log.Printf("[machine] container %s %s", uuid, reason)
+
+			var restartErr error
+			if c.restarts >= MaxRestarts {
+				restartErr = fmt.Errorf("container crashed %d times", c.restarts)
+			} else {
+				c.restarts++
+				c.stderr = new(stderrTail)
+				mu.Unlock()
+				restartErr = startContainer(uuid, c)
+				mu.Lock()
+			}
+			if restartErr != nil {
+				log.Printf("[machine] not restarting container %s: %v", uuid, restartErr)
+				delete(containers, uuid)
+				releaseResources(c)
+				mu.Unlock()
+				reportExit(uuid, c, reason, false)
+				close(c.done)
+				return
+			}
+			log.Printf("[machine] container %s restarted on port %d", uuid, c.port)
+			if c.stopping {
+				// de-allocated while we were restarting it, so stop the new process
+				// the next iteration sees that it is stopping once it exits
+				c.stdin.Close()
+			}
+			mu.Unlock()
+			reportExit(uuid, c, reason, true)
+		}
+	}
+
 	http.HandleFunc("/allocate", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(404)
@@ -82,58 +484,91 @@ func main() {
 			return
 		}
 
+		// build the image before taking the lock since it may take a while
+		var image string
+		if request.Image != "" {
+			var err error
+			image, err = prepareImage(request.Image)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
 		uuid := gouuid.New().String()
-		cmd := exec.Command("./container", uuid, coordinatorURL)
+		c := &Cmd{
+			stderr: new(stderrTail),
+			done: make(chan bool),
+		}
 
 		// assign GPUs if needed
-		var gpuIndexes []int
+		mu.Lock()
+		var cudaStr string
 		if request.Requirements["gpu"] > 0 {
-			var cudaStr string
 			var err error
-			gpuIndexes, cudaStr, err = getGPUs(request.Requirements["gpu"])
+			c.gpuIndexes, cudaStr, err = getGPUs(request.Requirements["gpu"])
 			if err != nil {
+				mu.Unlock()
 				http.Error(w, err.Error(), 400)
 				return
 			}
-			for _, env := range os.Environ() {
-				if !strings.Contains(env, "CUDA_VISIBLE_DEVICES") {
-					cmd.Env = append(cmd.Env, env)
-				}
-			}
-			cmd.Env = append(cmd.Env, cudaStr)
 		}
-
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			panic(err)
+		for _, env := range os.Environ() {
+			if cudaStr != "" && strings.Contains(env, "CUDA_VISIBLE_DEVICES") {
+				continue
+			}
+			c.env = append(c.env, env)
 		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			panic(err)
+		if cudaStr != "" {
+			c.env = append(c.env, cudaStr)
 		}
-		cmd.Stderr = os.Stderr
-		if err := cmd.Start(); err != nil {
-			panic(err)
+		// pass the secret through the environment rather than the command-line
+		if vaas.AuthSecret() != "" {
+			c.env = append(c.env, vaas.AuthSecretEnv + "=" + vaas.AuthSecret())
 		}
-		log.Printf("[machine] container %s started (gpus=%v)", uuid, gpuIndexes)
-		mu.Lock()
-		containers[uuid] = Cmd{
-			cmd: cmd,
-			stdin: stdin,
-			gpuIndexes: gpuIndexes,
+
+		// leave half of the memory limit for the executors themselves
+		c.bufferBudget = request.Requirements["memory"]/2
+
+		// limit memory and cpu usage if the environment requires them
+		// Docker applies the limits itself
+		c.image = image
+		c.requirements = request.Requirements
+		if c.image == "" && (request.Requirements["memory"] > 0 || request.Requirements["cpu"] > 0) {
+			var err error
+			c.cgroup, err = createCgroup(uuid, request.Requirements)
+			if err != nil {
+				log.Printf("[machine] warning: could not create cgroup for container %s: %v", uuid, err)
+				// CUDA reserves a lot of virtual memory, so a ulimit would break GPU containers
+				if request.Requirements["memory"] > 0 && request.Requirements["gpu"] == 0 {
+					log.Printf("[machine] ... falling back to ulimit on virtual memory")
+					c.ulimitKB = request.Requirements["memory"]*1024
+				} else {
+					log.Printf("[machine] ... container %s will run without resource limits", uuid)
+				}
+			}
 		}
+
 		mu.Unlock()
 
-		rd := bufio.NewReader(stdout)
-		line, err := rd.ReadString('\n')
-		if err != nil {
-			panic(err)
+		// the GPUs are reserved, so we can start the container without the lock
+		if err := startContainer(uuid, c); err != nil {
+			mu.Lock()
+			releaseResources(c)
+			mu.Unlock()
+			http.Error(w, fmt.Sprintf("error starting container: %v", err), 500)
+			return
 		}
-		port := vaas.ParseInt(strings.TrimSpace(line))
+		mu.Lock()
+		log.Printf("[machine] container %s started (gpus=%v cgroup=%s)", uuid, c.gpuIndexes, c.cgroup)
+		containers[uuid] = c
+		mu.Unlock()
+
+		go monitorContainer(uuid, c)
 
 		vaas.JsonResponse(w, vaas.Container{
 			UUID: uuid,
-			BaseURL: fmt.Sprintf("http://%s:%d", myIP, port),
+			BaseURL: fmt.Sprintf("http://%s:%d", myIP, c.port),
 		})
 	})
 
@@ -145,17 +580,20 @@ func main() {
 		r.ParseForm()
 		uuid := r.Form.Get("uuid")
 		mu.Lock()
-		cmd, ok := containers[uuid]
+		c, ok := containers[uuid]
 		if ok {
-			cmd.stdin.Close()
-			cmd.cmd.Wait()
-			delete(containers, uuid)
-			for _, gpuIdx := range cmd.gpuIndexes {
-				log.Printf("[machine] ... release GPU idx=%d gpu=%s", gpuIdx, gpulist[gpuIdx])
-				gpusInUse[gpuIdx] = false
-			}
+			c.stopping = true
+			c.stdin.Close()
 		}
 		mu.Unlock()
+		if ok {
+			// monitorContainer closes done once the process exits
+			<- c.done
+			mu.Lock()
+			delete(containers, uuid)
+			releaseResources(c)
+			mu.Unlock()
+		}
 		log.Printf("[machine] container %s stopped", uuid)
 	})
 
@@ -165,15 +603,21 @@ func main() {
 		Resources: map[string]int{
 			"gpu": len(gpulist),
 			"container": runtime.NumCPU() / 4,
+			"cpu": runtime.NumCPU(),
 		},
 	}
+	if memory := totalMemoryMB(); memory > 0 {
+		machine.Resources["memory"] = memory
+	} else {
+		log.Printf("[machine] warning: total memory is unknown, memory requirements will not be enforced")
+	}
 	err := vaas.JsonPost(coordinatorURL, "/register-machine", machine, nil)
 	if err != nil {
 		panic(err)
 	}
 
 	log.Printf("starting on :%d", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), vaas.RequireAuth(http.DefaultServeMux.ServeHTTP)); err != nil {
 		panic(err)
 	}
 }
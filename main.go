@@ -8,11 +8,21 @@ import (
 
 	"github.com/googollee/go-socket.io"
 
+	"flag"
 	"log"
 	"net/http"
 )
 
 func main() {
+	secret := vaas.AuthFlag()
+	inProcess := flag.Bool("inprocess", false, "run executors in the coordinator process instead of on machines")
+	flag.Parse()
+	vaas.SetupAuth(*secret)
+	app.LoadPlugins()
+	if *inProcess {
+		app.UseLocalAllocator()
+	}
+
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	vaas.SeedRand()
 	server, err := socketio.NewServer(nil)
@@ -7,6 +7,7 @@ import os.path
 import skimage.io
 import struct
 import sys
+import traceback
 
 def eprint(s):
 	sys.stderr.write(str(s) + "\n")
@@ -93,6 +94,10 @@ def all_decorate(f):
 			output_packet(job_desc['slice_idx'], (0, len(all_inputs[0])), outputs)
 	return wrap
 
+# The executor protocol is documented in vaas/exec_protocol.go.
+PROTOCOL_VERSION = 1
+CONTROL_SLICE = 0xFFFFFFFF
+
 stdin = None
 stdout = None
 meta = None
@@ -130,6 +135,15 @@ def output_packet(slice_idx, frame_range, data):
 	stdout.write(encoded_data)
 	stdout.flush()
 
+# Tell the executor that the slice failed.
+# The executor recognizes these packets by the range.
+ERROR_MARKER = 0xFFFFFFFF
+def error_packet(slice_idx, s):
+	encoded_data = s.encode('utf-8')
+	stdout.write(struct.pack('>IIII', slice_idx, ERROR_MARKER, ERROR_MARKER, len(encoded_data)))
+	stdout.write(encoded_data)
+	stdout.flush()
+
 def run(callback_func):
 	global stdin, stdout, meta
 
@@ -140,8 +154,18 @@ def run(callback_func):
 		stdin = sys.stdin
 		stdout = sys.stdout
 	meta = input_packet()
+	# reply with our version even if it doesn't match, so the executor can report the mismatch
+	encoded_data = json.dumps({'Version': PROTOCOL_VERSION}).encode('utf-8')
+	stdout.write(struct.pack('>IIII', CONTROL_SLICE, 0, 0, len(encoded_data)))
+	stdout.write(encoded_data)
+	stdout.flush()
+	if meta.get('Version', 0) != PROTOCOL_VERSION:
+		return
 
 	states = {}
+	# slices where the callback raised an exception
+	# we skip their remaining jobs, and the executor already failed them
+	failed = set()
 	while True:
 		packet = input_packet()
 		if packet is None:
@@ -151,23 +175,39 @@ def run(callback_func):
 		elif packet['Type'] == 'job':
 			# job packet
 			slice_idx = packet['SliceIdx']
+			parents = [input_packet() for _ in range(meta['Parents'])]
+			if slice_idx in failed:
+				continue
 			inputs = [{
 				'type': 'job',
 				'range': packet['Range'],
 				'slice_idx': slice_idx,
 				'state': states[slice_idx],
 			}]
-			for _ in range(meta['Parents']):
-				inputs.append(input_packet())
-			states[slice_idx] = callback_func(*inputs)
+			inputs.extend(parents)
+			try:
+				states[slice_idx] = callback_func(*inputs)
+			except Exception:
+				error_packet(slice_idx, traceback.format_exc())
+				failed.add(slice_idx)
+				del states[slice_idx]
 		elif packet['Type'] == 'finish':
+			slice_idx = packet['ID']
+			if slice_idx in failed:
+				failed.remove(slice_idx)
+				continue
 			inputs = [{
 				'type': 'finish',
-				'slice_idx': packet['ID'],
-				'state': states[packet['ID']],
+				'slice_idx': slice_idx,
+				'state': states[slice_idx],
 			}]
 			inputs.extend([None]*meta['Parents'])
-			callback_func(*inputs)
-			del states[packet['ID']]
-			stdout.write(struct.pack('>IIII', packet['ID'], 0, 0, 0))
+			try:
+				callback_func(*inputs)
+			except Exception:
+				error_packet(slice_idx, traceback.format_exc())
+				del states[slice_idx]
+				continue
+			del states[slice_idx]
+			stdout.write(struct.pack('>IIII', slice_idx, 0, 0, 0))
 			stdout.flush()
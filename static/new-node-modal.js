@@ -39,6 +39,12 @@ Vue.component('new-node-modal', {
 							DataType: "track",
 							Parents: ["detection"],
 						},
+						{
+							ID: "model-server",
+							Name: "Model Server",
+							Description: "Model behind an HTTP inference server (detection, int, or float output)",
+							Parents: ["video"],
+						},
 					],
 				},
 				{
@@ -59,6 +65,13 @@ Vue.component('new-node-modal', {
 							DataType: "track",
 							Parents: ["track"],
 						},
+						{
+							ID: "filter-speed",
+							Name: "Speed Filter",
+							Description: "Filter Tracks based on Ground Speed",
+							DataType: "track",
+							Parents: ["track"],
+						},
 					],
 				},
 				{
@@ -72,6 +85,59 @@ Vue.component('new-node-modal', {
 							DataType: "track",
 							Parents: ["detection"],
 						},
+						{
+							ID: "sort",
+							Name: "SORT",
+							Description: "Kalman Filter Multi-Object Tracker",
+							DataType: "track",
+							Parents: ["detection"],
+						},
+						{
+							ID: "track-cleanup",
+							Name: "Track Cleanup",
+							Description: "Interpolate, Smooth and Join Tracks",
+							DataType: "track",
+							Parents: ["track"],
+						},
+						{
+							ID: "line-crossing",
+							Name: "Line Crossing",
+							Description: "Detect Tracks Crossing Directed Lines",
+							DataType: "detection",
+							Parents: ["track"],
+						},
+						{
+							ID: "line-count",
+							Name: "Line Count",
+							Description: "Count Line Crossings",
+							DataType: "int",
+							Parents: ["detection"],
+						},
+						{
+							ID: "zone-occupancy",
+							Name: "Zone Occupancy",
+							Description: "Count Objects in Zones (int or string output)",
+						},
+						{
+							ID: "zone-dwell",
+							Name: "Zone Dwell Time",
+							Description: "Entry, Exit and Dwell Time of Tracks in Zones",
+							DataType: "string",
+							Parents: ["track"],
+						},
+						{
+							ID: "track-speed",
+							Name: "Track Speed",
+							Description: "Speed, Heading and Distance of Tracks",
+							DataType: "float",
+							Parents: ["track"],
+						},
+						{
+							ID: "motion",
+							Name: "Motion Detection",
+							Description: "Frame Differencing Motion Score (float output) or Selector (int output)",
+							Parents: ["video"],
+						},
 					],
 				},
 				{
@@ -103,6 +169,11 @@ Vue.component('new-node-modal', {
 							Name: "Python",
 							Description: "Python function",
 						},
+						{
+							ID: "subprocess",
+							Name: "Subprocess",
+							Description: "Executable speaking the executor protocol",
+						},
 					],
 				},
 				{
@@ -117,8 +188,12 @@ Vue.component('new-node-modal', {
 						{
 							ID: "bool-expr",
 							Name: "Boolean Expression",
-							Description: "Boolean Expression (AND, OR)",
-							DataType: "int",
+							Description: "Boolean or Arithmetic Expression over Parents (int or float output)",
+						},
+						{
+							ID: "temporal-pattern",
+							Name: "Temporal Pattern",
+							Description: "Match a Sequence of Events with Time Constraints (int or text output)",
 						},
 					],
 				},
@@ -216,6 +291,7 @@ Vue.component('new-node-modal', {
 									<option value="imlist">Image List</option>
 									<option value="text">Text</option>
 									<option value="float">Float</option>
+									<option value="string">String</option>
 								</select>
 								<small class="form-text text-muted">
 									The type of data that this node will output.
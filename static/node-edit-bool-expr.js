@@ -1,17 +1,22 @@
 Vue.component('node-edit-bool-expr', {
 	data: function() {
 		return {
+			expr: '',
 		};
 	},
 	props: ['initNode'],
 	created: function() {
 		try {
 			var s = JSON.parse(this.initNode.Code);
+			if(s.Expr) {
+				this.expr = s.Expr;
+			}
 		} catch(e) {}
 	},
 	methods: {
 		save: function() {
 			var code = JSON.stringify({
+				Expr: this.expr,
 			});
 			myCall('POST', '/queries/node?id='+this.initNode.ID, {
 				code: code,
@@ -21,11 +26,28 @@ Vue.component('node-edit-bool-expr', {
 	template: `
 <div class="small-container m-2">
 	<p>
-		You ought to be able to at least select between AND and OR here.
-		Currently, though, this node always spits out the logical AND of all of its parents.
-		Parents can be any data type, and each data type has its own semantics on truthiness (e.g. at least one detection, non-zero integer, etc.).
+		The expression is evaluated on every frame.
+		With int output, true is 1 and false is 0; with float output, arithmetic results are output as-is.
+		If the expression is empty, this node outputs the logical AND of all of its parents.
 	</p>
-	<p>Parents are evaluated from left to right. So add the fast, selective nodes as parents first.</p>
+	<p>
+		Parents are referenced by position as <code>p0</code>, <code>p1</code>, and so on.
+		Detection and track parents evaluate to the number of detections in the frame, int and float parents to their value, and string and text parents to 1 if non-empty.
+	</p>
+	<ul>
+		<li>Operators: <code>and</code>, <code>or</code>, <code>not</code>, <code>== != &lt; &lt;= &gt; &gt;=</code>, <code>+ - * / %</code></li>
+		<li><code>count(p0, "car")</code>: number of detections in p0 with class car</li>
+		<li><code>any_in_last(x, n)</code>: true if x was true in any of the last n frames</li>
+		<li><code>sum_over(x, n)</code>: sum of x over the last n frames</li>
+		<li><code>abs(x)</code>, <code>min(x, y)</code>, <code>max(x, y)</code></li>
+	</ul>
+	<p>Example: <code>count(p0, "car") &gt;= 2 and any_in_last(p1 &gt; 0.5, 50)</code></p>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Expression</label>
+		<div class="col-sm-10">
+			<textarea v-model="expr" class="form-control" rows="3"></textarea>
+		</div>
+	</div>
 	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
 </div>
 	`,
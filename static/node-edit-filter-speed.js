@@ -0,0 +1,71 @@
+Vue.component('node-edit-filter-speed', {
+	data: function() {
+		return {
+			minSpeed: 0,
+			maxSpeed: 0,
+			mode: 'max',
+			window: 10,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.minSpeed = s.MinSpeed;
+			this.maxSpeed = s.MaxSpeed;
+			this.mode = s.Mode;
+			this.window = s.Window;
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				MinSpeed: parseFloat(this.minSpeed),
+				MaxSpeed: parseFloat(this.maxSpeed),
+				Mode: this.mode,
+				Window: parseInt(this.window),
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a track parent, and only outputs the tracks whose speed is in the range below. The timeline must be calibrated (see the timeline's Calibration section).</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Min Speed</label>
+		<div class="col-sm-10">
+			<input v-model="minSpeed" type="text" class="form-control">
+			<small class="form-text text-muted">In km/h.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Max Speed</label>
+		<div class="col-sm-10">
+			<input v-model="maxSpeed" type="text" class="form-control">
+			<small class="form-text text-muted">In km/h, or 0 for no maximum.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Speed</label>
+		<div class="col-sm-10">
+			<select v-model="mode" class="form-control">
+				<option value="max">Fastest speed of the track</option>
+				<option value="mean">Average speed of the track</option>
+			</select>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Window</label>
+		<div class="col-sm-10">
+			<input v-model="window" type="text" class="form-control">
+			<small class="form-text text-muted">Number of frames over which the fastest speed is measured.</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
@@ -0,0 +1,52 @@
+Vue.component('node-edit-line-count', {
+	data: function() {
+		return {
+			line: '',
+			direction: '',
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.line = s.Line;
+			this.direction = s.Direction;
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				Line: this.line,
+				Direction: this.direction,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a Line Crossing parent, and outputs the number of crossings so far in the clip on each frame.</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Line</label>
+		<div class="col-sm-10">
+			<input v-model="line" type="text" class="form-control">
+			<small class="form-text text-muted">Name of the line to count. Leave empty to count crossings of all lines.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Direction</label>
+		<div class="col-sm-10">
+			<select v-model="direction" class="form-control">
+				<option value="">Both</option>
+				<option value="forward">Forward</option>
+				<option value="backward">Backward</option>
+			</select>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
@@ -0,0 +1,113 @@
+Vue.component('node-edit-line-crossing', {
+	data: function() {
+		return {
+			canvasDims: [0, 0],
+			lines: [],
+			dataSeries: [],
+			selectedSeries: null,
+			newName: '',
+			drawing: false,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.canvasDims = s.CanvasDims;
+			if(s.Lines) {
+				this.lines = s.Lines;
+			}
+		} catch(e) {}
+		myCall('GET', '/datasets', null, (dataSeries) => {
+			this.dataSeries = dataSeries;
+		});
+	},
+	methods: {
+		addLine: function() {
+			this.drawing = true;
+		},
+		removeLine: function(i) {
+			this.lines.splice(i, 1);
+			this.drawing = false;
+		},
+		onDraw: function(e) {
+			this.canvasDims = e.dims;
+			var name = this.newName;
+			if(!name) {
+				name = 'line' + (this.lines.length+1);
+			}
+			this.lines.push({
+				Name: name,
+				Points: e.points,
+			});
+			this.newName = '';
+			this.drawing = false;
+		},
+		save: function() {
+			var code = JSON.stringify({
+				CanvasDims: [parseFloat(this.canvasDims[0]), parseFloat(this.canvasDims[1])],
+				Lines: this.lines,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="m-2 container">
+	<p>This node requires a track parent, and outputs a detection for each time a track crosses one of the lines below, on the frame where it crosses. The class of the detection is the line name followed by the direction, e.g. "stopline:forward". A track crosses a line forward if it moves from the left-hand side to the right-hand side of the line, as seen when walking from the start of the line to the end (the arrow head). Use a Line Count node to get the number of crossings.</p>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Canvas Width</label>
+		<div class="col-sm-10">
+			<input v-model="canvasDims[0]" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Canvas Height</label>
+		<div class="col-sm-10">
+			<input v-model="canvasDims[1]" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-4 col-form-label">Dataset</label>
+		<div class="col-sm-8">
+			<select v-model="selectedSeries" class="form-control mx-2">
+				<option v-for="ds in dataSeries" :value="ds.ID">{{ ds.Name }}</option>
+			</select>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-4 col-form-label">Lines</label>
+		<div class="col-sm-8">
+			<table class="table table-sm table-borderless">
+				<tbody>
+					<tr v-for="(line, i) in lines">
+						<td><input v-model="line.Name" type="text" class="form-control form-control-sm"></td>
+						<td>{{ line.Points }}</td>
+						<td><button type="button" class="btn btn-danger btn-sm" v-on:click="removeLine(i)">Remove</button></td>
+					</tr>
+					<tr>
+						<td><input v-model="newName" type="text" class="form-control form-control-sm" placeholder="Name"></td>
+						<td></td>
+						<td>
+							<button type="button" class="btn btn-primary btn-sm" v-on:click="addLine" :disabled="selectedSeries == null">Add Line</button>
+						</td>
+					</tr>
+				</tbody>
+			</table>
+			<div
+				v-if="drawing && selectedSeries != null"
+				class="bordered-div p-2 m-2"
+				>
+				<util-video-draw-shape
+					v-bind:series_id="selectedSeries"
+					fixedOptions="line"
+					v-on:draw="onDraw($event)">
+				</util-video-draw-shape>
+			</div>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
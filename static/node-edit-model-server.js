@@ -0,0 +1,136 @@
+Vue.component('node-edit-model-server', {
+	data: function() {
+		return {
+			url: '',
+			format: 'jpeg',
+			headers: '{}',
+			inputWidth: '',
+			inputHeight: '',
+			batchSize: 1,
+			concurrency: 1,
+			retries: 0,
+			timeout: 60,
+			response: '{}',
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.url = s.URL;
+			this.format = s.Format;
+			this.headers = JSON.stringify(s.Headers || {});
+			if(s.InputSize && s.InputSize[0] > 0) {
+				this.inputWidth = s.InputSize[0];
+				this.inputHeight = s.InputSize[1];
+			}
+			this.batchSize = s.BatchSize;
+			this.concurrency = s.Concurrency;
+			this.retries = s.Retries;
+			this.timeout = s.Timeout;
+			this.response = JSON.stringify(s.Response, null, 2);
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var headers, response;
+			try {
+				headers = JSON.parse(this.headers);
+				response = JSON.parse(this.response);
+			} catch(e) {
+				alert('invalid JSON: ' + e);
+				return;
+			}
+			var code = JSON.stringify({
+				URL: this.url,
+				Format: this.format,
+				Headers: headers,
+				InputSize: [parseInt(this.inputWidth) || 0, parseInt(this.inputHeight) || 0],
+				BatchSize: parseInt(this.batchSize),
+				Concurrency: parseInt(this.concurrency),
+				Retries: parseInt(this.retries),
+				Timeout: parseInt(this.timeout),
+				Response: response,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<p>This node sends video frames from its parent to an HTTP inference server, and maps the JSON responses to detections, integers, or floats.</p>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">URL</label>
+		<div class="col-sm-9">
+			<input v-model="url" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Request Format</label>
+		<div class="col-sm-9">
+			<select v-model="format" class="form-control">
+				<option value="jpeg">JPEG frames</option>
+				<option value="rgb">Raw RGB batch</option>
+			</select>
+			<small class="form-text text-muted">JPEG frames are sent as <code>{"images": [base64, ...]}</code>. Raw RGB batches are sent as bytes, with the X-Frames, X-Height, and X-Width headers.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Headers</label>
+		<div class="col-sm-9">
+			<input v-model="headers" type="text" class="form-control">
+			<small class="form-text text-muted">Extra headers as JSON, e.g. <code>{"Authorization": "Bearer ..."}</code>.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Input Size</label>
+		<div class="col-sm-4">
+			<input v-model="inputWidth" type="text" class="form-control" placeholder="width">
+		</div>
+		<div class="col-sm-5">
+			<input v-model="inputHeight" type="text" class="form-control" placeholder="height">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Batch Size</label>
+		<div class="col-sm-9">
+			<input v-model="batchSize" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Concurrency</label>
+		<div class="col-sm-9">
+			<input v-model="concurrency" type="text" class="form-control">
+			<small class="form-text text-muted">Maximum concurrent requests from each container.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Retries</label>
+		<div class="col-sm-9">
+			<input v-model="retries" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Timeout</label>
+		<div class="col-sm-9">
+			<input v-model="timeout" type="text" class="form-control">
+			<small class="form-text text-muted">Request timeout in seconds.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-3 col-form-label">Response Mapping</label>
+		<div class="col-sm-9">
+			<textarea v-model="response" class="form-control" rows="8"></textarea>
+			<small class="form-text text-muted">
+				JSON with dot-separated paths into the response.
+				<code>Frames</code> is the list with one element per frame.
+				For detections: <code>Detections</code>, <code>Box</code> (or <code>Left</code>, <code>Top</code>, <code>Right</code>, <code>Bottom</code>), <code>Score</code>, <code>Class</code>, and <code>Normalized</code>.
+				For integers and floats: <code>Value</code>, and <code>Labels</code> to map string labels to integers.
+			</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
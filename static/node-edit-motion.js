@@ -0,0 +1,91 @@
+Vue.component('node-edit-motion', {
+	data: function() {
+		return {
+			width: 160,
+			height: 90,
+			mode: 'diff',
+			alpha: 0.05,
+			pixelThreshold: 25,
+			threshold: 0.01,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.width = s.Width;
+			this.height = s.Height;
+			this.mode = s.Mode;
+			this.alpha = s.Alpha;
+			this.pixelThreshold = s.PixelThreshold;
+			this.threshold = s.Threshold;
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				Width: parseInt(this.width),
+				Height: parseInt(this.height),
+				Mode: this.mode,
+				Alpha: parseFloat(this.alpha),
+				PixelThreshold: parseFloat(this.pixelThreshold),
+				Threshold: parseFloat(this.threshold),
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a video parent, and computes the fraction of pixels that are moving in each frame.</p>
+		<p>With float output, it outputs the fraction. With int output, it outputs 1 on frames where the fraction is at least the threshold below, so it can be used as a query selector. Object detectors and classifiers downstream of the selector then only run on the selected frames, and output nothing on the other frames.</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Width</label>
+		<div class="col-sm-10">
+			<input v-model="width" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Height</label>
+		<div class="col-sm-10">
+			<input v-model="height" type="text" class="form-control">
+			<small class="form-text text-muted">Frames are downscaled to these dimensions before computing motion.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Mode</label>
+		<div class="col-sm-10">
+			<select v-model="mode" class="form-control">
+				<option value="diff">Difference from the previous frame</option>
+				<option value="background">Difference from a running average background</option>
+			</select>
+		</div>
+	</div>
+	<div v-if="mode == 'background'" class="form-group row">
+		<label class="col-sm-2 col-form-label">Alpha</label>
+		<div class="col-sm-10">
+			<input v-model="alpha" type="text" class="form-control">
+			<small class="form-text text-muted">Weight of each new frame in the running average. Lower values adapt to lighting changes more slowly.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Pixel Threshold</label>
+		<div class="col-sm-10">
+			<input v-model="pixelThreshold" type="text" class="form-control">
+			<small class="form-text text-muted">A pixel is moving if its grayscale value (0-255) changes by more than this.</small>
+		</div>
+	</div>
+	<div v-if="initNode.DataType == 'int'" class="form-group row">
+		<label class="col-sm-2 col-form-label">Threshold</label>
+		<div class="col-sm-10">
+			<input v-model="threshold" type="text" class="form-control">
+			<small class="form-text text-muted">Fraction of moving pixels (0-1) needed to output 1.</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
@@ -0,0 +1,77 @@
+Vue.component('node-edit-sort', {
+	data: function() {
+		return {
+			maxAge: 5,
+			minHits: 3,
+			iouThreshold: 0.3,
+			maxDistance: 0,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			if(s.maxAge) {
+				this.maxAge = s.maxAge;
+			}
+			if(s.minHits) {
+				this.minHits = s.minHits;
+			}
+			if(s.iouThreshold) {
+				this.iouThreshold = s.iouThreshold;
+			}
+			if(s.maxDistance) {
+				this.maxDistance = s.maxDistance;
+			}
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				maxAge: parseInt(this.maxAge),
+				minHits: parseInt(this.minHits),
+				iouThreshold: parseFloat(this.iouThreshold),
+				maxDistance: parseFloat(this.maxDistance),
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a detection parent, and produces tracks. Each track follows a constant-velocity Kalman filter, and detections are assigned to the predicted track positions by bounding box overlap, so tracks survive short gaps in the detections.</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Max Age</label>
+		<div class="col-sm-10">
+			<input v-model="maxAge" type="text" class="form-control">
+			<small class="form-text text-muted">Number of frames without a matching detection until track is considered dead.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Min Hits</label>
+		<div class="col-sm-10">
+			<input v-model="minHits" type="text" class="form-control">
+			<small class="form-text text-muted">Number of matched detections before a new track is output.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">IoU Threshold</label>
+		<div class="col-sm-10">
+			<input v-model="iouThreshold" type="text" class="form-control">
+			<small class="form-text text-muted">Minimum overlap between a detection and the predicted track position to match them.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Max Distance</label>
+		<div class="col-sm-10">
+			<input v-model="maxDistance" type="text" class="form-control">
+			<small class="form-text text-muted">If positive, detections that do not overlap may still match a track if their centers are within this many pixels of the prediction.</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
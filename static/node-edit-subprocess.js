@@ -0,0 +1,78 @@
+Vue.component('node-edit-subprocess', {
+	data: function() {
+		return {
+			command: '',
+			args: '',
+			workers: 1,
+			timeout: '',
+			image: '',
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.command = s.Command;
+			this.args = (s.Args || []).join(' ');
+			this.workers = s.Workers;
+			this.timeout = s.Timeout ? s.Timeout : '';
+			this.image = s.Image ? s.Image : '';
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var args = this.args.split(' ').filter((arg) => arg != '');
+			var code = JSON.stringify({
+				Command: this.command,
+				Args: args,
+				Workers: parseInt(this.workers),
+				Timeout: this.timeout ? parseInt(this.timeout) : 0,
+				Image: this.image,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<p>This node runs an executable that reads its inputs from stdin and writes its outputs to stdout using the executor protocol (see vaas/exec_protocol.go).</p>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Command</label>
+		<div class="col-sm-10">
+			<input v-model="command" type="text" class="form-control">
+			<small class="form-text text-muted">Executable in the PATH or relative to the container working directory.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Arguments</label>
+		<div class="col-sm-10">
+			<input v-model="args" type="text" class="form-control">
+			<small class="form-text text-muted">Space-separated arguments.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Workers</label>
+		<div class="col-sm-10">
+			<input v-model="workers" type="text" class="form-control">
+			<small class="form-text text-muted">Number of processes to run in each container.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Timeout</label>
+		<div class="col-sm-10">
+			<input v-model="timeout" type="text" class="form-control">
+			<small class="form-text text-muted">Seconds before a slice fails (optional).</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Image</label>
+		<div class="col-sm-10">
+			<input v-model="image" type="text" class="form-control">
+			<small class="form-text text-muted">Docker image, or directory with a Dockerfile, to run this node in its own container (optional).</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
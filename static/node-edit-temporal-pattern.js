@@ -0,0 +1,90 @@
+Vue.component('node-edit-temporal-pattern', {
+	data: function() {
+		return {
+			steps: [],
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			if(s.Steps) {
+				this.steps = s.Steps;
+			}
+		} catch(e) {}
+		if(this.steps.length == 0) {
+			this.addStep();
+		}
+	},
+	methods: {
+		addStep: function() {
+			this.steps.push({
+				Name: '',
+				Expr: '',
+				Rising: true,
+				Within: 0,
+			});
+		},
+		removeStep: function(i) {
+			this.steps.splice(i, 1);
+		},
+		save: function() {
+			var steps = this.steps.map((step) => {
+				return {
+					Name: step.Name,
+					Expr: step.Expr,
+					Rising: step.Rising,
+					Within: parseFloat(step.Within),
+				};
+			});
+			var code = JSON.stringify({
+				Steps: steps,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<p>
+		This node matches an ordered sequence of steps, e.g. a person enters zone A (<code>count(p0, "person") &gt; 0</code>), then within 10 seconds a car enters zone B (<code>count(p1, "car") &gt; 0</code>).
+		Each step is an expression over the parents, with the same syntax as the Boolean Expression node.
+		Each step must match on a later frame than the previous step.
+	</p>
+	<p>With int output, the node outputs 1 from the first to the last step of each match. With text output, it outputs a description of the match on those frames.</p>
+	<table class="table">
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Expression</th>
+				<th>Rising Edge</th>
+				<th>Within (seconds)</th>
+				<th></th>
+			</tr>
+		</thead>
+		<tbody>
+			<tr v-for="(step, i) in steps">
+				<td><input v-model="step.Name" type="text" class="form-control"></td>
+				<td><input v-model="step.Expr" type="text" class="form-control"></td>
+				<td><input v-model="step.Rising" type="checkbox"></td>
+				<td>
+					<input v-if="i > 0" v-model="step.Within" type="text" class="form-control">
+				</td>
+				<td>
+					<button type="button" class="btn btn-danger btn-sm" v-on:click="removeStep(i)">Remove</button>
+				</td>
+			</tr>
+		</tbody>
+	</table>
+	<p>
+		<small class="form-text text-muted">
+			Rising Edge: only match on the frame where the expression becomes true, rather than on every frame where it is true.
+			Within: the step must match within this many seconds after the previous step, or 0 for no limit.
+		</small>
+	</p>
+	<button v-on:click="addStep" type="button" class="btn btn-secondary">Add Step</button>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
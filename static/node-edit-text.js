@@ -58,6 +58,7 @@ Vue.component('node-edit-text', {
 <div id="n-edit-text-div">
 	<div id="n-edit-text-code-div">
 		<textarea v-model="node.Code" v-on:keydown="autoindent($event)" id="n-edit-text-code" placeholder="Your Code Here"></textarea>
+		<small class="form-text text-muted">Declare extra packages with lines like <code># require: shapely==1.7.0</code>. They are installed from the wheels directory on each machine. Run several Python processes with a line like <code># workers: 4</code>, and fail slices that take longer than some seconds with <code># timeout: 600</code>.</small>
 	</div>
 	<div class="m-1">
 		<button v-on:click="save" type="button" class="btn btn-primary btn-sm" id="n-edit-text-save">Save</button>
@@ -0,0 +1,79 @@
+Vue.component('node-edit-track-cleanup', {
+	data: function() {
+		return {
+			maxGap: 10,
+			smoothWindow: 5,
+			joinFrames: 30,
+			joinDistance: 50,
+			minLength: 10,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.maxGap = s.maxGap;
+			this.smoothWindow = s.smoothWindow;
+			this.joinFrames = s.joinFrames;
+			this.joinDistance = s.joinDistance;
+			this.minLength = s.minLength;
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				maxGap: parseInt(this.maxGap),
+				smoothWindow: parseInt(this.smoothWindow),
+				joinFrames: parseInt(this.joinFrames),
+				joinDistance: parseFloat(this.joinDistance),
+				minLength: parseInt(this.minLength),
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a track parent, and produces cleaned-up tracks. Track fragments are joined, missing frames are filled by interpolation, boxes are smoothed, and short tracks are dropped. All frame counts refer to frames of the original video, regardless of the sampling frequency of the input. Set a value to 0 to disable that step.</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Max Gap</label>
+		<div class="col-sm-10">
+			<input v-model="maxGap" type="text" class="form-control">
+			<small class="form-text text-muted">Gaps of up to this many missing frames within a track are filled by interpolation.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Smoothing Window</label>
+		<div class="col-sm-10">
+			<input v-model="smoothWindow" type="text" class="form-control">
+			<small class="form-text text-muted">Width, in frames, of the moving average applied to the boxes.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Join Frames</label>
+		<div class="col-sm-10">
+			<input v-model="joinFrames" type="text" class="form-control">
+			<small class="form-text text-muted">A track that starts at most this many frames after another ends may be joined with it.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Join Distance</label>
+		<div class="col-sm-10">
+			<input v-model="joinDistance" type="text" class="form-control">
+			<small class="form-text text-muted">Maximum distance, in pixels, between the start of the later track and the extrapolated position of the earlier one.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Min Length</label>
+		<div class="col-sm-10">
+			<input v-model="minLength" type="text" class="form-control">
+			<small class="form-text text-muted">Tracks spanning fewer frames than this are dropped.</small>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
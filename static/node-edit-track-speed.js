@@ -0,0 +1,66 @@
+Vue.component('node-edit-track-speed', {
+	data: function() {
+		return {
+			metric: 'speed',
+			window: 10,
+			aggregate: 'max',
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.metric = s.Metric;
+			this.window = s.Window;
+			this.aggregate = s.Aggregate;
+		} catch(e) {}
+	},
+	methods: {
+		save: function() {
+			var code = JSON.stringify({
+				Metric: this.metric,
+				Window: parseInt(this.window),
+				Aggregate: this.aggregate,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="small-container m-2">
+	<div>
+		<p>This node requires a track parent, and measures the motion of each track on the ground plane. The timeline must be calibrated (see the timeline's Calibration section).</p>
+		<p>The output is the metric aggregated over the tracks in each frame.</p>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Metric</label>
+		<div class="col-sm-10">
+			<select v-model="metric" class="form-control">
+				<option value="speed">Speed (km/h)</option>
+				<option value="heading">Heading (degrees)</option>
+				<option value="distance">Distance Travelled (m)</option>
+			</select>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Window</label>
+		<div class="col-sm-10">
+			<input v-model="window" type="text" class="form-control">
+			<small class="form-text text-muted">Number of frames over which speed and heading are measured. Longer windows reduce noise from jittery boxes.</small>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Aggregate</label>
+		<div class="col-sm-10">
+			<select v-model="aggregate" class="form-control">
+				<option value="max">Maximum</option>
+				<option value="min">Minimum</option>
+				<option value="mean">Mean</option>
+			</select>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+});
@@ -0,0 +1,141 @@
+// Editor for zone-occupancy and zone-dwell nodes, which share the zone configuration.
+var nodeEditZones = {
+	data: function() {
+		return {
+			canvasDims: [0, 0],
+			zones: [],
+			zone: '',
+			dataSeries: [],
+			selectedSeries: null,
+			newName: '',
+			drawing: false,
+		};
+	},
+	props: ['initNode'],
+	created: function() {
+		try {
+			var s = JSON.parse(this.initNode.Code);
+			this.canvasDims = s.CanvasDims;
+			if(s.Zones) {
+				this.zones = s.Zones;
+			}
+			if(s.Zone) {
+				this.zone = s.Zone;
+			}
+		} catch(e) {}
+		myCall('GET', '/datasets', null, (dataSeries) => {
+			this.dataSeries = dataSeries;
+		});
+	},
+	methods: {
+		addZone: function() {
+			this.drawing = true;
+		},
+		removeZone: function(i) {
+			this.zones.splice(i, 1);
+			this.drawing = false;
+		},
+		onDraw: function(e) {
+			var shp;
+			if(e.type == 'box') {
+				shp = [[e.left, e.top], [e.right, e.bottom]];
+			} else {
+				shp = e.points;
+			}
+			this.canvasDims = e.dims;
+			var name = this.newName;
+			if(!name) {
+				name = 'zone' + (this.zones.length+1);
+			}
+			this.zones.push({
+				Name: name,
+				Shape: shp,
+			});
+			this.newName = '';
+			this.drawing = false;
+		},
+		save: function() {
+			var code = JSON.stringify({
+				CanvasDims: [parseFloat(this.canvasDims[0]), parseFloat(this.canvasDims[1])],
+				Zones: this.zones,
+				Zone: this.zone,
+			});
+			myCall('POST', '/queries/node?id='+this.initNode.ID, {
+				code: code,
+			});
+		},
+	},
+	template: `
+<div class="m-2 container">
+	<template v-if="initNode.Type == 'zone-dwell'">
+		<p>This node requires a track parent. Whenever a track leaves one of the zones below, it outputs a JSON list of visits, each with the track ID, zone, first and last frame in the zone, and dwell time. Visits that are still in progress at the end of the clip are output on the last frame, and marked as partial.</p>
+	</template>
+	<template v-else>
+		<p>This node requires a detection or track parent, and counts the objects whose center is in each zone below on each frame. With string output, it outputs a JSON object from zone name to count; with integer output, it outputs the count for one zone.</p>
+		<div v-if="initNode.DataType == 'int'" class="form-group row">
+			<label class="col-sm-2 col-form-label">Zone</label>
+			<div class="col-sm-10">
+				<select v-model="zone" class="form-control">
+					<option value="">All Zones</option>
+					<option v-for="z in zones" :value="z.Name">{{ z.Name }}</option>
+				</select>
+			</div>
+		</div>
+	</template>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Canvas Width</label>
+		<div class="col-sm-10">
+			<input v-model="canvasDims[0]" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-2 col-form-label">Canvas Height</label>
+		<div class="col-sm-10">
+			<input v-model="canvasDims[1]" type="text" class="form-control">
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-4 col-form-label">Dataset</label>
+		<div class="col-sm-8">
+			<select v-model="selectedSeries" class="form-control mx-2">
+				<option v-for="ds in dataSeries" :value="ds.ID">{{ ds.Name }}</option>
+			</select>
+		</div>
+	</div>
+	<div class="form-group row">
+		<label class="col-sm-4 col-form-label">Zones</label>
+		<div class="col-sm-8">
+			<table class="table table-sm table-borderless">
+				<tbody>
+					<tr v-for="(z, i) in zones">
+						<td><input v-model="z.Name" type="text" class="form-control form-control-sm"></td>
+						<td>{{ z.Shape }}</td>
+						<td><button type="button" class="btn btn-danger btn-sm" v-on:click="removeZone(i)">Remove</button></td>
+					</tr>
+					<tr>
+						<td><input v-model="newName" type="text" class="form-control form-control-sm" placeholder="Name"></td>
+						<td></td>
+						<td>
+							<button type="button" class="btn btn-primary btn-sm" v-on:click="addZone" :disabled="selectedSeries == null">Add Zone</button>
+						</td>
+					</tr>
+				</tbody>
+			</table>
+			<div
+				v-if="drawing && selectedSeries != null"
+				class="bordered-div p-2 m-2"
+				>
+				<util-video-draw-shape
+					v-bind:series_id="selectedSeries"
+					fixedOptions="polygon,box"
+					v-on:draw="onDraw($event)">
+				</util-video-draw-shape>
+			</div>
+		</div>
+	</div>
+	<button v-on:click="save" type="button" class="btn btn-primary">Save</button>
+</div>
+	`,
+};
+Vue.component('node-edit-zone-occupancy', nodeEditZones);
+Vue.component('node-edit-zone-dwell', nodeEditZones);
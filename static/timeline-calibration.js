@@ -0,0 +1,96 @@
+Vue.component('timeline-calibration', {
+	data: function() {
+		return {
+			calibration: null,
+			canvasDims: [0, 0],
+			// one correspondence per line: image x, image y, ground x, ground y
+			pointsText: '',
+		};
+	},
+	props: ['timeline'],
+	created: function() {
+		this.fetch();
+	},
+	methods: {
+		fetch: function() {
+			myCall('GET', '/timelines/calibration?timeline_id='+this.timeline.ID, null, (calibration) => {
+				this.setCalibration(calibration);
+			});
+		},
+		setCalibration: function(calibration) {
+			this.calibration = calibration;
+			if(!calibration) {
+				return;
+			}
+			this.canvasDims = calibration.CanvasDims;
+			var lines = [];
+			calibration.Points.forEach((p) => {
+				lines.push([p.Image[0], p.Image[1], p.Ground[0], p.Ground[1]].join(' '));
+			});
+			this.pointsText = lines.join('\n');
+		},
+		save: function() {
+			var points = [];
+			this.pointsText.split('\n').forEach((line) => {
+				var parts = line.trim().split(/[\s,]+/);
+				if(parts.length != 4) {
+					return;
+				}
+				points.push({
+					Image: [parseFloat(parts[0]), parseFloat(parts[1])],
+					Ground: [parseFloat(parts[2]), parseFloat(parts[3])],
+				});
+			});
+			var request = {
+				TimelineID: this.timeline.ID,
+				CanvasDims: [parseInt(this.canvasDims[0]), parseInt(this.canvasDims[1])],
+				Points: points,
+			};
+			myCall('POST', '/timelines/calibration', JSON.stringify(request), (calibration) => {
+				this.setCalibration(calibration);
+			});
+		},
+		clear: function() {
+			var request = {
+				TimelineID: this.timeline.ID,
+				Points: [],
+			};
+			myCall('POST', '/timelines/calibration', JSON.stringify(request), () => {
+				this.calibration = null;
+				this.pointsText = '';
+			});
+		},
+	},
+	template: `
+<div>
+	<p>
+		Calibrating the timeline with a ground-plane homography lets nodes like Track Speed measure speeds and distances.
+		Enter at least four points on the road surface, one per line, as the image x and y (in canvas coordinates) followed by the corresponding ground x and y in metres.
+	</p>
+	<p v-if="calibration">Calibrated from {{ calibration.Points.length }} points, mean error {{ calibration.Error.toFixed(2) }} m.</p>
+	<p v-else>This timeline is not calibrated.</p>
+	<form v-on:submit.prevent="save">
+		<div class="form-group row">
+			<label class="col-sm-2 col-form-label">Canvas Width</label>
+			<div class="col-sm-10">
+				<input v-model="canvasDims[0]" type="text" class="form-control">
+			</div>
+		</div>
+		<div class="form-group row">
+			<label class="col-sm-2 col-form-label">Canvas Height</label>
+			<div class="col-sm-10">
+				<input v-model="canvasDims[1]" type="text" class="form-control">
+			</div>
+		</div>
+		<div class="form-group row">
+			<label class="col-sm-2 col-form-label">Points</label>
+			<div class="col-sm-10">
+				<textarea v-model="pointsText" class="form-control" rows="6" placeholder="120 340 0 0"></textarea>
+			</div>
+		</div>
+		<button type="submit" class="btn btn-primary">Save Calibration</button>
+		<button v-if="calibration" type="button" class="btn btn-danger" v-on:click="clear">Remove Calibration</button>
+	</form>
+</div>
+	`,
+});
@@ -324,6 +324,8 @@ Vue.component('timeline-manage', {
 				</tr>
 			</tbody>
 		</table>
+		<h4>Calibration</h4>
+		<timeline-calibration v-bind:timeline="timeline"></timeline-calibration>
 	</template>
 	<template v-else>
 		<timeline-data-series v-bind:timeline="timeline" v-bind:series="selectedSeries" v-on:back="selectSeries(null)"></timeline-data-series>
@@ -112,6 +112,54 @@ Vue.component('util-video-draw-shape', {
 					updateRect(pos.x, pos.y);
 					layer.draw();
 				});
+			} else if(this.mode == 'line') {
+				// directed line segment, drawn as an arrow from the first click to the second
+				var curArrow = null;
+				var done = false;
+				var updateArrow = (x, y) => {
+					curArrow.points([curArrow.meta[0], curArrow.meta[1], x, y]);
+					var s = {
+						type: 'line',
+						points: [
+							[parseInt(curArrow.meta[0]), parseInt(curArrow.meta[1])],
+							[parseInt(x), parseInt(y)],
+						],
+						dims: [this.item.Width, this.item.Height],
+					};
+					s.desc = `Line((${s.points[0][0]}, ${s.points[0][1]}) to (${s.points[1][0]}, ${s.points[1][1]}))`;
+					this.curDesc = s.desc;
+					return s;
+				};
+				stage.on('click', () => {
+					if(done) {
+						return;
+					}
+					var pos = stage.getPointerPosition();
+					if(curArrow == null) {
+						curArrow = new Konva.Arrow({
+							points: [pos.x, pos.y, pos.x, pos.y],
+							stroke: 'yellow',
+							fill: 'yellow',
+							strokeWidth: 3,
+						});
+						curArrow.meta = [pos.x, pos.y];
+						layer.add(curArrow);
+						layer.draw();
+					} else {
+						var s = updateArrow(pos.x, pos.y);
+						done = true;
+						layer.draw();
+						this.$emit('draw', s);
+					}
+				});
+				stage.on('mousemove', () => {
+					if(curArrow == null || done) {
+						return;
+					}
+					var pos = stage.getPointerPosition();
+					updateArrow(pos.x, pos.y);
+					layer.draw();
+				});
 			} else if(this.mode == 'polygon') {
 				var curLine = null;
 				var points = [];
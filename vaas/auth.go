@@ -0,0 +1,69 @@
+package vaas
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"os"
+)
+
+// The coordinator, machines, and containers authenticate HTTP requests between
+// each other using a shared secret passed in AuthHeader.
+// Authentication is disabled if the secret is empty.
+const AuthHeader = "X-Vaas-Secret"
+
+// Environment variable that the secret may be passed in.
+// Machines pass the secret to containers this way so it doesn't appear in the process list.
+const AuthSecretEnv = "VAAS_SECRET"
+
+var authSecret string
+
+// Register the -secret flag, which defaults to the VAAS_SECRET environment variable.
+// After flag.Parse, the caller must call SetupAuth.
+func AuthFlag() *string {
+	return flag.String("secret", os.Getenv(AuthSecretEnv), "shared secret for authenticating coordinator/machine/container requests (default $" + AuthSecretEnv + ")")
+}
+
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if authSecret == "" {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrip must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(AuthHeader, authSecret)
+	return t.base.RoundTrip(req)
+}
+
+// Transport for requests between the coordinator, machines, and containers.
+// It attaches the shared secret, so it must not be used for other hosts.
+var InternalTransport http.RoundTripper = authTransport{http.DefaultTransport}
+
+// Client for requests between the coordinator, machines, and containers.
+var InternalClient = &http.Client{Transport: InternalTransport}
+
+// Set the shared secret that InternalClient attaches to outgoing requests.
+func SetupAuth(secret string) {
+	authSecret = secret
+	// don't leak the secret to processes that we start, e.g. python executors
+	os.Unsetenv(AuthSecretEnv)
+}
+
+// Returns the configured shared secret.
+func AuthSecret() string {
+	return authSecret
+}
+
+// Wrap a handler so that it rejects requests without the shared secret.
+func RequireAuth(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(AuthHeader)), []byte(authSecret)) != 1 {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		f(w, r)
+	}
+}
@@ -0,0 +1,132 @@
+package vaas
+
+import (
+	"fmt"
+	"math"
+)
+
+// A point in the image (in CanvasDims coordinates) and the corresponding point on
+// the ground plane, in metres.
+type CalibrationPoint struct {
+	Image [2]float64
+	Ground [2]float64
+}
+
+// Ground-plane calibration of a timeline: a homography from image coordinates to
+// ground-plane coordinates in metres, used to measure distances and speeds.
+type Calibration struct {
+	TimelineID int
+	CanvasDims [2]int
+	// the correspondences that H was computed from
+	Points []CalibrationPoint
+	// maps (x, y, 1) in CanvasDims coordinates to homogeneous ground coordinates
+	H [3][3]float64
+	// mean distance, in metres, between the ground points and the mapped image points
+	Error float64
+}
+
+// Computes the homography from at least four point correspondences.
+func NewCalibration(timelineID int, canvasDims [2]int, points []CalibrationPoint) (Calibration, error) {
+	calib := Calibration{
+		TimelineID: timelineID,
+		CanvasDims: canvasDims,
+		Points: points,
+	}
+	if canvasDims[0] <= 0 || canvasDims[1] <= 0 {
+		return calib, fmt.Errorf("canvas dimensions must be set")
+	}
+	if len(points) < 4 {
+		return calib, fmt.Errorf("need at least 4 points but got %d", len(points))
+	}
+
+	// direct linear transform with H[2][2] fixed to 1, solved in the least-squares
+	// sense using the normal equations
+	var ata [8][8]float64
+	var atb [8]float64
+	addRow := func(row [8]float64, b float64) {
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 8; j++ {
+				ata[i][j] += row[i]*row[j]
+			}
+			atb[i] += row[i]*b
+		}
+	}
+	for _, p := range points {
+		x, y := p.Image[0], p.Image[1]
+		u, v := p.Ground[0], p.Ground[1]
+		addRow([8]float64{x, y, 1, 0, 0, 0, -u*x, -u*y}, u)
+		addRow([8]float64{0, 0, 0, x, y, 1, -v*x, -v*y}, v)
+	}
+	h, ok := solveLinear(ata, atb)
+	if !ok {
+		return calib, fmt.Errorf("points are degenerate (e.g. three or more are on a line)")
+	}
+	calib.H = [3][3]float64{
+		{h[0], h[1], h[2]},
+		{h[3], h[4], h[5]},
+		{h[6], h[7], 1},
+	}
+
+	for _, p := range points {
+		u, v := calib.ToGround(p.Image[0], p.Image[1])
+		calib.Error += math.Hypot(u-p.Ground[0], v-p.Ground[1])
+	}
+	calib.Error /= float64(len(points))
+	return calib, nil
+}
+
+// Solves ax=b by Gaussian elimination with partial pivoting.
+func solveLinear(a [8][8]float64, b [8]float64) ([8]float64, bool) {
+	const n = 8
+	var x [8]float64
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col+1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return x, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col+1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= f*a[col][k]
+			}
+			b[row] -= f*b[col]
+		}
+	}
+	for row := n-1; row >= 0; row-- {
+		sum := b[row]
+		for k := row+1; k < n; k++ {
+			sum -= a[row][k]*x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, true
+}
+
+// Maps a point in CanvasDims coordinates to the ground plane.
+func (calib Calibration) ToGround(x float64, y float64) (float64, float64) {
+	h := calib.H
+	w := h[2][0]*x + h[2][1]*y + h[2][2]
+	u := (h[0][0]*x + h[0][1]*y + h[0][2]) / w
+	v := (h[1][0]*x + h[1][1]*y + h[1][2]) / w
+	return u, v
+}
+
+// Returns the ground position of a detection, i.e. the bottom-center of its box,
+// which is where the object touches the ground.
+// canvasDims are the dimensions that the detection's coordinates are relative to.
+func (calib Calibration) DetectionToGround(d Detection, canvasDims [2]int) (float64, float64) {
+	x := float64(d.Left+d.Right)/2
+	y := float64(d.Bottom)
+	if canvasDims[0] != 0 && canvasDims[1] != 0 {
+		x = x * float64(calib.CanvasDims[0]) / float64(canvasDims[0])
+		y = y * float64(calib.CanvasDims[1]) / float64(canvasDims[1])
+	}
+	return calib.ToGround(x, y)
+}
@@ -0,0 +1,67 @@
+package vaas
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCalibrationRoundTrip(t *testing.T) {
+	// a perspective homography, as from a camera looking down at a road
+	h := [3][3]float64{
+		{0.05, 0.01, -3},
+		{0.002, 0.12, -10},
+		{0.0001, 0.002, 1},
+	}
+	apply := func(x float64, y float64) [2]float64 {
+		w := h[2][0]*x + h[2][1]*y + h[2][2]
+		return [2]float64{
+			(h[0][0]*x + h[0][1]*y + h[0][2]) / w,
+			(h[1][0]*x + h[1][1]*y + h[1][2]) / w,
+		}
+	}
+	var points []CalibrationPoint
+	for _, p := range [][2]float64{{100, 400}, {540, 400}, {600, 250}, {50, 250}, {320, 300}} {
+		points = append(points, CalibrationPoint{Image: p, Ground: apply(p[0], p[1])})
+	}
+
+	calib, err := NewCalibration(1, [2]int{640, 480}, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range h {
+		for j := range h[i] {
+			if math.Abs(calib.H[i][j] - h[i][j]) > 1e-6 {
+				t.Fatalf("expected H=%v but got %v", h, calib.H)
+			}
+		}
+	}
+	if calib.Error > 1e-6 {
+		t.Fatalf("expected zero error but got %v", calib.Error)
+	}
+
+	// a point that wasn't used for the calibration, and the same point as the
+	// bottom-center of a detection on a canvas of half the size
+	expected := apply(200, 350)
+	u, v := calib.ToGround(200, 350)
+	if math.Abs(u-expected[0]) > 1e-6 || math.Abs(v-expected[1]) > 1e-6 {
+		t.Fatalf("expected %v but got (%v, %v)", expected, u, v)
+	}
+	u, v = calib.DetectionToGround(Detection{Left: 90, Top: 150, Right: 110, Bottom: 175}, [2]int{320, 240})
+	if math.Abs(u-expected[0]) > 1e-6 || math.Abs(v-expected[1]) > 1e-6 {
+		t.Fatalf("expected %v but got (%v, %v)", expected, u, v)
+	}
+}
+
+func TestCalibrationDegenerate(t *testing.T) {
+	var points []CalibrationPoint
+	for i := 0; i < 4; i++ {
+		x := float64(100*i)
+		points = append(points, CalibrationPoint{Image: [2]float64{x, x}, Ground: [2]float64{x/10, x/10}})
+	}
+	if _, err := NewCalibration(1, [2]int{640, 480}, points); err == nil {
+		t.Fatalf("expected error for points on a line")
+	}
+	if _, err := NewCalibration(1, [2]int{640, 480}, points[0:3]); err == nil {
+		t.Fatalf("expected error for three points")
+	}
+}
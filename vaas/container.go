@@ -10,8 +10,22 @@ type EnvSetID struct {
 
 type Environment struct {
 	Template string
+
+	// Resources needed by the container, e.g. "gpu", "container", "memory" (MB), "cpu" (cores).
+	// The machine limits the container to the requested memory and cpu.
 	Requirements map[string]int
 
+	// Optional Docker image that the container binary should run in.
+	// This can also be a directory (relative to the machine's working directory)
+	// containing a Dockerfile, which the machine builds when first needed.
+	// The machine's working directory is mounted at the same path in the image,
+	// so the image only needs to provide the libraries that executors use.
+	// Nodes can override the image of their executor's environment (see
+	// ExecutorMeta.NodeImage), e.g. python nodes with a "# image: ..." line and
+	// subprocess nodes with the Image field. Such nodes get their own container,
+	// so nodes with conflicting dependencies can be mixed in one query.
+	Image string
+
 	// e.g. the node ID
 	RefID int
 }
@@ -32,3 +46,12 @@ type Container struct {
 	BaseURL string
 	MachineIdx int
 }
+
+// Response from the container /health endpoint.
+type ContainerHealth struct {
+	UUID string
+	Executors int
+	Contexts int
+	// contexts with executors running or buffers being streamed
+	Active int
+}
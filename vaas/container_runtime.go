@@ -0,0 +1,521 @@
+package vaas
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Release the buffers of contexts that haven't been used for this long by default,
+// in case the coordinator never calls /query/finish (e.g. it crashed).
+const DefaultBufferTTL = 10*time.Minute
+
+// How often we check the buffer TTL and memory budget.
+const BufferCheckInterval = 5*time.Second
+
+type BufferMemory struct {
+	// bytes of buffered outputs held in memory
+	Bytes int64
+	// zero if there is no budget
+	Budget int64
+	// bytes of video buffers moved to disk so far
+	Spilled int64
+	Contexts int
+	// contexts released due to the TTL or the memory budget
+	Evictions int
+}
+
+// Response from the container /allstats endpoint.
+type ContainerStats struct {
+	// node ID -> stats
+	Nodes map[int]StatsSample
+	Memory BufferMemory
+}
+
+// Runs the executors of a container and shares their output buffers between
+// the requests for each execution context (ExecContext.UUID).
+// container.go serves it over HTTP; in in-process mode the coordinator calls it directly.
+type ContainerRuntime struct {
+	UUID string
+
+	// persists the outputs of a node, e.g. by calling the coordinator
+	AddOutputItem func(request AddOutputItemRequest) Item
+	// if set, persists the state exported by stateful nodes at the end of each slice
+	SaveState func(request SaveStateRequest)
+
+	executors map[int]Executor
+	// nodes whose executor is being created
+	// this can take a while (e.g. python nodes install their requirements), so we
+	// don't hold the lock, which would also block Health
+	creating map[int]bool
+	buffers map[string]map[int]DataBuffer
+	// contexts received over the stream transport, by UUID
+	contexts map[string]ExecContext
+	// when each context's buffers were last requested
+	lastUsed map[string]time.Time
+	// number of executors running and buffers being streamed in each context
+	// contexts that are in use are not released by the TTL or the memory budget
+	active map[string]int
+	mu sync.Mutex
+	cond *sync.Cond
+
+	// buffers of contexts unused for longer than BufferTTL are released
+	BufferTTL time.Duration
+	// if non-zero, we try to keep buffers under this many bytes by first spilling
+	// completed videos to disk and then releasing least recently used contexts
+	MemoryBudget int64
+
+	spilled int64
+	evictions int
+	closed bool
+}
+
+func NewContainerRuntime(uuid string, addOutputItem func(request AddOutputItemRequest) Item) *ContainerRuntime {
+	rt := &ContainerRuntime{
+		UUID: uuid,
+		AddOutputItem: addOutputItem,
+		executors: make(map[int]Executor),
+		creating: make(map[int]bool),
+		buffers: make(map[string]map[int]DataBuffer),
+		contexts: make(map[string]ExecContext),
+		lastUsed: make(map[string]time.Time),
+		active: make(map[string]int),
+		BufferTTL: DefaultBufferTTL,
+	}
+	rt.cond = sync.NewCond(&rt.mu)
+	go func() {
+		for {
+			time.Sleep(BufferCheckInterval)
+			rt.mu.Lock()
+			closed := rt.closed
+			rt.mu.Unlock()
+			if closed {
+				return
+			}
+			rt.enforceLimits()
+		}
+	}()
+	return rt
+}
+
+// Returns the output buffer of a node in the context, running the node if needed.
+func (rt *ContainerRuntime) Start(context ExecContext, nodeID int) DataBuffer {
+	node := context.Nodes[nodeID]
+
+	// if we already have the buffer for it, just use that
+	// synchronization is a bit complicated because e.Run call may recursively
+	// request more buffers, and we can't hold the lock here on the recursive calls
+	// we keep a reference to the context's map since the context may be released
+	// (by Finish or eviction) while the node is running
+	rt.mu.Lock()
+	if rt.buffers[context.UUID] == nil {
+		rt.buffers[context.UUID] = make(map[int]DataBuffer)
+	}
+	rt.lastUsed[context.UUID] = time.Now()
+	ctxBuffers := rt.buffers[context.UUID]
+	buf, ok := ctxBuffers[node.ID]
+	if buf != nil {
+		rt.mu.Unlock()
+		return buf
+	} else if ok {
+		for ctxBuffers[node.ID] == nil {
+			rt.cond.Wait()
+		}
+		buf = ctxBuffers[node.ID]
+		rt.mu.Unlock()
+		return buf
+	}
+
+	// placeholder buffer
+	ctxBuffers[node.ID] = nil
+
+	// init the executor if it's not already present
+	for rt.creating[node.ID] {
+		rt.cond.Wait()
+	}
+	e := rt.executors[node.ID]
+	if e == nil {
+		rt.creating[node.ID] = true
+		rt.mu.Unlock()
+		log.Printf("container %s starting node %s", rt.UUID, node.Name)
+		e = Executors[node.Type].New(*node)
+		rt.mu.Lock()
+		delete(rt.creating, node.ID)
+		rt.executors[node.ID] = e
+		rt.cond.Broadcast()
+	}
+	rt.mu.Unlock()
+
+	// the context is in use until the executor finishes writing its output
+	done := rt.use(context.UUID)
+	if se, ok := e.(StatefulExecutor); ok {
+		buf = se.RunWithState(context, context.States[node.ID], func(state []byte) {
+			rt.saveState(context, *node, state)
+		})
+	} else {
+		buf = e.Run(context)
+	}
+	rt.persist(context, *node, buf)
+	go func() {
+		buf.Wait()
+		done()
+	}()
+
+	rt.mu.Lock()
+	ctxBuffers[node.ID] = buf
+	rt.cond.Broadcast()
+	rt.mu.Unlock()
+
+	return buf
+}
+
+// Writes the output buffer of a node in the context to w, running the node if needed.
+// The context is in use until the buffer is written.
+func (rt *ContainerRuntime) Serve(context ExecContext, nodeID int, w io.Writer) error {
+	done := rt.use(context.UUID)
+	defer done()
+	buf := rt.Start(context, nodeID)
+	iobuf, ok := buf.(DataBufferIOWriter)
+	if !ok {
+		return fmt.Errorf("buffer of node %s (%T) cannot be streamed", context.Nodes[nodeID].Name, buf)
+	}
+	return iobuf.ToWriter(w)
+}
+
+// Marks the context as in use, and returns a function to call once it is no longer in use.
+func (rt *ContainerRuntime) use(uuid string) func() {
+	rt.mu.Lock()
+	rt.active[uuid]++
+	rt.mu.Unlock()
+	return func() {
+		rt.mu.Lock()
+		rt.active[uuid]--
+		if rt.active[uuid] <= 0 {
+			delete(rt.active, uuid)
+		}
+		// the TTL counts from when the context was last in use
+		if _, ok := rt.lastUsed[uuid]; ok {
+			rt.lastUsed[uuid] = time.Now()
+		}
+		rt.mu.Unlock()
+	}
+}
+
+// Asynchronously persist the outputs.
+func (rt *ContainerRuntime) persist(context ExecContext, node Node, buf DataBuffer) {
+	addOutputItem := func(format string, freq int, dims [2]int) Item {
+		return rt.AddOutputItem(AddOutputItemRequest{
+			Node: node,
+			Vector: context.Vector,
+			Slice: context.Slice,
+			Format: format,
+			Freq: freq,
+			Dims: dims,
+			Masked: context.Mask != nil,
+		})
+	}
+	if !context.Opts.NoPersist && node.DataType != VideoType {
+		go func() {
+			rd := buf.Reader()
+			data, err := rd.Read(context.Slice.Length())
+			if err != nil {
+				return
+			}
+			item := addOutputItem("json", rd.Freq(), [2]int{0, 0})
+			item.UpdateData(data)
+		}()
+	} else if context.Opts.PersistVideo {
+		go func() {
+			rd := buf.Reader()
+			if context.Slice.Length() == 1 {
+				data, err := rd.Read(1)
+				if err != nil {
+					return
+				}
+				im := data.(VideoData)[0]
+				item := addOutputItem("jpeg", rd.Freq(), [2]int{im.Width, im.Height})
+				item.Mkdir()
+				err = ioutil.WriteFile(item.Fname(0), im.AsJPG(), 0644)
+				if err != nil {
+					panic(err)
+				}
+			} else {
+				videoRd := rd.(*VideoBufferReader)
+				item := addOutputItem("mp4", rd.Freq(), videoRd.GetDims())
+				file, err := os.Create(item.Fname(0))
+				if err != nil {
+					panic(err)
+				}
+				err = videoRd.ReadMP4(file)
+				if err != nil {
+					panic(err)
+				}
+				file.Close()
+			}
+		}()
+	}
+}
+
+// Persist the state exported by a stateful node.
+// This is synchronous so that the state is saved before the node's output is done.
+func (rt *ContainerRuntime) saveState(context ExecContext, node Node, state []byte) {
+	if !context.Opts.ChainStates || context.Opts.NoPersist || rt.SaveState == nil || state == nil {
+		return
+	}
+	rt.SaveState(SaveStateRequest{
+		Node: node,
+		Vector: context.Vector,
+		Slice: context.Slice,
+		State: state,
+	})
+}
+
+// Release the buffers for a context.
+// Existing readers can finish reading.
+func (rt *ContainerRuntime) Finish(uuid string) {
+	rt.mu.Lock()
+	rt.release(uuid)
+	rt.mu.Unlock()
+}
+
+// Caller must have the lock.
+func (rt *ContainerRuntime) release(uuid string) {
+	delete(rt.buffers, uuid)
+	delete(rt.contexts, uuid)
+	delete(rt.lastUsed, uuid)
+}
+
+// Returns the memory used by buffers of each context, and the distinct buffers.
+// A buffer shared by several contexts is counted once, for an arbitrary context.
+// Caller must have the lock.
+func (rt *ContainerRuntime) bufferUsage() (map[string]int64, map[DataBufferMemory]int64) {
+	contextUsage := make(map[string]int64)
+	bufUsage := make(map[DataBufferMemory]int64)
+	for uuid, ctxBuffers := range rt.buffers {
+		for _, buf := range ctxBuffers {
+			membuf, ok := buf.(DataBufferMemory)
+			if !ok {
+				continue
+			}
+			if _, seen := bufUsage[membuf]; seen {
+				continue
+			}
+			bufUsage[membuf] = membuf.MemoryUsage()
+			contextUsage[uuid] += bufUsage[membuf]
+		}
+	}
+	return contextUsage, bufUsage
+}
+
+func (rt *ContainerRuntime) Memory() BufferMemory {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	_, bufUsage := rt.bufferUsage()
+	var total int64
+	for _, usage := range bufUsage {
+		total += usage
+	}
+	return BufferMemory{
+		Bytes: total,
+		Budget: rt.MemoryBudget,
+		Spilled: rt.spilled,
+		Contexts: len(rt.buffers),
+		Evictions: rt.evictions,
+	}
+}
+
+// Release contexts past the TTL, and enforce the memory budget.
+func (rt *ContainerRuntime) enforceLimits() {
+	rt.mu.Lock()
+	for uuid, t := range rt.lastUsed {
+		if time.Now().Sub(t) < rt.BufferTTL || rt.active[uuid] > 0 {
+			continue
+		}
+		log.Printf("container %s releasing buffers of context %s after %v without use", rt.UUID, uuid, rt.BufferTTL)
+		rt.release(uuid)
+		rt.evictions++
+	}
+	if rt.MemoryBudget <= 0 {
+		rt.mu.Unlock()
+		return
+	}
+	_, bufUsage := rt.bufferUsage()
+	rt.mu.Unlock()
+
+	var total int64
+	var spillers []DataBufferMemory
+	for buf, usage := range bufUsage {
+		total += usage
+		if _, ok := buf.(DataBufferSpiller); ok && usage > 0 {
+			spillers = append(spillers, buf)
+		}
+	}
+	if total <= rt.MemoryBudget {
+		return
+	}
+
+	// spill the largest videos first
+	// we don't hold the lock here since this writes to disk
+	sort.Slice(spillers, func(i, j int) bool {
+		return bufUsage[spillers[i]] > bufUsage[spillers[j]]
+	})
+	for _, buf := range spillers {
+		if total <= rt.MemoryBudget {
+			break
+		}
+		freed, err := buf.(DataBufferSpiller).Spill()
+		if err != nil {
+			log.Printf("container %s: error spilling buffer to disk: %v", rt.UUID, err)
+			break
+		}
+		total -= freed
+		rt.mu.Lock()
+		rt.spilled += freed
+		rt.mu.Unlock()
+	}
+	if total <= rt.MemoryBudget {
+		return
+	}
+
+	// release least recently used contexts
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	contextUsage, _ := rt.bufferUsage()
+	var uuids []string
+	for uuid := range rt.buffers {
+		if rt.active[uuid] > 0 {
+			continue
+		}
+		uuids = append(uuids, uuid)
+	}
+	sort.Slice(uuids, func(i, j int) bool {
+		return rt.lastUsed[uuids[i]].Before(rt.lastUsed[uuids[j]])
+	})
+	for _, uuid := range uuids {
+		if total <= rt.MemoryBudget {
+			break
+		}
+		log.Printf("container %s releasing buffers of context %s since buffers use %d bytes (budget %d)", rt.UUID, uuid, total, rt.MemoryBudget)
+		total -= contextUsage[uuid]
+		rt.release(uuid)
+		rt.evictions++
+	}
+}
+
+func (rt *ContainerRuntime) setContext(context ExecContext) {
+	rt.mu.Lock()
+	rt.contexts[context.UUID] = context
+	rt.mu.Unlock()
+}
+
+func (rt *ContainerRuntime) getContext(uuid string) (ExecContext, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	context, ok := rt.contexts[uuid]
+	return context, ok
+}
+
+// Returns stats of a node, or false if the node hasn't been started.
+func (rt *ContainerRuntime) Stats(nodeID int) (StatsSample, bool) {
+	rt.mu.Lock()
+	e := rt.executors[nodeID]
+	rt.mu.Unlock()
+	if e == nil {
+		return StatsSample{}, false
+	}
+	statsProvider, ok := e.(StatsProvider)
+	if !ok {
+		return StatsSample{}, true
+	}
+	return statsProvider.Stats(), true
+}
+
+func (rt *ContainerRuntime) AllStats() map[int]StatsSample {
+	m := make(map[int]StatsSample)
+	rt.mu.Lock()
+	for nodeID, e := range rt.executors {
+		statsProvider, ok := e.(StatsProvider)
+		if !ok {
+			continue
+		}
+		m[nodeID] = statsProvider.Stats()
+	}
+	rt.mu.Unlock()
+	return m
+}
+
+func (rt *ContainerRuntime) Health() ContainerHealth {
+	// we take the lock so that a deadlocked container is reported as unhealthy
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return ContainerHealth{
+		UUID: rt.UUID,
+		Executors: len(rt.executors),
+		Contexts: len(rt.buffers),
+		Active: len(rt.active),
+	}
+}
+
+// Close all executors.
+func (rt *ContainerRuntime) Close() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, e := range rt.executors {
+		e.Close()
+	}
+	rt.executors = make(map[int]Executor)
+	rt.closed = true
+}
+
+// Containers that run inside the current process, by UUID.
+// ExecContext calls these directly instead of performing HTTP requests.
+var localContainers = make(map[string]*ContainerRuntime)
+var localContainersMu sync.Mutex
+
+func RegisterLocalContainer(rt *ContainerRuntime) {
+	localContainersMu.Lock()
+	localContainers[rt.UUID] = rt
+	localContainersMu.Unlock()
+}
+
+// Remove an in-process container and close its executors.
+func UnregisterLocalContainer(uuid string) {
+	localContainersMu.Lock()
+	rt := localContainers[uuid]
+	delete(localContainers, uuid)
+	localContainersMu.Unlock()
+	if rt != nil {
+		rt.Close()
+	}
+}
+
+// Returns the in-process runtime for a container, or nil if it's a remote container.
+func GetLocalContainer(uuid string) *ContainerRuntime {
+	localContainersMu.Lock()
+	defer localContainersMu.Unlock()
+	return localContainers[uuid]
+}
+
+func GetContainerHealth(container Container) (ContainerHealth, error) {
+	if rt := GetLocalContainer(container.UUID); rt != nil {
+		return rt.Health(), nil
+	}
+	var health ContainerHealth
+	err := JsonPost(container.BaseURL, "/health", nil, &health)
+	return health, err
+}
+
+// Get stats for each node on a container, along with its buffer memory usage.
+func GetContainerStats(container Container) (ContainerStats, error) {
+	if rt := GetLocalContainer(container.UUID); rt != nil {
+		return ContainerStats{rt.AllStats(), rt.Memory()}, nil
+	}
+	var stats ContainerStats
+	err := JsonPost(container.BaseURL, "/allstats", nil, &stats)
+	return stats, err
+}
@@ -0,0 +1,101 @@
+package vaas
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Outputs one item once release is closed.
+type blockingTestExecutor struct {
+	release chan bool
+}
+
+func (e blockingTestExecutor) Run(ctx ExecContext) DataBuffer {
+	buf := NewSimpleBuffer(IntType)
+	go func() {
+		buf.SetMeta(1)
+		<- e.release
+		buf.Write(IntData{1})
+		buf.Close()
+	}()
+	return buf
+}
+
+func (e blockingTestExecutor) Close() {}
+
+func TestRuntimeKeepsContextsInUse(t *testing.T) {
+	release := make(chan bool)
+	Executors["blocking-test"] = ExecutorMeta{
+		New: func(node Node) Executor {
+			return blockingTestExecutor{release}
+		},
+	}
+	rt := NewContainerRuntime("runtime-test", nil)
+	defer rt.Close()
+	rt.BufferTTL = time.Millisecond
+	context := ExecContext{
+		Nodes: map[int]*Node{1: &Node{ID: 1, Name: "node1", Type: "blocking-test", DataType: IntType}},
+		UUID: "ctx",
+		Opts: ExecOptions{NoPersist: true},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- rt.Serve(context, 1, ioutil.Discard)
+	}()
+
+	// the context is past the TTL but the node is still running
+	for rt.Health().Contexts == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5*time.Millisecond)
+	rt.enforceLimits()
+	if rt.Health().Contexts != 1 {
+		t.Fatalf("context was released while in use")
+	}
+
+	close(release)
+	if err := <- served; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5*time.Millisecond)
+	rt.enforceLimits()
+	if rt.Health().Contexts != 0 {
+		t.Fatalf("expected context to be released after the TTL")
+	}
+}
+
+func TestRuntimeHealthWhileCreatingExecutor(t *testing.T) {
+	created := make(chan bool)
+	Executors["slow-create-test"] = ExecutorMeta{
+		New: func(node Node) Executor {
+			<- created
+			return blockingTestExecutor{created}
+		},
+	}
+	rt := NewContainerRuntime("runtime-test", nil)
+	defer rt.Close()
+	context := ExecContext{
+		Nodes: map[int]*Node{1: &Node{ID: 1, Name: "node1", Type: "slow-create-test", DataType: IntType}},
+		UUID: "ctx",
+		Opts: ExecOptions{NoPersist: true},
+	}
+	started := make(chan DataBuffer, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			started <- rt.Start(context, 1)
+		}()
+	}
+
+	// Health must not wait for the executor to be created
+	for rt.Health().Contexts == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(created)
+	if <- started != <- started {
+		t.Fatalf("expected both requests to get the same buffer")
+	}
+	if rt.Health().Executors != 1 {
+		t.Fatalf("expected one executor")
+	}
+}
@@ -7,4 +7,26 @@ type AddOutputItemRequest struct {
 	Format string
 	Freq int
 	Dims [2]int
+	// whether the output was computed under ExecContext.Mask, in which case it
+	// is only valid for the current selector of the query
+	Masked bool
+}
+
+// State exported by a stateful node at the end of a slice.
+type SaveStateRequest struct {
+	Node Node
+	Vector []Series
+	Slice Slice
+	State []byte
+}
+
+// Sent by a machine when one of its containers exits without being de-allocated.
+type ContainerExit struct {
+	UUID string
+	BaseURL string
+	Reason string
+
+	// whether the machine was able to restart the container with the same environment
+	// if so, the container keeps the same UUID and BaseURL
+	Restarted bool
 }
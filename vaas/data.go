@@ -79,6 +79,16 @@ type DataBufferIOWriter interface {
 	ToWriter(w io.Writer) error
 }
 
+// DataBuffers that can report how many bytes they hold in memory.
+type DataBufferMemory interface {
+	MemoryUsage() int64
+}
+
+// DataBuffers that can move their contents to disk, returning the bytes freed.
+type DataBufferSpiller interface {
+	Spill() (int64, error)
+}
+
 type DataWriter interface {
 	SetMeta(freq int)
 	Write(data Data)
@@ -126,12 +136,39 @@ func AdjustDataFreq(data Data, length int, freq int, target int) Data {
 
 type ReadMultipleOptions struct {
 	Stats *StatsHolder
+
+	// frame-level selector mask over the frames of the slice (see ExecContext.Mask)
+	// executors that set it can skip processing the frames that aren't selected
+	Mask []bool
+}
+
+// Returns whether any of the frames [start, start+freq) are selected by mask.
+// All frames are selected if mask is nil.
+func MaskSelected(mask []bool, start int, freq int) bool {
+	if mask == nil {
+		return true
+	}
+	for i := start; i < start+freq && i < len(mask); i++ {
+		if mask[i] {
+			return true
+		}
+	}
+	return false
 }
 
 // Read from multiple DataReaders in lockstep.
 // Output is limited by the slowest DataReader.
 // Also adjusts input data so that the Data provided to callback corresponds to targetFreq.
 func ReadMultiple(length int, targetFreq int, inputs []DataReader, opts ReadMultipleOptions, callback func(int, []Data) error) error {
+	return ReadMultipleMasked(length, targetFreq, inputs, opts, func(index int, datas []Data, selected []bool) error {
+		return callback(index, datas)
+	})
+}
+
+// Like ReadMultiple, but also passes to callback whether each of the frames in
+// datas is selected by opts.Mask.
+// The inputs are still read on every frame, so only the processing can be skipped.
+func ReadMultipleMasked(length int, targetFreq int, inputs []DataReader, opts ReadMultipleOptions, callback func(int, []Data, []bool) error) error {
 	defer func() {
 		for _, input := range inputs {
 			input.Close()
@@ -187,7 +224,15 @@ func ReadMultiple(length int, targetFreq int, inputs []DataReader, opts ReadMult
 
 		t1 := time.Now()
 
-		err := callback(completed, datas)
+		var selected []bool
+		if len(datas) > 0 {
+			selected = make([]bool, datas[0].Length())
+		}
+		for i := range selected {
+			selected[i] = MaskSelected(opts.Mask, completed + i*targetFreq, targetFreq)
+		}
+
+		err := callback(completed, datas, selected)
 		if err != nil {
 			return fmt.Errorf("error from callback: %v", err)
 		}
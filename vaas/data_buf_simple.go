@@ -15,6 +15,9 @@ type SimpleBuffer struct {
 	done bool
 	freq int
 	length int
+
+	// approximate bytes in buf, see MemoryUsage
+	memUsage int64
 }
 
 type SimpleReader struct {
@@ -103,7 +106,13 @@ func (buf *SimpleBuffer) peek(pos int, n int) (Data, error) {
 }
 
 func (buf *SimpleBuffer) Write(data Data) {
+	buf.write(data, len(data.Encode()))
+}
+
+// Write data whose encoding is size bytes.
+func (buf *SimpleBuffer) write(data Data, size int) {
 	buf.mu.Lock()
+	buf.memUsage += int64(size)
 	buf.buf = buf.buf.Append(data)
 	if buf.length > 0 && buf.buf.Length() > buf.length {
 		buf.buf = buf.buf.Slice(0, buf.length)
@@ -141,6 +150,15 @@ func (buf *SimpleBuffer) Wait() error {
 	return nil
 }
 
+// Returns the approximate memory used by the buffered data.
+// We use the size of the encoded data, which we count as it is written so that
+// this is cheap enough to call while the container runtime holds its lock.
+func (buf *SimpleBuffer) MemoryUsage() int64 {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.memUsage
+}
+
 func (buf *SimpleBuffer) Reader() DataReader {
 	return &SimpleReader{
 		buf: buf,
@@ -190,7 +208,7 @@ func (buf *SimpleBuffer) FromReader(r io.Reader) {
 			return
 		}
 		if header[0] == 'd' {
-			buf.Write(DecodeData(buf.Type(), b))
+			buf.write(DecodeData(buf.Type(), b), len(b))
 		} else if header[0] == 'e' {
 			buf.Error(fmt.Errorf(string(b)))
 		}
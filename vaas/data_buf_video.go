@@ -4,8 +4,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
 	"sync"
 )
@@ -117,6 +119,9 @@ func (w *VideoWriter) Buffer() DataBuffer {
 
 type VideoBuffer struct {
 	videoBytes []byte
+	// if set, the video bytes were spilled to this (already unlinked) file
+	file *os.File
+	fileSize int
 	mu sync.Mutex
 	cond *sync.Cond
 	err error
@@ -205,6 +210,16 @@ func (buf *VideoBuffer) Reader() DataReader {
 func (buf *VideoBuffer) Read(pos int, b []byte) (int, error) {
 	buf.mu.Lock()
 	defer buf.mu.Unlock()
+	if buf.file != nil {
+		if pos >= buf.fileSize {
+			return 0, io.EOF
+		}
+		n, err := buf.file.ReadAt(b, int64(pos))
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
 	for len(buf.videoBytes) <= pos && buf.err == nil && !buf.done {
 		buf.cond.Wait()
 	}
@@ -217,6 +232,40 @@ func (buf *VideoBuffer) Read(pos int, b []byte) (int, error) {
 	return n, nil
 }
 
+// Returns the number of video bytes held in memory.
+func (buf *VideoBuffer) MemoryUsage() int64 {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return int64(len(buf.videoBytes))
+}
+
+// Move the video bytes to a temporary file so that they no longer use memory.
+// Only completed buffers are spilled; returns the number of bytes freed.
+func (buf *VideoBuffer) Spill() (int64, error) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	if !buf.done || buf.err != nil || buf.file != nil || len(buf.videoBytes) == 0 {
+		return 0, nil
+	}
+	file, err := ioutil.TempFile("", "vaas-vbuf-")
+	if err != nil {
+		return 0, err
+	}
+	// unlink immediately so the file is removed once the buffer is garbage collected
+	os.Remove(file.Name())
+	if _, err := file.Write(buf.videoBytes); err != nil {
+		file.Close()
+		return 0, err
+	}
+	buf.file = file
+	buf.fileSize = len(buf.videoBytes)
+	buf.videoBytes = nil
+	runtime.SetFinalizer(buf, func(buf *VideoBuffer) {
+		buf.file.Close()
+	})
+	return int64(buf.fileSize), nil
+}
+
 func (buf *VideoBuffer) ToWriter(w io.Writer) error {
 	return buf.Reader().(*VideoBufferReader).ToWriter(w)
 }
@@ -295,6 +344,20 @@ func (rd *VideoBufferReader) Type() DataType {
 	return VideoType
 }
 
+func (rd *VideoBufferReader) MemoryUsage() int64 {
+	if rd.buf == nil {
+		return 0
+	}
+	return rd.buf.MemoryUsage()
+}
+
+func (rd *VideoBufferReader) Spill() (int64, error) {
+	if rd.buf == nil {
+		return 0, nil
+	}
+	return rd.buf.Spill()
+}
+
 func (rd *VideoBufferReader) Rescale(scale [2]int) {
 	rd.rescale = scale
 }
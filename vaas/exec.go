@@ -1,10 +1,9 @@
 package vaas
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 )
 
 type ExecOptions struct {
@@ -21,6 +20,12 @@ type ExecOptions struct {
 	// handled by the coordinator
 	IgnoreItems bool
 
+	// if true, stateful nodes start from the state at the end of the previous
+	// contiguous slice, and save their state at the end of this slice
+	// only set by ExecJob, which applies the slices of each segment in order
+	// handled by the coordinator (loading) and the container (saving)
+	ChainStates bool
+
 	// override selector
 	Selector *Node
 	NoSelector bool
@@ -52,6 +57,20 @@ type ExecContext struct {
 	Vector []Series
 	Slice Slice
 
+	// ground-plane calibration of the timeline, or nil if it is not calibrated
+	Calibration *Calibration
+
+	// if the query's selector is evaluated per frame, whether each frame of the
+	// slice is selected; expensive executors pass it to ReadMultipleOptions.Mask
+	// and output empty data on the frames that aren't selected
+	// nil if all frames are selected
+	Mask []bool
+
+	// state exported by stateful nodes (see StatefulExecutor) at the end of the
+	// previous contiguous slice of the same segment, by node ID
+	// only set if Opts.ChainStates
+	States map[int][]byte
+
 	Opts ExecOptions
 }
 
@@ -61,24 +80,32 @@ func (context ExecContext) GetBuffer(node Node) (DataBuffer, error) {
 		return item.Load(context.Slice), nil
 	}
 	container := context.Containers[node.ID]
-	path := fmt.Sprintf("/query/start?node_id=%d", node.ID)
-	resp, err := http.Post(
-		container.BaseURL + path,
-		"application/json", bytes.NewBuffer(JsonMarshal(context)),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("error performing HTTP request: %v", err)
-	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("HTTP error %d", resp.StatusCode)
+
+	var body io.ReadCloser
+	if rt := GetLocalContainer(container.UUID); rt != nil {
+		// in-process container: we still stream the buffer through its encoding so
+		// that the caller gets its own copy, same as with a remote container
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(rt.Serve(context, node.ID, pw))
+		}()
+		body = pr
+	} else {
+		var err error
+		body, err = OpenStream(container, context, node.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error opening stream: %v", err)
+		}
 	}
+
 	var buf DataBuffer
 	if node.DataType == VideoType {
-		buf = VideoBufferFromReader(resp.Body)
+		buf = VideoBufferFromReader(body)
 	} else {
 		sbuf := NewSimpleBuffer(node.DataType)
 		go func() {
-			sbuf.FromReader(resp.Body)
-			resp.Body.Close()
+			sbuf.FromReader(body)
+			body.Close()
 		}()
 		buf = sbuf
 	}
@@ -105,7 +132,11 @@ func (context ExecContext) Release() {
 			continue
 		}
 		seen[container.UUID] = true
-		resp, err := http.Post(container.BaseURL + "/query/finish?uuid=" + context.UUID, "", nil)
+		if rt := GetLocalContainer(container.UUID); rt != nil {
+			rt.Finish(context.UUID)
+			continue
+		}
+		resp, err := InternalClient.Post(container.BaseURL + "/query/finish?uuid=" + context.UUID, "", nil)
 		if err != nil {
 			// could be due to container de-allocation
 			log.Printf("[context] warning: error releasing container %s (%s): %v", container.BaseURL, container.UUID, err)
@@ -120,6 +151,19 @@ type Executor interface {
 	Close()
 }
 
+// Executors can implement StatefulExecutor to continue from one slice to the next
+// contiguous slice of the same segment, e.g. so that a tracker keeps its track IDs.
+// The container calls RunWithState instead of Run.
+type StatefulExecutor interface {
+	Executor
+
+	// Like Run, but starts from state, which the executor exported at the end of
+	// the previous contiguous slice (nil if there is none).
+	// The executor should call export once with its state at the end of the slice,
+	// before closing the output buffer.
+	RunWithState(context ExecContext, state []byte, export func(state []byte)) DataBuffer
+}
+
 type ErrorExecutor struct {
 	DataType DataType
 	Error error
@@ -133,6 +177,10 @@ type ExecutorMeta struct {
 	// only set for non-default environments
 	Environment *Environment
 
+	// optional, returns the Docker image that the node should run in, or "" to
+	// use the image of Environment (see NodeEnvironment)
+	NodeImage func(node Node) string
+
 	// whether the system should erase items when inputs have been
 	// re-scaled and/or re-sampled with no other modifications
 	// e.g. an object detector can set these true if it will take control of deciding
@@ -141,6 +189,11 @@ type ExecutorMeta struct {
 	HandleRescale bool
 	HandleResample bool
 
+	// whether the executor implements StatefulExecutor
+	// if so, ExecJob applies the query on the contiguous slices of each segment
+	// in order so that state can be handed from one slice to the next
+	Stateful bool
+
 	// Returns list of configs that the node should be tested with.
 	// Tuples are (config, short description of the config).
 	// During tuning, node.Code is set to one of these configs.
@@ -148,3 +201,31 @@ type ExecutorMeta struct {
 }
 
 var Executors = map[string]ExecutorMeta{}
+
+// Returns the environment of the container that a node needs, or nil if the
+// node runs in the default container.
+// Nodes that override the image run in their own container even if their
+// executor has no Environment.
+func NodeEnvironment(node Node) *Environment {
+	meta := Executors[node.Type]
+	var env *Environment
+	if meta.Environment != nil {
+		env = new(Environment)
+		*env = *meta.Environment
+	}
+	if meta.NodeImage != nil {
+		if image := meta.NodeImage(node); image != "" {
+			if env == nil {
+				env = &Environment{
+					Template: "image",
+					Requirements: map[string]int{"container": 1},
+				}
+			}
+			env.Image = image
+		}
+	}
+	if env != nil {
+		env.RefID = node.ID
+	}
+	return env
+}
@@ -0,0 +1,245 @@
+package vaas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Wire protocol between an executor and a process that implements a node
+// (used by the python and subprocess node types).
+//
+// The executor writes input packets to the process stdin:
+//   uint32 length | byte kind | payload (length bytes)
+// Kind 'j' is a JSON payload. Kind 'v' is a video payload:
+//   uint32 frames | uint32 height | uint32 width | uint32 channels | frames*height*width*channels bytes
+// All integers are big endian, and frames are RGB.
+//
+// The process writes output packets to its stdout:
+//   uint32 slice | uint32 start | uint32 end | uint32 size | data (size bytes)
+// For video nodes the data is a video payload, otherwise it is the JSON encoding of
+// the Data for frames [start, end) of the slice.
+//
+// The conversation goes like this:
+// 1) The executor sends an ExecHello JSON packet. The process replies with an
+//    output packet with slice=ExecControlSlice where data is an ExecHelloReply.
+//    The versions must match, otherwise the executor fails the node.
+// 2) For each slice, the executor sends an ExecInitPacket. Then for each batch of
+//    frames, it sends an ExecJobPacket followed by one packet for each parent. Then
+//    it sends an ExecFinishPacket. Packets of different slices may be interleaved.
+// 3) The process writes the outputs of a slice in any number of output packets, and
+//    then an output packet with start=end=size=0 when it is done with the slice.
+//    If it fails to process a slice, it instead writes an output packet with
+//    start=end=ExecErrorMarker where data is the error message (e.g. a traceback),
+//    and ignores the remaining packets of that slice.
+// The process should exit when its stdin is closed.
+const ExecProtocolVersion = 1
+
+const ExecControlSlice uint32 = 0xFFFFFFFF
+const ExecErrorMarker uint32 = 0xFFFFFFFF
+
+type ExecHello struct {
+	// for compatibility with the original python protocol, Type is the node's output type
+	Type DataType
+	Parents int
+	Version int
+	NodeName string
+}
+
+type ExecHelloReply struct {
+	Version int
+}
+
+type ExecInitPacket struct {
+	Type string // "init"
+	ID int
+	// number of frames in the slice
+	Length int
+}
+
+type ExecJobPacket struct {
+	Type string // "job"
+	SliceIdx int
+	// frames covered by the job (relative to the start of the slice)
+	Range [2]int
+}
+
+type ExecFinishPacket struct {
+	Type string // "finish"
+	ID int
+}
+
+type ExecOutputHeader struct {
+	Slice uint32
+	Start uint32
+	End uint32
+	Size uint32
+}
+
+func (h ExecOutputHeader) IsControl() bool {
+	return h.Slice == ExecControlSlice
+}
+
+func (h ExecOutputHeader) IsError() bool {
+	return h.Start == ExecErrorMarker && h.End == ExecErrorMarker
+}
+
+func (h ExecOutputHeader) IsFinish() bool {
+	return h.Start == 0 && h.End == 0 && h.Size == 0
+}
+
+func WriteExecJSON(w io.Writer, x interface{}) error {
+	encoded := JsonMarshal(x)
+	buf := make([]byte, 5)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(encoded)))
+	buf[4] = 'j'
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(encoded)
+	return err
+}
+
+// Writes the header of a video payload.
+func writeExecVideoHeader(w io.Writer, images []Image) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(images)))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(images[0].Height))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(images[0].Width))
+	binary.BigEndian.PutUint32(buf[12:16], 3)
+	_, err := w.Write(buf)
+	return err
+}
+
+func WriteExecVideo(w io.Writer, images []Image) error {
+	buf := make([]byte, 5)
+	l := 16+len(images)*images[0].Width*images[0].Height*3
+	binary.BigEndian.PutUint32(buf[0:4], uint32(l))
+	buf[4] = 'v'
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if err := writeExecVideoHeader(w, images); err != nil {
+		return err
+	}
+	// write frames one at a time to avoid copying the whole video
+	for _, image := range images {
+		if _, err := w.Write(image.ToBytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a parent Data as an input packet.
+func WriteExecData(w io.Writer, data Data) error {
+	if data.Type() == VideoType {
+		return WriteExecVideo(w, data.(VideoData))
+	}
+	return WriteExecJSON(w, data)
+}
+
+// Reads an input packet, returning its kind and payload.
+func ReadExecPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, int(binary.BigEndian.Uint32(header[0:4])))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// Decodes the payload of an input packet, or the data of an output packet.
+func DecodeExecData(t DataType, payload []byte) (Data, error) {
+	if t != VideoType {
+		return DecodeData(t, payload), nil
+	}
+	if len(payload) < 16 {
+		return nil, fmt.Errorf("video payload too short")
+	}
+	nframes := int(binary.BigEndian.Uint32(payload[0:4]))
+	height := int(binary.BigEndian.Uint32(payload[4:8]))
+	width := int(binary.BigEndian.Uint32(payload[8:12]))
+	// TODO: channels payload[12:16]
+	chunkSize := width*height*3
+	payload = payload[16:]
+	if len(payload) < nframes*chunkSize {
+		return nil, fmt.Errorf("video payload has %d bytes but expected %d", len(payload), nframes*chunkSize)
+	}
+	var vdata VideoData
+	for i := 0; i < nframes; i++ {
+		vdata = append(vdata, ImageFromBytes(width, height, payload[i*chunkSize:(i+1)*chunkSize]))
+	}
+	return vdata, nil
+}
+
+func WriteExecOutput(w io.Writer, header ExecOutputHeader, data []byte) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], header.Slice)
+	binary.BigEndian.PutUint32(buf[4:8], header.Start)
+	binary.BigEndian.PutUint32(buf[8:12], header.End)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(data)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Write the outputs of frames [start, end) of a slice.
+func WriteExecOutputData(w io.Writer, sliceIdx int, start int, end int, data Data) error {
+	var buf bytes.Buffer
+	if data.Type() == VideoType {
+		images := data.(VideoData)
+		writeExecVideoHeader(&buf, images)
+		for _, image := range images {
+			buf.Write(image.ToBytes())
+		}
+	} else {
+		buf.Write(JsonMarshal(data))
+	}
+	return WriteExecOutput(w, ExecOutputHeader{uint32(sliceIdx), uint32(start), uint32(end), 0}, buf.Bytes())
+}
+
+func ReadExecOutput(r io.Reader) (ExecOutputHeader, []byte, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return ExecOutputHeader{}, nil, err
+	}
+	header := ExecOutputHeader{
+		Slice: binary.BigEndian.Uint32(buf[0:4]),
+		Start: binary.BigEndian.Uint32(buf[4:8]),
+		End: binary.BigEndian.Uint32(buf[8:12]),
+		Size: binary.BigEndian.Uint32(buf[12:16]),
+	}
+	data := make([]byte, int(header.Size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return header, nil, err
+	}
+	return header, data, nil
+}
+
+// Called by the executor to check the process's reply to the ExecHello.
+// Errors reading the reply (e.g. io.EOF if the process exited) are returned as is.
+func ReadExecHelloReply(r io.Reader) error {
+	header, data, err := ReadExecOutput(r)
+	if err != nil {
+		return err
+	}
+	if !header.IsControl() {
+		return fmt.Errorf("process did not reply to the protocol handshake (protocol version %d)", ExecProtocolVersion)
+	}
+	var reply ExecHelloReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("error decoding handshake reply: %v", err)
+	}
+	if reply.Version != ExecProtocolVersion {
+		return fmt.Errorf("process speaks protocol version %d but we need version %d", reply.Version, ExecProtocolVersion)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package vaas
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Go plugins (built with go build -buildmode=plugin) in this directory are loaded
+// when the coordinator and containers start. Plugins register their executors in
+// Executors from init functions, like the packages in builtins/. On the coordinator,
+// they can also register app.Watchers and app.Metrics.
+// Plugins must be built with the same Go version and package paths as the binaries.
+const PluginDir = "plugins"
+
+type PluginError struct {
+	// "coordinator" or the UUID of the container that failed to load the plugin
+	Source string
+	Filename string
+	Error string
+	Time time.Time
+	// number of times the error was reported (set by the coordinator)
+	Count int
+}
+
+// Load the plugins in dir, returning the plugins that failed to load.
+func LoadPlugins(dir string, source string) []PluginError {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("[plugins] error listing %s: %v", dir, err)
+		return []PluginError{{
+			Source: source,
+			Filename: dir,
+			Error: err.Error(),
+			Time: time.Now(),
+		}}
+	}
+
+	var errors []PluginError
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".so") {
+			continue
+		}
+		fname := filepath.Join(dir, fi.Name())
+		before := make(map[string]bool)
+		for name := range Executors {
+			before[name] = true
+		}
+		if _, err := plugin.Open(fname); err != nil {
+			log.Printf("[plugins] error loading %s: %v", fname, err)
+			errors = append(errors, PluginError{
+				Source: source,
+				Filename: fi.Name(),
+				Error: err.Error(),
+				Time: time.Now(),
+			})
+			continue
+		}
+		var added []string
+		for name := range Executors {
+			if !before[name] {
+				added = append(added, name)
+			}
+		}
+		sort.Strings(added)
+		log.Printf("[plugins] loaded %s (new executors: %v)", fname, added)
+	}
+	return errors
+}
@@ -0,0 +1,53 @@
+package vaas
+
+import (
+	gomapinfer "github.com/mitroadmaps/gomapinfer/common"
+)
+
+// A box (if there are two points) or polygon, specified by a list of points.
+type Shape [][2]int
+
+func (shp Shape) Bounds() gomapinfer.Rectangle {
+	r := gomapinfer.EmptyRectangle
+	for _, p := range shp {
+		r = r.Extend(gomapinfer.Point{float64(p[0]), float64(p[1])})
+	}
+	return r
+}
+
+func (shp Shape) Polygon() gomapinfer.Polygon {
+	poly := gomapinfer.Polygon{}
+	for _, p := range shp {
+		poly = append(poly, gomapinfer.Point{float64(p[0]), float64(p[1])})
+	}
+	return poly
+}
+
+// Returns whether the center of the detection is in the shape.
+func (shp Shape) Contains(d Detection) bool {
+	cx := (d.Left + d.Right)/2
+	cy := (d.Top + d.Bottom)/2
+	point := gomapinfer.Point{float64(cx), float64(cy)}
+	if len(shp) == 2 {
+		return shp.Bounds().Contains(point)
+	} else {
+		return shp.Polygon().Contains(point)
+	}
+}
+
+// A named region of the frame, used for zone occupancy and origin-destination counts.
+type Zone struct {
+	Name string
+	// in CanvasDims coordinates of the containing configuration
+	Shape Shape
+}
+
+// Returns the index of the first zone containing the center of the detection, or -1.
+func FindZone(zones []Zone, d Detection) int {
+	for i, zone := range zones {
+		if zone.Shape.Contains(d) {
+			return i
+		}
+	}
+	return -1
+}
@@ -64,12 +64,11 @@ func GetStatsByNode(containers [][]Container) map[int]StatsSample {
 	stats := make(map[int]StatsSample)
 	for _, clist := range containers {
 		for _, container := range clist {
-			statsMap := make(map[int]StatsSample)
-			err := JsonPost(container.BaseURL, "/allstats", nil, &statsMap)
+			containerStats, err := GetContainerStats(container)
 			if err != nil {
 				panic(err)
 			}
-			for nodeID, sample := range statsMap {
+			for nodeID, sample := range containerStats.Nodes {
 				stats[nodeID] = stats[nodeID].Add(sample)
 			}
 		}
@@ -0,0 +1,599 @@
+package vaas
+
+/*
+Stream transport between the coordinator and containers, and between containers.
+
+ExecContext.GetBuffer used to perform one HTTP POST to /query/start for each node,
+re-sending the full ExecContext each time. Instead, callers keep one persistent
+TCP connection to each container (established by upgrading a request to /stream
+so it shares the container port and authentication), and multiplex streams of
+DataBuffer contents over it.
+
+Each frame is [type (1 byte)] [stream ID (4 bytes)] [payload length (4 bytes)] [payload].
+The ExecContext is sent once per context UUID on each connection (frameContext),
+and then each node buffer is requested with a frameStart on a new stream ID.
+The container replies with frameData chunks and then a frameEnd.
+
+Flow control is per stream: the container may only send StreamWindow bytes that
+the reader hasn't consumed yet, and the reader returns credit with frameWindow
+as it reads. So a slow consumer of one stream doesn't block the other streams,
+and the container doesn't buffer unbounded output in the socket.
+
+The container closes connections that have no streams for StreamIdleTimeout,
+and callers re-connect before then instead of re-using a connection that may be
+about to close.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const StreamProtocol = "vaas-stream"
+
+// Maximum bytes that a container sends on a stream before the reader acknowledges them.
+const StreamWindow = 1024*1024
+
+// Maximum payload of a frameData, and the minimum credit returned in a frameWindow.
+const StreamChunkSize = 64*1024
+
+// Number of context UUIDs per connection that we remember sending.
+// If the container doesn't have a context, it asks for it again.
+const StreamContextCache = 256
+
+// Maximum payload of any frame. This mostly limits frameContext, since the
+// ExecContext includes the node states and the selector mask.
+const StreamMaxFrame = 64*1024*1024
+
+// The container closes connections that have no streams for this long.
+const StreamIdleTimeout = 5*time.Minute
+
+// Writing a frame fails if the peer doesn't accept it within this long.
+const StreamWriteTimeout = 30*time.Second
+
+const (
+	// client -> container: JSON ExecContext
+	frameContext byte = 1
+	// client -> container: JSON streamStart
+	frameStart byte = 2
+	// container -> client: buffer bytes
+	frameData byte = 3
+	// container -> client: error message, or empty if successful
+	frameEnd byte = 4
+	// client -> container: uint32 credit in bytes
+	frameWindow byte = 5
+	// client -> container: stop sending the stream
+	frameCancel byte = 6
+	// container -> client: container doesn't have the context for a frameStart
+	frameNeedContext byte = 7
+)
+
+type streamStart struct {
+	UUID string
+	NodeID int
+}
+
+func writeFrame(w io.Writer, t byte, id uint32, payload []byte) error {
+	if len(payload) > StreamMaxFrame {
+		return fmt.Errorf("frame payload is %d bytes (limit %d)", len(payload), StreamMaxFrame)
+	}
+	frame := make([]byte, 9+len(payload))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[9:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, uint32, []byte, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > StreamMaxFrame {
+		return 0, 0, nil, fmt.Errorf("frame payload is %d bytes (limit %d)", length, StreamMaxFrame)
+	}
+	payload := make([]byte, int(length))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:5]), payload, nil
+}
+
+// Client side of a connection to a container.
+type streamConn struct {
+	baseURL string
+	conn net.Conn
+	// serializes frame writes
+	wmu sync.Mutex
+
+	mu sync.Mutex
+	streams map[uint32]*clientStream
+	nextID uint32
+	// context UUIDs that were sent, and whether the sent context had a Mask
+	// the context is sent again once the coordinator sets the Mask (after computing
+	// the selector under the same UUID)
+	sentContexts map[string]bool
+	sentOrder []string
+	// when the last stream was opened or finished
+	lastUsed time.Time
+	err error
+}
+
+type clientStream struct {
+	c *streamConn
+	id uint32
+	start streamStart
+	context ExecContext
+
+	mu sync.Mutex
+	cond *sync.Cond
+	chunks [][]byte
+	// bytes read but not yet acknowledged with a frameWindow
+	unacked int
+	done bool
+	err error
+}
+
+var streamConns = make(map[string]*streamConn)
+var streamConnsMu sync.Mutex
+
+func getStreamConn(baseURL string) (*streamConn, error) {
+	streamConnsMu.Lock()
+	c := streamConns[baseURL]
+	if c != nil {
+		c.mu.Lock()
+		idle := len(c.streams) == 0 && time.Now().Sub(c.lastUsed) > StreamIdleTimeout/2
+		c.mu.Unlock()
+		if !idle {
+			streamConnsMu.Unlock()
+			return c, nil
+		}
+		// the container may close it soon
+		delete(streamConns, baseURL)
+	}
+	streamConnsMu.Unlock()
+	if c != nil {
+		c.fail(fmt.Errorf("connection is idle"))
+	}
+
+	// dial without the lock so that a slow container doesn't block connections
+	// to other containers
+	c, err := dialStream(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	streamConnsMu.Lock()
+	defer streamConnsMu.Unlock()
+	if other := streamConns[baseURL]; other != nil {
+		// another caller connected first
+		c.conn.Close()
+		return other, nil
+	}
+	streamConns[baseURL] = c
+	return c, nil
+}
+
+func dialStream(baseURL string) (*streamConn, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", baseURL, err)
+	}
+	req, err := http.NewRequest("GET", baseURL + "/stream", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", StreamProtocol)
+	if AuthSecret() != "" {
+		req.Header.Set(AuthHeader, AuthSecret())
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s: %v", baseURL, err)
+	}
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s: %v", baseURL, err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s: HTTP error %d", baseURL, resp.StatusCode)
+	}
+	c := &streamConn{
+		baseURL: baseURL,
+		conn: conn,
+		streams: make(map[uint32]*clientStream),
+		sentContexts: make(map[string]bool),
+		lastUsed: time.Now(),
+	}
+	go c.readLoop(rd)
+	return c, nil
+}
+
+func (c *streamConn) writeFrame(t byte, id uint32, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	return writeFrame(c.conn, t, id, payload)
+}
+
+// Close the connection and fail all of its streams.
+func (c *streamConn) fail(err error) {
+	streamConnsMu.Lock()
+	if streamConns[c.baseURL] == c {
+		delete(streamConns, c.baseURL)
+	}
+	streamConnsMu.Unlock()
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	streams := c.streams
+	c.streams = make(map[uint32]*clientStream)
+	c.mu.Unlock()
+	c.conn.Close()
+	for _, s := range streams {
+		s.finish(fmt.Errorf("stream connection to %s failed: %v", c.baseURL, err))
+	}
+}
+
+func (c *streamConn) readLoop(rd io.Reader) {
+	for {
+		t, id, payload, err := readFrame(rd)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		s := c.streams[id]
+		if t == frameEnd {
+			delete(c.streams, id)
+			c.lastUsed = time.Now()
+		}
+		c.mu.Unlock()
+		if s == nil {
+			// stream was closed by the reader
+			continue
+		}
+		switch t {
+		case frameData:
+			s.push(payload)
+		case frameEnd:
+			if len(payload) > 0 {
+				s.finish(fmt.Errorf("%s", string(payload)))
+			} else {
+				s.finish(nil)
+			}
+		case frameNeedContext:
+			go func() {
+				if err := c.writeFrame(frameContext, 0, JsonMarshal(s.context)); err != nil {
+					c.fail(err)
+					return
+				}
+				if err := c.writeFrame(frameStart, s.id, JsonMarshal(s.start)); err != nil {
+					c.fail(err)
+				}
+			}()
+		}
+	}
+}
+
+// Request the output buffer of a node from the container.
+func (c *streamConn) open(context ExecContext, nodeID int) (*clientStream, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	s := &clientStream{
+		c: c,
+		id: c.nextID,
+		start: streamStart{context.UUID, nodeID},
+		context: context,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	c.streams[s.id] = s
+	c.lastUsed = time.Now()
+	masked, sent := c.sentContexts[context.UUID]
+	sendContext := !sent || (context.Mask != nil && !masked)
+	if sendContext {
+		c.sentContexts[context.UUID] = context.Mask != nil
+	}
+	if !sent {
+		c.sentOrder = append(c.sentOrder, context.UUID)
+		if len(c.sentOrder) > StreamContextCache {
+			delete(c.sentContexts, c.sentOrder[0])
+			c.sentOrder = c.sentOrder[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	if sendContext {
+		if err := c.writeFrame(frameContext, 0, JsonMarshal(context)); err != nil {
+			c.fail(err)
+			return nil, err
+		}
+	}
+	if err := c.writeFrame(frameStart, s.id, JsonMarshal(s.start)); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *clientStream) push(b []byte) {
+	s.mu.Lock()
+	s.chunks = append(s.chunks, b)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *clientStream) finish(err error) {
+	s.mu.Lock()
+	if !s.done {
+		s.done = true
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *clientStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.chunks) == 0 && !s.done {
+		s.cond.Wait()
+	}
+	if len(s.chunks) == 0 {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n := copy(p, s.chunks[0])
+	s.chunks[0] = s.chunks[0][n:]
+	if len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+	}
+	s.unacked += n
+	var credit int
+	if s.unacked >= StreamChunkSize && !s.done {
+		credit = s.unacked
+		s.unacked = 0
+	}
+	s.mu.Unlock()
+
+	if credit > 0 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(credit))
+		if err := s.c.writeFrame(frameWindow, s.id, b); err != nil {
+			s.c.fail(err)
+		}
+	}
+	return n, nil
+}
+
+func (s *clientStream) Close() error {
+	s.mu.Lock()
+	done := s.done
+	s.done = true
+	if s.err == nil && !done {
+		s.err = fmt.Errorf("stream closed")
+	}
+	s.chunks = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if done {
+		return nil
+	}
+	s.c.mu.Lock()
+	delete(s.c.streams, s.id)
+	s.c.lastUsed = time.Now()
+	s.c.mu.Unlock()
+	return s.c.writeFrame(frameCancel, s.id, nil)
+}
+
+// Open a stream of the output buffer of a node on a remote container.
+func OpenStream(container Container, context ExecContext, nodeID int) (io.ReadCloser, error) {
+	c, err := getStreamConn(container.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(context, nodeID)
+}
+
+// Container side of a connection.
+type streamSession struct {
+	rt *ContainerRuntime
+	conn net.Conn
+	wmu sync.Mutex
+
+	mu sync.Mutex
+	streams map[uint32]*serverStream
+}
+
+type serverStream struct {
+	mu sync.Mutex
+	cond *sync.Cond
+	credit int
+	cancelled bool
+}
+
+func (st *serverStream) cancel() {
+	st.mu.Lock()
+	st.cancelled = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (s *streamSession) writeFrame(t byte, id uint32, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	return writeFrame(s.conn, t, id, payload)
+}
+
+// io.Writer that sends frameData while respecting the stream's credit.
+type streamWriter struct {
+	s *streamSession
+	id uint32
+	st *serverStream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	var total int
+	for len(p) > 0 {
+		w.st.mu.Lock()
+		for w.st.credit == 0 && !w.st.cancelled {
+			w.st.cond.Wait()
+		}
+		if w.st.cancelled {
+			w.st.mu.Unlock()
+			return total, fmt.Errorf("stream cancelled")
+		}
+		n := len(p)
+		if n > w.st.credit {
+			n = w.st.credit
+		}
+		if n > StreamChunkSize {
+			n = StreamChunkSize
+		}
+		w.st.credit -= n
+		w.st.mu.Unlock()
+
+		if err := w.s.writeFrame(frameData, w.id, p[:n]); err != nil {
+			return total, err
+		}
+		p = p[n:]
+		total += n
+	}
+	return total, nil
+}
+
+func (s *streamSession) run(id uint32, st *serverStream, context ExecContext, nodeID int) {
+	node := context.Nodes[nodeID]
+	err := s.rt.Serve(context, nodeID, streamWriter{s, id, st})
+	var msg string
+	if err != nil {
+		log.Printf("[node %s %v] error writing buffer: %v", node.Name, context.Slice, err)
+		msg = err.Error()
+	}
+	s.mu.Lock()
+	delete(s.streams, id)
+	if len(s.streams) == 0 {
+		s.conn.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+	}
+	s.mu.Unlock()
+	s.writeFrame(frameEnd, id, []byte(msg))
+}
+
+func (s *streamSession) serve(rd io.Reader) {
+	defer func() {
+		s.conn.Close()
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.cancel()
+		}
+		s.mu.Unlock()
+	}()
+	// there is a read deadline only while the connection has no streams
+	s.conn.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+	for {
+		t, id, payload, err := readFrame(rd)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Printf("[stream] closing idle connection from %s", s.conn.RemoteAddr())
+			return
+		} else if err != nil {
+			if err != io.EOF {
+				log.Printf("[stream] error reading from %s: %v", s.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+
+		switch t {
+		case frameContext:
+			var context ExecContext
+			JsonUnmarshal(payload, &context)
+			s.rt.setContext(context)
+		case frameStart:
+			var start streamStart
+			JsonUnmarshal(payload, &start)
+			context, ok := s.rt.getContext(start.UUID)
+			if !ok {
+				s.writeFrame(frameNeedContext, id, nil)
+				continue
+			}
+			st = &serverStream{credit: StreamWindow}
+			st.cond = sync.NewCond(&st.mu)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.conn.SetReadDeadline(time.Time{})
+			s.mu.Unlock()
+			go s.run(id, st, context, start.NodeID)
+		case frameWindow:
+			if st == nil || len(payload) != 4 {
+				continue
+			}
+			st.mu.Lock()
+			st.credit += int(binary.BigEndian.Uint32(payload))
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		case frameCancel:
+			if st != nil {
+				st.cancel()
+			}
+		}
+	}
+}
+
+// Handle an upgrade request to /stream on a container.
+func ServeStream(rt *ContainerRuntime, w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != StreamProtocol {
+		http.Error(w, "expected upgrade to " + StreamProtocol, 400)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support upgrade", 500)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("[stream] error upgrading connection: %v", err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + StreamProtocol + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	s := &streamSession{
+		rt: rt,
+		conn: conn,
+		streams: make(map[uint32]*serverStream),
+	}
+	s.serve(rw.Reader)
+}
@@ -0,0 +1,206 @@
+package vaas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Outputs 0, 1, ..., N-1 where N is node.Code.
+type streamTestExecutor struct {
+	node Node
+}
+
+func (e streamTestExecutor) Run(ctx ExecContext) DataBuffer {
+	buf := NewSimpleBuffer(IntType)
+	go func() {
+		buf.SetMeta(1)
+		n := ParseInt(e.node.Code)
+		for i := 0; i < n; i += 1000 {
+			var data IntData
+			for j := i; j < i+1000 && j < n; j++ {
+				data = append(data, j)
+			}
+			buf.Write(data)
+		}
+		buf.Close()
+	}()
+	return buf
+}
+
+func (e streamTestExecutor) Close() {}
+
+func init() {
+	Executors["stream-test"] = ExecutorMeta{
+		New: func(node Node) Executor {
+			return streamTestExecutor{node}
+		},
+	}
+}
+
+func newStreamTestServer() (*ContainerRuntime, *httptest.Server) {
+	rt := NewContainerRuntime("stream-test", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeStream(rt, w, r)
+	}))
+	return rt, server
+}
+
+func streamTestContext(uuid string, lengths []int) ExecContext {
+	context := ExecContext{
+		Nodes: make(map[int]*Node),
+		UUID: uuid,
+		Opts: ExecOptions{NoPersist: true},
+	}
+	for i, length := range lengths {
+		context.Nodes[i+1] = &Node{
+			ID: i+1,
+			Name: fmt.Sprintf("node%d", i+1),
+			Type: "stream-test",
+			DataType: IntType,
+			Code: fmt.Sprintf("%d", length),
+		}
+	}
+	return context
+}
+
+// Reads the stream of a node and checks that it has 0, 1, ..., length-1.
+func checkStream(container Container, context ExecContext, nodeID int, length int) error {
+	rd, err := OpenStream(container, context, nodeID)
+	if err != nil {
+		return err
+	}
+	buf := NewSimpleBuffer(IntType)
+	buf.FromReader(rd)
+	rd.Close()
+	data, err := buf.Reader().Read(length+1)
+	if err == io.EOF {
+		data = IntData{}
+	} else if err != nil {
+		return err
+	}
+	ints := data.(IntData)
+	if len(ints) != length {
+		return fmt.Errorf("node %d: expected %d outputs but got %d", nodeID, length, len(ints))
+	}
+	for i, x := range ints {
+		if x != i {
+			return fmt.Errorf("node %d: expected %d at position %d but got %d", nodeID, i, i, x)
+		}
+	}
+	return nil
+}
+
+func TestStreamConcurrent(t *testing.T) {
+	rt, server := newStreamTestServer()
+	defer server.Close()
+	defer rt.Close()
+	container := Container{UUID: "stream-test", BaseURL: server.URL}
+
+	// the larger outputs exceed StreamWindow, so they need credit from the reader
+	lengths := []int{10, 500000, 1, 250000, 0, 400000, 3000, 500000}
+	context := streamTestContext("ctx1", lengths)
+	errs := make([]error, len(lengths))
+	var wg sync.WaitGroup
+	for i, length := range lengths {
+		wg.Add(1)
+		go func(i int, length int) {
+			defer wg.Done()
+			errs[i] = checkStream(container, context, i+1, length)
+		}(i, length)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamContextCacheMiss(t *testing.T) {
+	rt, server := newStreamTestServer()
+	defer server.Close()
+	defer rt.Close()
+	container := Container{UUID: "stream-test", BaseURL: server.URL}
+
+	context := streamTestContext("ctx2", []int{100, 200})
+	if err := checkStream(container, context, 1, 100); err != nil {
+		t.Fatal(err)
+	}
+	// the container forgets the context, but the connection remembers sending it,
+	// so the container has to ask for it with frameNeedContext
+	rt.Finish(context.UUID)
+	if _, ok := rt.getContext(context.UUID); ok {
+		t.Fatalf("expected context to be released")
+	}
+	if err := checkStream(container, context, 2, 200); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rt.getContext(context.UUID); !ok {
+		t.Fatalf("expected context to be sent again")
+	}
+}
+
+func TestStreamFrameLimit(t *testing.T) {
+	header := make([]byte, 9)
+	header[0] = frameData
+	binary.BigEndian.PutUint32(header[5:9], StreamMaxFrame+1)
+	_, _, _, err := readFrame(bytes.NewReader(header))
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("expected frame size error but got %v", err)
+	}
+	if err := writeFrame(new(bytes.Buffer), frameData, 1, make([]byte, StreamMaxFrame+1)); err == nil {
+		t.Fatalf("expected error writing oversized frame")
+	}
+}
+
+func TestStreamIdleReconnect(t *testing.T) {
+	rt, server := newStreamTestServer()
+	defer server.Close()
+	defer rt.Close()
+	container := Container{UUID: "stream-test", BaseURL: server.URL}
+
+	context := streamTestContext("ctx3", []int{100, 200})
+	if err := checkStream(container, context, 1, 100); err != nil {
+		t.Fatal(err)
+	}
+	streamConnsMu.Lock()
+	old := streamConns[server.URL]
+	streamConnsMu.Unlock()
+	old.mu.Lock()
+	old.lastUsed = time.Now().Add(-StreamIdleTimeout)
+	old.mu.Unlock()
+
+	// the idle connection is replaced instead of re-used
+	done := make(chan error, 1)
+	go func() {
+		done <- checkStream(container, context, 2, 200)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10*time.Second):
+		t.Fatalf("timed out opening a stream after the connection was idle")
+	}
+	streamConnsMu.Lock()
+	c := streamConns[server.URL]
+	streamConnsMu.Unlock()
+	if c == nil || c == old {
+		t.Fatalf("expected a new connection")
+	}
+	old.mu.Lock()
+	err := old.err
+	old.mu.Unlock()
+	if err == nil {
+		t.Fatalf("expected the idle connection to be closed")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 func ReadTextFile(fname string) string {
@@ -78,7 +79,7 @@ func JsonPost(baseURL string, path string, request interface{}, response interfa
 	if request != nil {
 		body = bytes.NewBuffer(JsonMarshal(request))
 	}
-	resp, err := http.Post(baseURL + path, "application/json", body)
+	resp, err := InternalClient.Post(baseURL + path, "application/json", body)
 	if err != nil {
 		return fmt.Errorf("error performing HTTP request: %v", err)
 	}
@@ -121,8 +122,15 @@ type Cmd struct {
 	// if not nil, means PrintStderr will send last line it got before exiting
 	stderrCh chan string
 	closed bool
+
+	// last StderrTailLines lines printed to stderr
+	stderrTail []string
+	stderrMu sync.Mutex
 }
 
+// How many stderr lines Cmd keeps for StderrTail.
+const StderrTailLines = 50
+
 func (cmd *Cmd) Stdin() io.WriteCloser {
 	return cmd.stdin
 }
@@ -135,6 +143,19 @@ func (cmd *Cmd) Stderr() io.ReadCloser {
 	return cmd.stderr
 }
 
+// Returns the last lines that the command printed to stderr.
+// Only available if the stderr is printed (the default).
+func (cmd *Cmd) StderrTail() []string {
+	cmd.stderrMu.Lock()
+	defer cmd.stderrMu.Unlock()
+	return append([]string{}, cmd.stderrTail...)
+}
+
+// Kill the process without waiting for it to exit.
+func (cmd *Cmd) Kill() error {
+	return cmd.cmd.Process.Kill()
+}
+
 func (cmd *Cmd) Wait() error {
 	if cmd.closed {
 		panic(fmt.Errorf("closed twice"))
@@ -169,6 +190,13 @@ func (cmd *Cmd) printStderr(onlyDebug bool) {
 		} else if err != nil {
 			panic(err)
 		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd.stderrMu.Lock()
+		cmd.stderrTail = append(cmd.stderrTail, line)
+		if len(cmd.stderrTail) > StderrTailLines {
+			cmd.stderrTail = cmd.stderrTail[1:]
+		}
+		cmd.stderrMu.Unlock()
 		line = strings.TrimSpace(line)
 		lastLine = line
 		if !onlyDebug || Debug {